@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errEmailTaken = errors.New("Email is already in use")
+
+// sendVerificationEmail sends a link that confirms the user owns email. The
+// token remembers the address, so changing it in the meantime voids the link.
+func sendVerificationEmail(userID int, email string) {
+	token, err := issueAccountToken(db, userID, accountTokenVerifyEmail, email, verifyEmailTokenTTL, time.Now())
+	if err != nil {
+		log.Printf("Failed to issue verification token for user %d: %v", userID, err)
+		return
+	}
+	sendEmailTo(email, "Confirm your email address",
+		"Welcome! Please confirm your email address by opening this link:\n"+
+			appLink("/verify-email", url.Values{"token": {token}})+"\n\n"+
+			"If you didn't sign up, you can ignore this email.")
+}
+
+// validateNewEmail checks an address is well formed and not taken by anyone
+// other than userID. It returns the address, or the status and error to
+// respond with.
+func validateNewEmail(value string, userID int) (string, int, error) {
+	email, err := parseEmail(value)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	var taken bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND idUser != ?)`, email, userID).Scan(&taken)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if taken {
+		return "", http.StatusConflict, errEmailTaken
+	}
+	return email, 0, nil
+}
+
+// startEmailChange sends a confirmation link to the new address and warns the
+// current one. The address only changes once the link is used.
+func startEmailChange(c echo.Context, userID int, newEmail string) error {
+	token, err := issueAccountToken(db, userID, accountTokenChangeEmail, newEmail, changeEmailTokenTTL, time.Now())
+	if err != nil {
+		return err
+	}
+	recordAudit(c, currentUser(c).UserID, auditActionRequestEmailChange, "user", userID, nil, echo.Map{"newEmail": newEmail})
+
+	sendEmailTo(newEmail, "Confirm your new email address",
+		"Open this link to make this your account's email address:\n"+
+			appLink("/confirm-email", url.Values{"token": {token}})+"\n\n"+
+			"If you didn't ask for this, you can ignore this email.")
+	sendEmail(userID, "Your email address is being changed",
+		"Someone asked to change your account's email address to "+newEmail+". "+
+			"It will change once the new address is confirmed.\n\n"+
+			"If this wasn't you, change your password straight away.")
+	return nil
+}
+
+// VerifyEmail marks an address as confirmed with the token sent to it
+func VerifyEmail(c echo.Context) error {
+	type VerifyRequest struct {
+		Token string `json:"token"`
+	}
+
+	var req VerifyRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Token is required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	userID, email, err := consumeAccountToken(tx, accountTokenVerifyEmail, req.Token, now)
+	if err == errInvalidAccountToken {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check token"})
+	}
+	result, err := tx.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE idUser = ? AND email = ?`,
+		now.Format(time.RFC3339), userID, email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to verify email"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "The email address has changed since this link was sent"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to verify email"})
+	}
+	recordAudit(c, userID, auditActionVerifyEmail, "user", userID, nil, echo.Map{"email": email})
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Email verified"})
+}
+
+// ResendVerification sends the current user a fresh verification link
+func ResendVerification(c echo.Context) error {
+	userID := currentUser(c).UserID
+	var email string
+	var verified bool
+	err := db.QueryRow(`SELECT email, email_verified_at IS NOT NULL FROM users WHERE idUser = ?`, userID).Scan(&email, &verified)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if verified {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Email is already verified"})
+	}
+
+	sendVerificationEmail(userID, email)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Verification email sent"})
+}
+
+// ForgotPassword emails a password reset link. It answers the same whether or
+// not the address belongs to an account, so it can't be used to find out.
+func ForgotPassword(c echo.Context) error {
+	type ForgotRequest struct {
+		Email string `json:"email"`
+	}
+
+	var req ForgotRequest
+	if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Email is required"})
+	}
+	response := echo.Map{"message": "If an account uses that address, a reset link is on its way"}
+
+	var userID int
+	var email string
+	err := db.QueryRow(`SELECT idUser, email FROM users WHERE email = ? COLLATE NOCASE`, strings.TrimSpace(req.Email)).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusOK, response)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	token, err := issueAccountToken(db, userID, accountTokenResetPassword, "", resetPasswordTokenTTL, time.Now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create reset link"})
+	}
+	recordAudit(c, 0, auditActionRequestPasswordReset, "user", userID, nil, nil)
+	sendEmailTo(email, "Reset your password",
+		"Open this link within the hour to choose a new password:\n"+
+			appLink("/reset-password", url.Values{"token": {token}})+"\n\n"+
+			"If you didn't ask for this, you can ignore this email, your password stays the same.")
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. It
+// signs the user out everywhere and lifts any login lockout. Using the link
+// also proves the user owns their address.
+func ResetPassword(c echo.Context) error {
+	type ResetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	var req ResetRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" || req.Password == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Token and password are required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	userID, _, err := consumeAccountToken(tx, accountTokenResetPassword, req.Token, now)
+	if err == errInvalidAccountToken {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check token"})
+	}
+	before := snapshot("user", userID)
+
+	_, err = tx.Exec(`
+        UPDATE users SET password = ?, must_reset_password = 0, tokens_invalid_before = ?,
+               email_verified_at = COALESCE(email_verified_at, ?)
+        WHERE idUser = ?`,
+		req.Password, now.Unix(), now.Format(time.RFC3339), userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update password"})
+	}
+	if err := resetAccountThrottle(tx, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unlock account"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update password"})
+	}
+	recordAudit(c, userID, auditActionResetPassword, "user", userID, before, snapshot("user", userID))
+	sendEmail(userID, "Your password was changed",
+		"Your password was just reset and you were signed out everywhere.\n\n"+
+			"If this wasn't you, reset your password again straight away.")
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Password updated, please log in again"})
+}
+
+// ChangeEmail starts moving the current user to a new address
+func ChangeEmail(c echo.Context) error {
+	type ChangeRequest struct {
+		Email string `json:"email"`
+	}
+
+	var req ChangeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request data"})
+	}
+	userID := currentUser(c).UserID
+	email, status, err := validateNewEmail(req.Email, userID)
+	if err != nil {
+		return c.JSON(status, echo.Map{"error": err.Error()})
+	}
+
+	if err := startEmailChange(c, userID, email); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to start email change"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Check your new address for a confirmation link"})
+}
+
+// ConfirmEmailChange switches to the new address with the token sent to it
+func ConfirmEmailChange(c echo.Context) error {
+	type ConfirmRequest struct {
+		Token string `json:"token"`
+	}
+
+	var req ConfirmRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Token is required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	userID, email, err := consumeAccountToken(tx, accountTokenChangeEmail, req.Token, now)
+	if err == errInvalidAccountToken {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check token"})
+	}
+	// Someone else may have taken the address since the link was sent
+	if _, status, err := validateNewEmail(email, userID); err != nil {
+		return c.JSON(status, echo.Map{"error": err.Error()})
+	}
+	before := snapshot("user", userID)
+
+	_, err = tx.Exec(`UPDATE users SET email = ?, email_verified_at = ? WHERE idUser = ?`, email, now.Format(time.RFC3339), userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to change email"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to change email"})
+	}
+	recordAudit(c, userID, auditActionChangeEmail, "user", userID, before, snapshot("user", userID))
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Email changed", "email": email})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	accountTokenUnlock        = "unlock"
+	accountTokenVerifyEmail   = "verify_email"
+	accountTokenResetPassword = "reset_password"
+	accountTokenChangeEmail   = "change_email"
+	// Not emailed, the challenge between the two steps of a 2FA login
+	accountTokenTwoFactor = "two_factor_login"
+
+	unlockTokenTTL        = 24 * time.Hour
+	verifyEmailTokenTTL   = 48 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+	changeEmailTokenTTL   = 24 * time.Hour
+)
+
+var errInvalidAccountToken = errors.New("Invalid or expired token")
+
+// createAccountTokensTable stores single-use tokens sent to users by email.
+// Only a hash of each token is kept, so the table alone can't be used to take
+// over an account. Data holds whatever the token is for, such as the new
+// address of an email change.
+func createAccountTokensTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS account_tokens (
+		"tokenHash" TEXT NOT NULL PRIMARY KEY,
+		"userID" INTEGER NOT NULL,
+		"purpose" TEXT NOT NULL,
+		"data" TEXT NOT NULL DEFAULT '',
+		"created_at" TEXT,
+		"expires_at" TEXT,
+		"used_at" TEXT,
+		FOREIGN KEY(userID) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	addColumnIfMissing(db, "account_tokens", "data", "TEXT NOT NULL DEFAULT ''")
+	fmt.Println("Account tokens table created")
+}
+
+func hashAccountToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAccountToken creates a token for purpose that expires after ttl and
+// returns it. Unused tokens the user already had for the same purpose stop
+// working.
+func issueAccountToken(exec execer, userID int, purpose, data string, ttl time.Duration, now time.Time) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	_, err := exec.Exec(`UPDATE account_tokens SET used_at = ? WHERE userID = ? AND purpose = ? AND used_at IS NULL`,
+		now.UTC().Format(time.RFC3339), userID, purpose)
+	if err != nil {
+		return "", err
+	}
+	_, err = exec.Exec(`INSERT INTO account_tokens (tokenHash, userID, purpose, data, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		hashAccountToken(token), userID, purpose, data, now.UTC().Format(time.RFC3339), now.Add(ttl).UTC().Format(time.RFC3339))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// accountTokenUser returns who a token was issued to without using it up
+func accountTokenUser(purpose, token string, now time.Time) (int, error) {
+	var userID int
+	err := db.QueryRow(`SELECT userID FROM account_tokens WHERE tokenHash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`,
+		hashAccountToken(token), purpose, now.UTC().Format(time.RFC3339)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidAccountToken
+	}
+	return userID, err
+}
+
+// consumeAccountToken uses up a token and returns the user it was issued to
+// along with its data. Unknown, expired and already used tokens give
+// errInvalidAccountToken.
+func consumeAccountToken(tx *sql.Tx, purpose, token string, now time.Time) (int, string, error) {
+	hash := hashAccountToken(token)
+	var userID int
+	var data string
+	err := tx.QueryRow(`SELECT userID, data FROM account_tokens WHERE tokenHash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`,
+		hash, purpose, now.UTC().Format(time.RFC3339)).Scan(&userID, &data)
+	if err == sql.ErrNoRows {
+		return 0, "", errInvalidAccountToken
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	// Only one of two requests racing with the same token gets to use it
+	result, err := tx.Exec(`UPDATE account_tokens SET used_at = ? WHERE tokenHash = ? AND used_at IS NULL`,
+		now.UTC().Format(time.RFC3339), hash)
+	if err != nil {
+		return 0, "", err
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return 0, "", errInvalidAccountToken
+	}
+	return userID, data, nil
+}
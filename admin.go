@@ -0,0 +1,440 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const adminUsersPageLimit = 50
+
+// AdminUser is a user as admins see them, account state included
+type AdminUser struct {
+	IDUser            int    `json:"idUser"`
+	Username          string `json:"username"`
+	DisplayName       string `json:"displayName"`
+	Email             string `json:"email"`
+	Role              string `json:"role"`
+	Private           bool   `json:"private"`
+	Suspended         bool   `json:"suspended"`
+	SuspendedUntil    string `json:"suspended_until,omitempty"`
+	SuspensionReason  string `json:"suspension_reason,omitempty"`
+	MustResetPassword bool   `json:"mustResetPassword"`
+	Shadowbanned      bool   `json:"shadowbanned"`
+}
+
+// suspendUser suspends an account until expiresAt, or until lifted when it is
+// nil. Suspended users can't log in and their tokens stop working.
+func suspendUser(exec execer, userID int, reason string, expiresAt interface{}) error {
+	_, err := exec.Exec(`UPDATE users SET suspended_at = ?, suspended_until = ?, suspension_reason = ? WHERE idUser = ?`,
+		time.Now().UTC().Format(time.RFC3339), expiresAt, reason, userID)
+	return err
+}
+
+// AdminListUsers lists and searches users. q matches username, display name
+// or email, role, suspended=true and shadowbanned=true narrow the list down.
+func AdminListUsers(c echo.Context) error {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{time.Now().UTC().Format(time.RFC3339)}
+
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		conditions = append(conditions, "(username LIKE ? OR displayName LIKE ? OR email LIKE ?)")
+		pattern := "%" + q + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	if role := c.QueryParam("role"); role != "" {
+		if _, err := parseRole(role); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+		conditions = append(conditions, "role = ?")
+		args = append(args, role)
+	}
+	if c.QueryParam("suspended") == "true" {
+		conditions = append(conditions, "suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > ?)")
+		args = append(args, time.Now().UTC().Format(time.RFC3339))
+	}
+	if c.QueryParam("shadowbanned") == "true" {
+		conditions = append(conditions, "shadowbanned_at IS NOT NULL")
+	}
+
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		var err error
+		if offset, err = strconv.Atoi(c.QueryParam("offset")); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
+		}
+	}
+
+	query := `
+        SELECT idUser, username, displayName, email, role, private,
+               suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > ?),
+               COALESCE(suspended_until, ''), COALESCE(suspension_reason, ''), must_reset_password,
+               shadowbanned_at IS NOT NULL
+        FROM users
+        WHERE ` + strings.Join(conditions, " AND ") + `
+        ORDER BY idUser
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, append(args, adminUsersPageLimit, offset)...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query users"})
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var user AdminUser
+		if err := rows.Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.Email, &user.Role, &user.Private,
+			&user.Suspended, &user.SuspendedUntil, &user.SuspensionReason, &user.MustResetPassword, &user.Shadowbanned); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan user data"})
+		}
+		if !user.Suspended {
+			user.SuspendedUntil, user.SuspensionReason = "", ""
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// bindAdminTarget reads the user an admin action is about. Admins can't act
+// on themselves, so nobody locks the last admin out by accident.
+func bindAdminTarget(c echo.Context, req interface{}, userID *int) error {
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if *userID == 0 {
+		return fmt.Errorf("User ID is required")
+	}
+	if *userID == currentUser(c).UserID {
+		return fmt.Errorf("You cannot do that to your own account")
+	}
+	return nil
+}
+
+// respondUserUpdate turns the result of an update on one user into a response,
+// auditing the action against the user's state before the update
+func respondUserUpdate(c echo.Context, action string, userID int, before interface{}, result sql.Result, err error, message string) error {
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update user: " + err.Error()})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	}
+	audit(c, action, "user", userID, before)
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func AdminSetRole(c echo.Context) error {
+	type RoleRequest struct {
+		UserID int    `json:"userID"`
+		Role   string `json:"role"`
+	}
+
+	var req RoleRequest
+	if err := bindAdminTarget(c, &req, &req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	role, err := parseRole(req.Role)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	before := snapshot("user", req.UserID)
+	result, err := db.Exec(`UPDATE users SET role = ? WHERE idUser = ?`, role, req.UserID)
+	return respondUserUpdate(c, auditActionSetRole, req.UserID, before, result, err, "Role updated")
+}
+
+// AdminSuspendUser suspends an account until expiresAt, or until lifted when
+// no expiry is given. Admins can't be suspended.
+func AdminSuspendUser(c echo.Context) error {
+	type SuspendRequest struct {
+		UserID    int    `json:"userID"`
+		Reason    string `json:"reason"`
+		ExpiresAt string `json:"expiresAt"`
+	}
+
+	var req SuspendRequest
+	if err := bindAdminTarget(c, &req, &req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	state, err := loadAccountState(req.UserID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if state.Role == roleAdmin {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Admins cannot be suspended"})
+	}
+
+	before := snapshot("user", req.UserID)
+	if err := suspendUser(db, req.UserID, reason, expiresAt); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to suspend user: " + err.Error()})
+	}
+	audit(c, auditActionSuspendUser, "user", req.UserID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User suspended", "suspended_until": expiresAt})
+}
+
+func AdminUnsuspendUser(c echo.Context) error {
+	type UnsuspendRequest struct {
+		UserID int `json:"userID"`
+	}
+
+	var req UnsuspendRequest
+	if err := bindAdminTarget(c, &req, &req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	before := snapshot("user", req.UserID)
+	result, err := db.Exec(`UPDATE users SET suspended_at = NULL, suspended_until = NULL, suspension_reason = NULL WHERE idUser = ?`,
+		req.UserID)
+	return respondUserUpdate(c, auditActionUnsuspendUser, req.UserID, before, result, err, "User unsuspended")
+}
+
+// AdminForcePasswordReset signs a user out everywhere and makes them choose a
+// new password before they can do anything else
+func AdminForcePasswordReset(c echo.Context) error {
+	type ResetRequest struct {
+		UserID int `json:"userID"`
+	}
+
+	var req ResetRequest
+	if err := bindAdminTarget(c, &req, &req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	before := snapshot("user", req.UserID)
+	result, err := db.Exec(`UPDATE users SET must_reset_password = 1, tokens_invalid_before = ? WHERE idUser = ?`,
+		time.Now().Unix(), req.UserID)
+	return respondUserUpdate(c, auditActionForcePasswordReset, req.UserID, before, result, err, "Password reset required")
+}
+
+// AdminDeletePost removes any post, in a community or not, with a reason the
+// author is told about
+func AdminDeletePost(c echo.Context) error {
+	type DeleteRequest struct {
+		PostID int    `json:"postID"`
+		Reason string `json:"reason"`
+	}
+
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil || req.PostID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Post ID is required"})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	categoryID, authorID, err := postCommunity(req.PostID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	before := snapshot("post", req.PostID)
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if err := removePost(tx, categoryID, currentUser(c).UserID, req.PostID, authorID, reason); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete post: " + err.Error()})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete post"})
+	}
+	audit(c, modActionRemovePost, "post", req.PostID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post deleted"})
+}
+
+// AdminDeleteComment removes any comment, leaving a placeholder in its thread
+func AdminDeleteComment(c echo.Context) error {
+	type DeleteRequest struct {
+		CommentID int    `json:"commentID"`
+		Reason    string `json:"reason"`
+	}
+
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil || req.CommentID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Comment ID is required"})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var categoryID, authorID int
+	err = db.QueryRow(`
+        SELECT COALESCE(p.categoryID, 0), cm.idUser FROM comments cm
+        JOIN posts p ON p.idPost = cm.idPost
+        WHERE cm.idComment = ? AND cm.deleted_at IS NULL AND cm.removed_at IS NULL`, req.CommentID).Scan(&categoryID, &authorID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Comment not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	before := snapshot("comment", req.CommentID)
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if err := removeComment(tx, categoryID, currentUser(c).UserID, req.CommentID, authorID, reason); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete comment: " + err.Error()})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete comment"})
+	}
+	audit(c, modActionRemoveComment, "comment", req.CommentID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Comment deleted"})
+}
+
+// AdminUpdateCategory edits any category. Setting ownerID hands the community
+// to another user and keeps the previous owner on as a moderator.
+func AdminUpdateCategory(c echo.Context) error {
+	type CategoryRequest struct {
+		CategoryID  int     `json:"categoryID"`
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Mode        *string `json:"mode"`
+		OwnerID     int     `json:"ownerID"`
+	}
+
+	var req CategoryRequest
+	if err := c.Bind(&req); err != nil || req.CategoryID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID is required"})
+	}
+
+	community, err := loadCommunity(req.CategoryID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query category"})
+	}
+	if community == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Category not found"})
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		var taken bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories WHERE name = ? COLLATE NOCASE AND idCategory != ?)`,
+			name, req.CategoryID).Scan(&taken)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
+		if name == "" || taken {
+			return c.JSON(http.StatusConflict, echo.Map{"error": "Name is empty or already taken"})
+		}
+		sets = append(sets, "name = ?")
+		args = append(args, name)
+	}
+	if req.Description != nil {
+		sets = append(sets, "description = ?")
+		args = append(args, *req.Description)
+	}
+	if req.Mode != nil {
+		mode, err := parseCommunityMode(*req.Mode)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+		sets = append(sets, "mode = ?")
+		args = append(args, mode)
+	}
+	if req.OwnerID != 0 {
+		sets = append(sets, "ownerID = ?")
+		args = append(args, req.OwnerID)
+	}
+	if len(sets) == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Nothing to update"})
+	}
+
+	before := snapshot("category", req.CategoryID)
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE categories SET ` + strings.Join(sets, ", ") + ` WHERE idCategory = ?`
+	if _, err := tx.Exec(query, append(args, req.CategoryID)...); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update category: " + err.Error()})
+	}
+	if req.OwnerID != 0 && req.OwnerID != community.OwnerID {
+		_, err := tx.Exec(`UPDATE community_members SET role = 'moderator' WHERE idCategory = ? AND role = 'owner'`, req.CategoryID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update previous owner"})
+		}
+		_, err = tx.Exec(`
+            INSERT INTO community_members (idCategory, idUser, role, status, joined_at) VALUES (?, ?, 'owner', 'accepted', ?)
+            ON CONFLICT(idCategory, idUser) DO UPDATE SET role = 'owner', status = 'accepted'`,
+			req.CategoryID, req.OwnerID, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to set new owner: " + err.Error()})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update category"})
+	}
+	audit(c, auditActionUpdateCategory, "category", req.CategoryID, before)
+
+	updated, err := loadCommunity(req.CategoryID)
+	if err != nil || updated == nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query category"})
+	}
+
+	return c.JSON(http.StatusOK, updated)
+}
+
+// AdminDeleteCategory deletes a category. Its posts stay, without a category.
+func AdminDeleteCategory(c echo.Context) error {
+	type DeleteRequest struct {
+		CategoryID int `json:"categoryID"`
+	}
+
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil || req.CategoryID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID is required"})
+	}
+
+	before := snapshot("category", req.CategoryID)
+	result, err := db.Exec(`DELETE FROM categories WHERE idCategory = ?`, req.CategoryID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete category: " + err.Error()})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Category not found"})
+	}
+	audit(c, auditActionDeleteCategory, "category", req.CategoryID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Category deleted"})
+}
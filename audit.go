@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditPageLimit = 50
+
+	auditActionLogin                = "login"
+	auditActionLoginFailed          = "login_failed"
+	auditActionLoginThrottled       = "login_throttled"
+	auditActionAccountLocked        = "account_locked"
+	auditActionAccountUnlocked      = "account_unlocked"
+	auditActionLoginChallenge       = "login_two_factor_challenge"
+	auditActionEnableTwoFactor      = "enable_two_factor"
+	auditActionDisableTwoFactor     = "disable_two_factor"
+	auditActionRegenerateCodes      = "regenerate_recovery_codes"
+	auditActionVerifyEmail          = "verify_email"
+	auditActionRequestPasswordReset = "request_password_reset"
+	auditActionResetPassword        = "reset_password"
+	auditActionRequestEmailChange   = "request_email_change"
+	auditActionChangeEmail          = "change_email"
+	auditActionUpdatePassword       = "update_password"
+	auditActionUpdateUser           = "update_user"
+	auditActionDeletePost           = "delete_post"
+	auditActionSetRole              = "set_role"
+	auditActionSuspendUser          = "suspend_user"
+	auditActionUnsuspendUser        = "unsuspend_user"
+	auditActionForcePasswordReset   = "force_password_reset"
+	auditActionShadowbanUser        = "shadowban_user"
+	auditActionUnshadowbanUser      = "unshadowban_user"
+	auditActionUpdateCategory       = "update_category"
+	auditActionDeleteCategory       = "delete_category"
+	auditActionUpdateCommunity      = "update_community"
+	auditActionApproveMember        = "approve_member"
+	auditActionDenyMember           = "deny_member"
+	auditActionResolveReports       = "resolve_reports"
+	auditActionCreateRule           = "create_automod_rule"
+	auditActionUpdateRule           = "update_automod_rule"
+	auditActionDeleteRule           = "delete_automod_rule"
+	auditActionSetOverride          = "set_automod_override"
+)
+
+// auditSnapshotQueries read what an audited target looks like, for the
+// before and after snapshots of an entry. Secrets such as passwords are left
+// out on purpose.
+var auditSnapshotQueries = map[string]string{
+	"user": `SELECT idUser, username, displayName, email, email_verified_at, role, private, suspended_at, suspended_until,
+	         suspension_reason, must_reset_password, tokens_invalid_before, shadowbanned_at, totp_enabled_at FROM users WHERE idUser = ?`,
+	"post": `SELECT idPost, userID, categoryID, content_text, status, visibility, deleted_at, removed_at, removed_by,
+	         removal_reason, locked, pinned_at FROM posts WHERE idPost = ?`,
+	"comment": `SELECT idComment, idPost, idUser, content_text, deleted_at, removed_at, removed_by, removal_reason, held_at
+	            FROM comments WHERE idComment = ?`,
+	"message":      `SELECT idMessage, senderID, receiverID, content, held_at FROM messages WHERE idMessage = ?`,
+	"category":     `SELECT idCategory, name, description, ownerID, mode, rules, bannerURL, iconURL FROM categories WHERE idCategory = ?`,
+	"automod_rule": `SELECT idRule, categoryID, ruleType, value, action, dryRun, description FROM automod_rules WHERE idRule = ?`,
+}
+
+// Community bans and memberships are keyed by community and user, these
+// snapshot them for actions on users within a community
+const (
+	auditBanSnapshotQuery    = `SELECT idCategory, idUser, bannedBy, reason, created_at, expires_at FROM community_bans WHERE idCategory = ? AND idUser = ?`
+	auditMemberSnapshotQuery = `SELECT idCategory, idUser, role, status, joined_at FROM community_members WHERE idCategory = ? AND idUser = ?`
+)
+
+// auditMu serializes appends, every entry has to see the hash of the one
+// before it
+var auditMu sync.Mutex
+
+// AuditEntry is one recorded action. Before and After are JSON snapshots of
+// the target, null when there is nothing to show. Hash covers the entry and
+// the previous entry's hash, so editing or dropping an entry breaks the chain
+// from there on.
+type AuditEntry struct {
+	IDEntry    int             `json:"idEntry"`
+	ActorID    int             `json:"actorID"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   int             `json:"targetID"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"userAgent"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  string          `json:"created_at"`
+	PrevHash   string          `json:"prevHash"`
+	Hash       string          `json:"hash"`
+}
+
+func createAuditLogTable(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+		"idEntry" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"actorID" INTEGER NOT NULL DEFAULT 0,
+		"action" TEXT NOT NULL,
+		"targetType" TEXT NOT NULL DEFAULT '',
+		"targetID" INTEGER NOT NULL DEFAULT 0,
+		"ip" TEXT NOT NULL DEFAULT '',
+		"userAgent" TEXT NOT NULL DEFAULT '',
+		"before" TEXT NOT NULL DEFAULT 'null',
+		"after" TEXT NOT NULL DEFAULT 'null',
+		"created_at" TEXT NOT NULL,
+		"prevHash" TEXT NOT NULL,
+		"hash" TEXT NOT NULL
+	);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log (actorID)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log (targetType, targetID)`,
+		// The log is append-only, the database refuses to change or drop entries
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Audit log table created")
+}
+
+// computeHash hashes the entry's fields together with the previous hash
+func (e *AuditEntry) computeHash() string {
+	fields, _ := json.Marshal([]interface{}{
+		e.PrevHash, e.ActorID, e.Action, e.TargetType, e.TargetID, e.IP, e.UserAgent,
+		string(e.Before), string(e.After), e.CreatedAt,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// snapshotRow reads one row into a map keyed by column name, nil when there
+// is no such row
+func snapshotRow(query string, args ...interface{}) map[string]interface{} {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("audit snapshot: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		log.Printf("audit snapshot: %v", err)
+		return nil
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if b, ok := values[i].([]byte); ok {
+			values[i] = string(b)
+		}
+		row[column] = values[i]
+	}
+	return row
+}
+
+// snapshot reads the current state of an audited target, nil when the type
+// has no snapshot or the target doesn't exist
+func snapshot(targetType string, targetID int) map[string]interface{} {
+	query, ok := auditSnapshotQueries[targetType]
+	if !ok {
+		return nil
+	}
+	return snapshotRow(query, targetID)
+}
+
+// appendAudit chains an entry onto the end of the log
+func appendAudit(entry *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT hash FROM audit_log ORDER BY idEntry DESC LIMIT 1`).Scan(&entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	entry.Hash = entry.computeHash()
+
+	_, err = tx.Exec(`INSERT INTO audit_log (actorID, action, targetType, targetID, ip, userAgent, before, after, created_at, prevHash, hash)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.ActorID, entry.Action, entry.TargetType, entry.TargetID, entry.IP, entry.UserAgent,
+		string(entry.Before), string(entry.After), entry.CreatedAt, entry.PrevHash, entry.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordAudit adds an entry for an action that already happened. It runs
+// after the action is committed, so a failure to record is logged rather than
+// undoing the action.
+func recordAudit(c echo.Context, actorID int, action, targetType string, targetID int, before, after interface{}) {
+	entry := AuditEntry{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         c.RealIP(),
+		UserAgent:  c.Request().UserAgent(),
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	var err error
+	if entry.Before, err = json.Marshal(before); err == nil {
+		entry.After, err = json.Marshal(after)
+	}
+	if err == nil {
+		err = appendAudit(&entry)
+	}
+	if err != nil {
+		log.Printf("audit: failed to record %s on %s %d: %v", action, targetType, targetID, err)
+	}
+}
+
+// audit records an action by the current user, snapshotting the target as
+// it is now for the after side
+func audit(c echo.Context, action, targetType string, targetID int, before interface{}) {
+	recordAudit(c, currentUser(c).UserID, action, targetType, targetID, before, snapshot(targetType, targetID))
+}
+
+// GetAuditLog lists audit entries, newest first. actorID, action, targetType,
+// targetID and since/until (RFC3339) narrow the list down.
+func GetAuditLog(c echo.Context) error {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+
+	for _, filter := range []struct{ param, condition string }{
+		{"action", "action = ?"},
+		{"targetType", "targetType = ?"},
+	} {
+		if value := c.QueryParam(filter.param); value != "" {
+			conditions = append(conditions, filter.condition)
+			args = append(args, value)
+		}
+	}
+	for _, filter := range []struct{ param, condition string }{
+		{"actorID", "actorID = ?"},
+		{"targetID", "targetID = ?"},
+	} {
+		if value := c.QueryParam(filter.param); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid " + filter.param + " parameter"})
+			}
+			conditions = append(conditions, filter.condition)
+			args = append(args, id)
+		}
+	}
+	for _, filter := range []struct{ param, condition string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		if value := c.QueryParam(filter.param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid " + filter.param + " parameter, use RFC3339"})
+			}
+			conditions = append(conditions, filter.condition)
+			args = append(args, at.UTC().Format(time.RFC3339))
+		}
+	}
+
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		var err error
+		if offset, err = strconv.Atoi(c.QueryParam("offset")); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
+		}
+	}
+
+	query := `
+        SELECT idEntry, actorID, action, targetType, targetID, ip, userAgent, before, after, created_at, prevHash, hash
+        FROM audit_log
+        WHERE ` + strings.Join(conditions, " AND ") + `
+        ORDER BY idEntry DESC
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, append(args, auditPageLimit, offset)...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query audit log"})
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan audit entry"})
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }) (AuditEntry, error) {
+	var entry AuditEntry
+	var before, after string
+	err := row.Scan(&entry.IDEntry, &entry.ActorID, &entry.Action, &entry.TargetType, &entry.TargetID, &entry.IP,
+		&entry.UserAgent, &before, &after, &entry.CreatedAt, &entry.PrevHash, &entry.Hash)
+	entry.Before, entry.After = json.RawMessage(before), json.RawMessage(after)
+	return entry, err
+}
+
+// VerifyAuditLog walks the whole chain and reports the first entry whose
+// hash doesn't add up or doesn't follow on from the entry before it
+func VerifyAuditLog(c echo.Context) error {
+	rows, err := db.Query(`
+        SELECT idEntry, actorID, action, targetType, targetID, ip, userAgent, before, after, created_at, prevHash, hash
+        FROM audit_log ORDER BY idEntry`)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query audit log"})
+	}
+	defer rows.Close()
+
+	checked, prevHash := 0, ""
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan audit entry"})
+		}
+		problem := ""
+		switch {
+		case entry.PrevHash != prevHash:
+			problem = "Entry does not follow on from the previous entry"
+		case entry.computeHash() != entry.Hash:
+			problem = "Entry hash does not match its contents"
+		}
+		if problem != "" {
+			return c.JSON(http.StatusOK, echo.Map{"valid": false, "checked": checked, "brokenAt": entry.IDEntry, "problem": problem})
+		}
+		prevHash = entry.Hash
+		checked++
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"valid": true, "checked": checked, "head": prevHash})
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	automodKeyword      = "keyword"
+	automodRegex        = "regex"
+	automodDenyDomains  = "link_deny"
+	automodAllowDomains = "link_allow"
+	automodAccountAge   = "account_age"
+	automodMaxLinks     = "max_links"
+	automodRepeated     = "repeated_content"
+
+	automodReject = "reject"
+	automodHold   = "hold"
+	automodFlag   = "flag"
+	// Only valid in overrides, switches a site rule off in one community
+	automodOff = "off"
+
+	// Automod files its reports under this reason code, with no reporter
+	reportReasonAutomod = "automod"
+	// Spam scoring files its reports under the spam reason users pick too
+	reportReasonSpam = "spam"
+
+	automodRepeatWindow  = 24 * time.Hour
+	automodLogPageLimit  = 50
+	maxAutomodRuleLength = 1000
+)
+
+// automodActionRank orders actions so the strictest matching rule wins
+var automodActionRank = map[string]int{automodFlag: 1, automodHold: 2, automodReject: 3}
+
+// automodReasons is what authors are told about a match. The rule itself is
+// not revealed so it can't be worked around by trial and error.
+var automodReasons = map[string]string{
+	automodKeyword:      "contains blocked words",
+	automodRegex:        "matches a blocked pattern",
+	automodDenyDomains:  "links to a blocked site",
+	automodAllowDomains: "links to a site that isn't allowed",
+	automodAccountAge:   "your account is too new",
+	automodMaxLinks:     "contains too many links",
+	automodRepeated:     "repeats content you already posted",
+}
+
+type AutomodRule struct {
+	IDRule      int    `json:"idRule"`
+	CategoryID  int    `json:"categoryID"`
+	RuleType    string `json:"ruleType"`
+	Value       string `json:"value"`
+	Action      string `json:"action"`
+	DryRun      bool   `json:"dryRun"`
+	Description string `json:"description"`
+	CreatedBy   int    `json:"createdBy"`
+	CreatedAt   string `json:"created_at"`
+	// Action set for the requested community, empty when not overridden
+	Override string `json:"override,omitempty"`
+}
+
+type AutomodLogEntry struct {
+	IDLog      int    `json:"idLog"`
+	RuleID     int    `json:"ruleID"`
+	CategoryID int    `json:"categoryID"`
+	UserID     int    `json:"userID"`
+	TargetType string `json:"targetType"`
+	TargetID   int    `json:"targetID"`
+	Action     string `json:"action"`
+	DryRun     bool   `json:"dryRun"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// automodContent is a piece of content about to be written. TargetType is a
+// report target type, CategoryID is 0 outside communities. PostID is set when
+// an existing post is edited so it doesn't count as a repeat of itself.
+type automodContent struct {
+	TargetType string
+	UserID     int
+	CategoryID int
+	PostID     int
+	Text       string
+}
+
+type automodMatch struct {
+	RuleID   int
+	RuleType string
+	Action   string
+	DryRun   bool
+}
+
+// automodVerdict is the outcome of running the rules over some content.
+// Action is the strictest action of the matches not in dry-run, empty when
+// the content goes through untouched. New posts and comments are also spam
+// scored, SpamAction is set when the score decided the action.
+type automodVerdict struct {
+	Content automodContent
+	Action  string
+	Matches []automodMatch
+
+	Scored      bool
+	Fingerprint uint64
+	SpamScore   float64
+	SpamAction  bool
+}
+
+func createAutomodTables(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS automod_rules (
+		"idRule" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"categoryID" INTEGER,
+		"ruleType" TEXT NOT NULL,
+		"value" TEXT NOT NULL,
+		"action" TEXT NOT NULL,
+		"dryRun" INTEGER NOT NULL DEFAULT 0,
+		"description" TEXT,
+		"createdBy" INTEGER,
+		"created_at" TEXT,
+		FOREIGN KEY(categoryID) REFERENCES categories(idCategory) ON DELETE CASCADE,
+		FOREIGN KEY(createdBy) REFERENCES users(idUser) ON DELETE SET NULL
+	);`,
+		`CREATE TABLE IF NOT EXISTS automod_overrides (
+		"idRule" INTEGER,
+		"idCategory" INTEGER,
+		"action" TEXT NOT NULL,
+		PRIMARY KEY(idRule, idCategory),
+		FOREIGN KEY(idRule) REFERENCES automod_rules(idRule) ON DELETE CASCADE,
+		FOREIGN KEY(idCategory) REFERENCES categories(idCategory) ON DELETE CASCADE
+	);`,
+		`CREATE TABLE IF NOT EXISTS automod_log (
+		"idLog" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idRule" INTEGER,
+		"categoryID" INTEGER,
+		"userID" INTEGER,
+		"targetType" TEXT,
+		"targetID" INTEGER,
+		"action" TEXT,
+		"dryRun" INTEGER NOT NULL DEFAULT 0,
+		"created_at" TEXT,
+		FOREIGN KEY(idRule) REFERENCES automod_rules(idRule) ON DELETE SET NULL
+	);`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Automod tables created")
+}
+
+func parseAutomodAction(action string, override bool) (string, error) {
+	if _, ok := automodActionRank[action]; ok || (override && action == automodOff) {
+		return action, nil
+	}
+	if override {
+		return "", errors.New("Action must be reject, hold, flag or off")
+	}
+	return "", errors.New("Action must be reject, hold or flag")
+}
+
+// splitAutomodList turns a comma separated list into trimmed, lowercase
+// entries, dropping empty ones
+func splitAutomodList(value string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// validateAutomodRule checks a rule's value against its type and returns it
+// normalized. Keywords and domains are comma separated lists, the limits are
+// positive numbers: hours for account age, links per post for max links and
+// identical items within automodRepeatWindow for repeated content.
+func validateAutomodRule(ruleType, value string) (string, error) {
+	if len(value) > maxAutomodRuleLength {
+		return "", fmt.Errorf("Value can be at most %d characters", maxAutomodRuleLength)
+	}
+	switch ruleType {
+	case automodKeyword, automodDenyDomains, automodAllowDomains:
+		entries := splitAutomodList(value)
+		if len(entries) == 0 {
+			return "", errors.New("At least one entry is required")
+		}
+		return strings.Join(entries, ","), nil
+	case automodRegex:
+		if _, err := regexp.Compile(value); err != nil || value == "" {
+			return "", errors.New("Invalid regular expression")
+		}
+		return value, nil
+	case automodAccountAge, automodMaxLinks, automodRepeated:
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || limit < 1 {
+			return "", errors.New("Value must be a positive number")
+		}
+		return strconv.Itoa(limit), nil
+	}
+	return "", errors.New("Unknown rule type")
+}
+
+// linkHosts returns the lowercase host of every link in text, without www.
+func linkHosts(text string) []string {
+	hosts := []string{}
+	for _, link := range urlPattern.FindAllString(text, -1) {
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www."))
+	}
+	return hosts
+}
+
+// hostInDomains reports whether host is one of domains or a subdomain of one
+func hostInDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRecentRepeats counts how often a user wrote the same text, ignoring
+// case and surrounding space, in posts other than excludePostID, comments and
+// messages within automodRepeatWindow
+func countRecentRepeats(userID, excludePostID int, text string) (int, error) {
+	since := time.Now().UTC().Add(-automodRepeatWindow).Format(time.RFC3339)
+	text = strings.ToLower(strings.TrimSpace(text))
+	var count int
+	err := db.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM posts WHERE userID = ? AND idPost != ? AND created_at > ? AND LOWER(TRIM(content_text)) = ?)
+             + (SELECT COUNT(*) FROM comments WHERE idUser = ? AND created_at > ? AND LOWER(TRIM(content_text)) = ?)
+             + (SELECT COUNT(*) FROM messages WHERE senderID = ? AND created_at > ? AND LOWER(TRIM(content)) = ?)`,
+		userID, excludePostID, since, text, userID, since, text, userID, since, text).Scan(&count)
+	return count, err
+}
+
+// accountAge returns how long ago a user registered, false for accounts that
+// predate registration times being recorded
+func accountAge(userID int) (time.Duration, bool, error) {
+	var createdAt string
+	err := db.QueryRow(`SELECT COALESCE(created_at, '') FROM users WHERE idUser = ?`, userID).Scan(&createdAt)
+	if err != nil || createdAt == "" {
+		return 0, false, err
+	}
+	at, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return 0, false, nil
+	}
+	return time.Since(at), true, nil
+}
+
+// automodRuleMatches reports whether a single rule matches the content
+func automodRuleMatches(rule AutomodRule, content automodContent, hosts []string) (bool, error) {
+	switch rule.RuleType {
+	case automodKeyword:
+		words := splitAutomodList(rule.Value)
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		pattern, err := regexp.Compile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+		return err == nil && pattern.MatchString(content.Text), nil
+	case automodRegex:
+		pattern, err := regexp.Compile(rule.Value)
+		return err == nil && pattern.MatchString(content.Text), nil
+	case automodDenyDomains, automodAllowDomains:
+		domains := splitAutomodList(rule.Value)
+		for _, host := range hosts {
+			if hostInDomains(host, domains) == (rule.RuleType == automodDenyDomains) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case automodMaxLinks:
+		limit, _ := strconv.Atoi(rule.Value)
+		return len(hosts) > limit, nil
+	case automodAccountAge:
+		hours, _ := strconv.Atoi(rule.Value)
+		age, known, err := accountAge(content.UserID)
+		return known && age < time.Duration(hours)*time.Hour, err
+	case automodRepeated:
+		limit, _ := strconv.Atoi(rule.Value)
+		repeats, err := countRecentRepeats(content.UserID, content.PostID, content.Text)
+		return repeats >= limit, err
+	}
+	return false, nil
+}
+
+// evaluateAutomod runs the rules that apply to content: the site-wide rules,
+// with the community's overrides applied, and the community's own rules
+func evaluateAutomod(content automodContent) (*automodVerdict, error) {
+	rows, err := db.Query(`
+        SELECT r.idRule, r.ruleType, r.value, COALESCE(o.action, r.action), r.dryRun
+        FROM automod_rules r
+        LEFT JOIN automod_overrides o ON o.idRule = r.idRule AND o.idCategory = ?
+        WHERE (r.categoryID IS NULL OR r.categoryID = ?) AND COALESCE(o.action, r.action) != 'off'
+        ORDER BY r.idRule`, content.CategoryID, content.CategoryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AutomodRule
+	for rows.Next() {
+		var rule AutomodRule
+		if err := rows.Scan(&rule.IDRule, &rule.RuleType, &rule.Value, &rule.Action, &rule.DryRun); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	verdict := &automodVerdict{Content: content}
+	hosts := linkHosts(content.Text)
+	for _, rule := range rules {
+		matched, err := automodRuleMatches(rule, content, hosts)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		verdict.Matches = append(verdict.Matches, automodMatch{RuleID: rule.IDRule, RuleType: rule.RuleType, Action: rule.Action, DryRun: rule.DryRun})
+		if !rule.DryRun && automodActionRank[rule.Action] > automodActionRank[verdict.Action] {
+			verdict.Action = rule.Action
+		}
+	}
+	return verdict, nil
+}
+
+// reasons lists what the author is told about the rules that acted on their
+// content, each reason once
+func (v *automodVerdict) reasons() []string {
+	seen := map[string]bool{}
+	reasons := []string{}
+	for _, match := range v.Matches {
+		if reason := automodReasons[match.RuleType]; !match.DryRun && !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// log records every match, dry-run ones included, against targetID. Rejected
+// content was never stored and is logged with a targetID of 0.
+func (v *automodVerdict) log(exec execer, targetID int64) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, match := range v.Matches {
+		_, err := exec.Exec(`INSERT INTO automod_log (idRule, categoryID, userID, targetType, targetID, action, dryRun, created_at)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			match.RuleID, v.Content.CategoryID, v.Content.UserID, v.Content.TargetType, targetID, match.Action, match.DryRun, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply logs the verdict for stored content and carries out its action. Held
+// content is hidden from everyone but its author and, like flagged content,
+// goes into the moderation queue.
+func (v *automodVerdict) apply(exec execer, targetID int64) error {
+	if err := v.log(exec, targetID); err != nil {
+		return err
+	}
+	if err := v.storeFingerprint(exec, targetID); err != nil {
+		return err
+	}
+	if v.Action != automodHold && v.Action != automodFlag {
+		return nil
+	}
+	if v.Action == automodHold {
+		if err := holdContent(exec, v.Content.TargetType, targetID); err != nil {
+			return err
+		}
+	}
+	if v.SpamAction {
+		return fileSystemReport(exec, v.Content.TargetType, targetID, v.Content.CategoryID,
+			reportReasonSpam, fmt.Sprintf("%s: spam score %.2f", v.Action, v.SpamScore))
+	}
+	return fileSystemReport(exec, v.Content.TargetType, targetID, v.Content.CategoryID,
+		reportReasonAutomod, v.Action+": "+strings.Join(v.reasons(), ", "))
+}
+
+// fileSystemReport puts content into the moderation queue of its community,
+// or the site queue, on behalf of the system rather than a user
+func fileSystemReport(exec execer, targetType string, targetID int64, categoryID int, reasonCode, details string) error {
+	var community interface{}
+	if categoryID != 0 {
+		community = categoryID
+	}
+	_, err := exec.Exec(`INSERT INTO reports (reporterID, targetType, targetID, categoryID, reasonCode, details, created_at) VALUES (NULL, ?, ?, ?, ?, ?, ?)`,
+		targetType, targetID, community, reasonCode, details, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// holdContent hides content until a moderator reviews it
+func holdContent(exec execer, targetType string, targetID int64) error {
+	var err error
+	switch targetType {
+	case reportTargetPost:
+		_, err = exec.Exec(`UPDATE posts SET held_status = status, status = ? WHERE idPost = ? AND status != ?`,
+			postStatusHeld, targetID, postStatusHeld)
+	case reportTargetComment:
+		_, err = exec.Exec(`UPDATE comments SET held_at = ? WHERE idComment = ?`, time.Now().UTC().Format(time.RFC3339), targetID)
+	case reportTargetMessage:
+		_, err = exec.Exec(`UPDATE messages SET held_at = ? WHERE idMessage = ?`, time.Now().UTC().Format(time.RFC3339), targetID)
+	}
+	return err
+}
+
+// releaseHeldContent makes held content visible again once a moderator has
+// let it through. Content that isn't held is left alone. Posts go back to the
+// status they had, so a held draft or scheduled post isn't published early.
+func releaseHeldContent(exec execer, targetType string, targetID int) error {
+	var err error
+	switch targetType {
+	case reportTargetPost:
+		_, err = exec.Exec(`UPDATE posts SET status = COALESCE(held_status, ?), held_status = NULL WHERE idPost = ? AND status = ?`,
+			postStatusPublished, targetID, postStatusHeld)
+	case reportTargetComment:
+		_, err = exec.Exec(`UPDATE comments SET held_at = NULL WHERE idComment = ?`, targetID)
+	case reportTargetMessage:
+		_, err = exec.Exec(`UPDATE messages SET held_at = NULL WHERE idMessage = ?`, targetID)
+	}
+	return err
+}
+
+// checkAutomod evaluates content before it is stored. It responds with an
+// error and returns false when the content can't go ahead, either because a
+// rule rejected it or because the rules couldn't be run.
+func checkAutomod(c echo.Context, content automodContent) (*automodVerdict, bool) {
+	verdict, err := evaluateAutomod(content)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to run automatic moderation"})
+		return nil, false
+	}
+	if verdict.Action != automodReject {
+		return verdict, true
+	}
+	if err := verdict.log(db, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log automatic moderation"})
+		return nil, false
+	}
+	c.JSON(http.StatusForbidden, echo.Map{"error": "Blocked by automatic moderation", "reasons": verdict.reasons()})
+	return nil, false
+}
+
+// requireAutomodManager responds with an error and returns false unless the
+// current user may manage the rules of categoryID. Site-wide rules are for
+// admins, community rules for the community's moderators.
+func requireAutomodManager(c echo.Context, categoryID int) bool {
+	if categoryID != 0 {
+		return requireCommunityModerator(c, categoryID)
+	}
+	if !roleAtLeast(currentRole(c), roleAdmin) {
+		c.JSON(http.StatusForbidden, echo.Map{"error": "Only admins can manage site-wide rules"})
+		return false
+	}
+	return true
+}
+
+// loadAutomodRule returns a rule, nil when it doesn't exist
+func loadAutomodRule(ruleID int) (*AutomodRule, error) {
+	var rule AutomodRule
+	err := db.QueryRow(`
+        SELECT idRule, COALESCE(categoryID, 0), ruleType, value, action, dryRun, COALESCE(description, ''),
+               COALESCE(createdBy, 0), created_at
+        FROM automod_rules WHERE idRule = ?`, ruleID).
+		Scan(&rule.IDRule, &rule.CategoryID, &rule.RuleType, &rule.Value, &rule.Action, &rule.DryRun, &rule.Description,
+			&rule.CreatedBy, &rule.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// GetAutomodRules lists the rules in force in a community, site-wide rules
+// with their override included, or only the site-wide rules without a
+// categoryID
+func GetAutomodRules(c echo.Context) error {
+	categoryID := 0
+	if c.QueryParam("categoryID") != "" {
+		var err error
+		if categoryID, err = strconv.Atoi(c.QueryParam("categoryID")); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID"})
+		}
+	}
+	if categoryID == 0 && !isSiteModerator(c) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Only site moderators can do that"})
+	}
+	if categoryID != 0 && !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+
+	rows, err := db.Query(`
+        SELECT r.idRule, COALESCE(r.categoryID, 0), r.ruleType, r.value, r.action, r.dryRun, COALESCE(r.description, ''),
+               COALESCE(r.createdBy, 0), r.created_at, COALESCE(o.action, '')
+        FROM automod_rules r
+        LEFT JOIN automod_overrides o ON o.idRule = r.idRule AND o.idCategory = ?
+        WHERE r.categoryID IS NULL OR r.categoryID = ?
+        ORDER BY r.categoryID IS NOT NULL, r.idRule`, categoryID, categoryID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query rules"})
+	}
+	defer rows.Close()
+
+	rules := []AutomodRule{}
+	for rows.Next() {
+		var rule AutomodRule
+		if err := rows.Scan(&rule.IDRule, &rule.CategoryID, &rule.RuleType, &rule.Value, &rule.Action, &rule.DryRun,
+			&rule.Description, &rule.CreatedBy, &rule.CreatedAt, &rule.Override); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan rule data"})
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+// CreateAutomodRule adds a rule, site-wide or for one community. Dry-run
+// rules only log what they would have done.
+func CreateAutomodRule(c echo.Context) error {
+	type RuleRequest struct {
+		CategoryID  int    `json:"categoryID"`
+		RuleType    string `json:"ruleType"`
+		Value       string `json:"value"`
+		Action      string `json:"action"`
+		DryRun      bool   `json:"dryRun"`
+		Description string `json:"description"`
+	}
+
+	var req RuleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request data"})
+	}
+	value, err := validateAutomodRule(req.RuleType, req.Value)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	action, err := parseAutomodAction(req.Action, false)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if !requireAutomodManager(c, req.CategoryID) {
+		return nil
+	}
+
+	var community interface{}
+	if req.CategoryID != 0 {
+		community = req.CategoryID
+	}
+	result, err := db.Exec(`INSERT INTO automod_rules (categoryID, ruleType, value, action, dryRun, description, createdBy, created_at)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		community, req.RuleType, value, action, req.DryRun, strings.TrimSpace(req.Description), currentUser(c).UserID,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create rule: " + err.Error()})
+	}
+	ruleID, _ := result.LastInsertId()
+	audit(c, auditActionCreateRule, "automod_rule", int(ruleID), nil)
+
+	rule, err := loadAutomodRule(int(ruleID))
+	if err != nil || rule == nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query rule"})
+	}
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+// UpdateAutomodRule changes a rule. Omitted fields stay as they are.
+func UpdateAutomodRule(c echo.Context) error {
+	type RuleRequest struct {
+		RuleID      int     `json:"ruleID"`
+		Value       *string `json:"value"`
+		Action      *string `json:"action"`
+		DryRun      *bool   `json:"dryRun"`
+		Description *string `json:"description"`
+	}
+
+	var req RuleRequest
+	if err := c.Bind(&req); err != nil || req.RuleID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Rule ID is required"})
+	}
+
+	rule, err := loadAutomodRule(req.RuleID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query rule"})
+	}
+	if rule == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Rule not found"})
+	}
+	if !requireAutomodManager(c, rule.CategoryID) {
+		return nil
+	}
+	before := snapshot("automod_rule", rule.IDRule)
+
+	if req.Value != nil {
+		if rule.Value, err = validateAutomodRule(rule.RuleType, *req.Value); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+	}
+	if req.Action != nil {
+		if rule.Action, err = parseAutomodAction(*req.Action, false); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+	}
+	if req.DryRun != nil {
+		rule.DryRun = *req.DryRun
+	}
+	if req.Description != nil {
+		rule.Description = strings.TrimSpace(*req.Description)
+	}
+
+	_, err = db.Exec(`UPDATE automod_rules SET value = ?, action = ?, dryRun = ?, description = ? WHERE idRule = ?`,
+		rule.Value, rule.Action, rule.DryRun, rule.Description, rule.IDRule)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update rule: " + err.Error()})
+	}
+	audit(c, auditActionUpdateRule, "automod_rule", rule.IDRule, before)
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+func DeleteAutomodRule(c echo.Context) error {
+	type DeleteRequest struct {
+		RuleID int `json:"ruleID"`
+	}
+
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil || req.RuleID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Rule ID is required"})
+	}
+
+	rule, err := loadAutomodRule(req.RuleID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query rule"})
+	}
+	if rule == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Rule not found"})
+	}
+	if !requireAutomodManager(c, rule.CategoryID) {
+		return nil
+	}
+
+	before := snapshot("automod_rule", rule.IDRule)
+	if _, err := db.Exec(`DELETE FROM automod_rules WHERE idRule = ?`, rule.IDRule); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to delete rule: " + err.Error()})
+	}
+	audit(c, auditActionDeleteRule, "automod_rule", rule.IDRule, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Rule deleted"})
+}
+
+// SetAutomodOverride changes what a site-wide rule does in one community. An
+// empty action removes the override. Community moderators can tune a rule,
+// only admins can switch one off.
+func SetAutomodOverride(c echo.Context) error {
+	type OverrideRequest struct {
+		RuleID     int    `json:"ruleID"`
+		CategoryID int    `json:"categoryID"`
+		Action     string `json:"action"`
+	}
+
+	var req OverrideRequest
+	if err := c.Bind(&req); err != nil || req.RuleID == 0 || req.CategoryID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Rule ID and category ID are required"})
+	}
+	if req.Action != "" {
+		if _, err := parseAutomodAction(req.Action, true); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+	}
+
+	rule, err := loadAutomodRule(req.RuleID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query rule"})
+	}
+	if rule == nil || rule.CategoryID != 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Site-wide rule not found"})
+	}
+	if !requireCommunityModerator(c, req.CategoryID) {
+		return nil
+	}
+	if req.Action == automodOff && !roleAtLeast(currentRole(c), roleAdmin) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Only admins can switch site-wide rules off"})
+	}
+
+	overrideQuery := `SELECT idRule, idCategory, action FROM automod_overrides WHERE idRule = ? AND idCategory = ?`
+	before := snapshotRow(overrideQuery, req.RuleID, req.CategoryID)
+	if req.Action == "" {
+		_, err = db.Exec(`DELETE FROM automod_overrides WHERE idRule = ? AND idCategory = ?`, req.RuleID, req.CategoryID)
+	} else {
+		_, err = db.Exec(`INSERT OR REPLACE INTO automod_overrides (idRule, idCategory, action) VALUES (?, ?, ?)`,
+			req.RuleID, req.CategoryID, req.Action)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to set override: " + err.Error()})
+	}
+	recordAudit(c, currentUser(c).UserID, auditActionSetOverride, "automod_rule", req.RuleID, before,
+		snapshotRow(overrideQuery, req.RuleID, req.CategoryID))
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Override updated"})
+}
+
+// GetAutomodLog lists what the rules matched, newest first, dry runs
+// included. Without a categoryID site moderators see every entry.
+func GetAutomodLog(c echo.Context) error {
+	categoryID, offset := 0, 0
+	var err error
+	if c.QueryParam("categoryID") != "" {
+		categoryID, offset, err = bindCommunityQuery(c)
+	} else if c.QueryParam("offset") != "" {
+		offset, err = strconv.Atoi(c.QueryParam("offset"))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID or offset"})
+	}
+	if categoryID == 0 && !isSiteModerator(c) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Only site moderators can do that"})
+	}
+	if categoryID != 0 && !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+
+	rows, err := db.Query(`
+        SELECT idLog, COALESCE(idRule, 0), COALESCE(categoryID, 0), userID, targetType, targetID, action, dryRun, created_at
+        FROM automod_log
+        WHERE ? = 0 OR categoryID = ?
+        ORDER BY idLog DESC
+        LIMIT ? OFFSET ?`, categoryID, categoryID, automodLogPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query automod log"})
+	}
+	defer rows.Close()
+
+	entries := []AutomodLogEntry{}
+	for rows.Next() {
+		var entry AutomodLogEntry
+		if err := rows.Scan(&entry.IDLog, &entry.RuleID, &entry.CategoryID, &entry.UserID, &entry.TargetType, &entry.TargetID,
+			&entry.Action, &entry.DryRun, &entry.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan automod log"})
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type BlockedUser struct {
+	IDUser      int    `json:"idUser"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	CreatedAt   string `json:"created_at"`
+	// ExpiresAt is only set for mutes with a time limit
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+func createBlockTables(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS blocks (
+		"blockerID" INTEGER,
+		"blockedID" INTEGER,
+		"created_at" TEXT,
+		PRIMARY KEY(blockerID, blockedID),
+		FOREIGN KEY(blockerID) REFERENCES users(idUser) ON DELETE CASCADE,
+		FOREIGN KEY(blockedID) REFERENCES users(idUser) ON DELETE CASCADE
+	);`,
+		`CREATE TABLE IF NOT EXISTS mutes (
+		"muterID" INTEGER,
+		"mutedID" INTEGER,
+		"created_at" TEXT,
+		"expires_at" TEXT,
+		PRIMARY KEY(muterID, mutedID),
+		FOREIGN KEY(muterID) REFERENCES users(idUser) ON DELETE CASCADE,
+		FOREIGN KEY(mutedID) REFERENCES users(idUser) ON DELETE CASCADE
+	);`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Block and mute tables created")
+}
+
+// notBlockedSQL is the condition that neither the viewer nor the user in
+// column has blocked the other. It takes the viewer ID twice.
+func notBlockedSQL(column string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM blocks bl
+            WHERE (bl.blockerID = ? AND bl.blockedID = %[1]s) OR (bl.blockerID = %[1]s AND bl.blockedID = ?))`, column)
+}
+
+// notMutedSQL returns the condition that the viewer has no active mute on the
+// user in column, with its arguments. Mutes only apply to feeds, so this is
+// added by the feed queries rather than postVisibleSQL.
+func notMutedSQL(column string, viewerID int) (string, []interface{}) {
+	condition := fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM mutes mu
+            WHERE mu.muterID = ? AND mu.mutedID = %s AND (mu.expires_at IS NULL OR mu.expires_at > ?))`, column)
+	return condition, []interface{}{viewerID, time.Now().UTC().Format(time.RFC3339)}
+}
+
+// isBlockedBetween reports whether either user has blocked the other
+func isBlockedBetween(userID, otherID interface{}) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blocks WHERE (blockerID = ? AND blockedID = ?) OR (blockerID = ? AND blockedID = ?))`,
+		userID, otherID, otherID, userID).Scan(&blocked)
+	return blocked, err
+}
+
+func bindTargetUser(c echo.Context) (int, string, error) {
+	type TargetRequest struct {
+		UserID int `json:"userID"`
+		// ExpiresAt (RFC3339) limits a mute, empty mutes until undone
+		ExpiresAt string `json:"expiresAt"`
+	}
+
+	var req TargetRequest
+	if err := c.Bind(&req); err != nil {
+		return 0, "", err
+	}
+	if req.UserID == 0 {
+		return 0, "", errors.New("User ID is required")
+	}
+	if req.UserID == currentUser(c).UserID {
+		return 0, "", errors.New("You cannot do that to yourself")
+	}
+	return req.UserID, req.ExpiresAt, nil
+}
+
+// BlockUser blocks a user and drops follows in both directions, pending
+// requests included
+func BlockUser(c echo.Context) error {
+	targetID, _, err := bindTargetUser(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	userID := currentUser(c).UserID
+	_, err = tx.Exec(`INSERT OR IGNORE INTO blocks (blockerID, blockedID, created_at) VALUES (?, ?, ?)`,
+		userID, targetID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to block user: " + err.Error()})
+	}
+	_, err = tx.Exec(`DELETE FROM subscriptions WHERE (subscriberID = ? AND subscribedToID = ?) OR (subscriberID = ? AND subscribedToID = ?)`,
+		userID, targetID, targetID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove follows: " + err.Error()})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to block user"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User blocked"})
+}
+
+func UnblockUser(c echo.Context) error {
+	targetID, _, err := bindTargetUser(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	result, err := db.Exec(`DELETE FROM blocks WHERE blockerID = ? AND blockedID = ?`, currentUser(c).UserID, targetID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unblock user"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User is not blocked"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User unblocked"})
+}
+
+// MuteUser hides a user's posts from the current user's feeds, until
+// expiresAt when one is given. Muting again replaces the expiry.
+func MuteUser(c echo.Context) error {
+	targetID, expiresAt, err := bindTargetUser(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var expires interface{}
+	if expiresAt != "" {
+		at, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid expiry, expected RFC3339"})
+		}
+		if !at.After(time.Now()) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Expiry must be in the future"})
+		}
+		// Stored in UTC so active mutes can be found by comparing text
+		expires = at.UTC().Format(time.RFC3339)
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO mutes (muterID, mutedID, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		currentUser(c).UserID, targetID, time.Now().UTC().Format(time.RFC3339), expires)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to mute user: " + err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User muted", "expires_at": expires})
+}
+
+func UnmuteUser(c echo.Context) error {
+	targetID, _, err := bindTargetUser(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	result, err := db.Exec(`DELETE FROM mutes WHERE muterID = ? AND mutedID = ?`, currentUser(c).UserID, targetID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unmute user"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User is not muted"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User unmuted"})
+}
+
+func listRestrictedUsers(c echo.Context, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query users"})
+	}
+	defer rows.Close()
+
+	users := []BlockedUser{}
+	for rows.Next() {
+		var user BlockedUser
+		if err := rows.Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.CreatedAt, &user.ExpiresAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan user data"})
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// GetBlockedUsers lists the users the current user has blocked
+func GetBlockedUsers(c echo.Context) error {
+	query := `
+        SELECT u.idUser, u.username, u.displayName, b.created_at, ''
+        FROM blocks b
+        JOIN users u ON u.idUser = b.blockedID
+        WHERE b.blockerID = ?
+        ORDER BY b.created_at DESC`
+	return listRestrictedUsers(c, query, currentUser(c).UserID)
+}
+
+// GetMutedUsers lists the current user's active mutes
+func GetMutedUsers(c echo.Context) error {
+	query := `
+        SELECT u.idUser, u.username, u.displayName, m.created_at, COALESCE(m.expires_at, '')
+        FROM mutes m
+        JOIN users u ON u.idUser = m.mutedID
+        WHERE m.muterID = ? AND (m.expires_at IS NULL OR m.expires_at > ?)
+        ORDER BY m.created_at DESC`
+	return listRestrictedUsers(c, query, currentUser(c).UserID, time.Now().UTC().Format(time.RFC3339))
+}
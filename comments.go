@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// deletedCommentText replaces the content of comments that were deleted
+// while they still had replies
+const deletedCommentText = "[deleted]"
+
+// hiddenCommentText replaces comments between users who blocked each other
+const hiddenCommentText = "[unavailable]"
+
+type CommentRevision struct {
+	IDRevision  int    `json:"idRevision"`
+	IDComment   int    `json:"idComment"`
+	ContentText string `json:"content_text"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func createCommentRevisionsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS comment_revisions (
+		"idRevision" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idComment" INTEGER,
+		"content_text" TEXT,
+		"created_at" TEXT,
+		FOREIGN KEY(idComment) REFERENCES comments(idComment) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Comment revisions table created")
+}
+
+// getCommentOwner returns the author of a live (not tombstoned or removed) comment
+func getCommentOwner(commentID int) (int, error) {
+	var ownerID int
+	err := db.QueryRow(`SELECT idUser FROM comments WHERE idComment = ? AND deleted_at IS NULL AND removed_at IS NULL`, commentID).Scan(&ownerID)
+	return ownerID, err
+}
+
+func EditComment(c echo.Context) error {
+	type EditCommentRequest struct {
+		CommentID   int    `json:"commentID"`
+		ContentText string `json:"contentText"`
+	}
+
+	var req EditCommentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid request format",
+		})
+	}
+
+	if req.CommentID == 0 || req.ContentText == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Comment ID and content text are required",
+		})
+	}
+
+	ownerID, err := getCommentOwner(req.CommentID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "Comment not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if ownerID != currentUser(c).UserID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only edit your own comments",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	// Keep the previous content as a revision before overwriting it
+	query := `
+        INSERT INTO comment_revisions (idComment, content_text, created_at)
+        SELECT idComment, content_text, COALESCE(edited_at, created_at) FROM comments WHERE idComment = ?`
+	if _, err := tx.Exec(query, req.CommentID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to store comment revision",
+		})
+	}
+
+	query = `UPDATE comments SET content_text = ?, edited_at = ? WHERE idComment = ?`
+	if _, err := tx.Exec(query, req.ContentText, now, req.CommentID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to update comment",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to update comment",
+		})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message":   "Comment updated successfully",
+		"edited_at": now,
+	})
+}
+
+func DeleteComment(c echo.Context) error {
+	type DeleteCommentRequest struct {
+		CommentID int `json:"commentID"`
+	}
+
+	var req DeleteCommentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid request format",
+		})
+	}
+
+	if req.CommentID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Comment ID is required",
+		})
+	}
+
+	ownerID, err := getCommentOwner(req.CommentID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "Comment not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if ownerID != currentUser(c).UserID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only delete your own comments",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	tombstoned, err := deleteComment(tx, req.CommentID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to delete comment: " + err.Error(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to delete comment",
+		})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message":    "Comment deleted successfully",
+		"tombstoned": tombstoned,
+	})
+}
+
+// deleteComment tombstones a comment that still has replies and removes it
+// entirely otherwise. Removing a leaf may leave its tombstoned parent without
+// replies, so empty tombstones are cleaned up walking up the thread.
+func deleteComment(tx *sql.Tx, commentID int) (bool, error) {
+	var replies int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM comments WHERE parentID = ?`, commentID).Scan(&replies); err != nil {
+		return false, err
+	}
+
+	if replies > 0 {
+		query := `UPDATE comments SET content_text = '', edited_at = NULL, deleted_at = ? WHERE idComment = ?`
+		if _, err := tx.Exec(query, time.Now().UTC().Format(time.RFC3339), commentID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`DELETE FROM comment_revisions WHERE idComment = ?`, commentID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	for commentID != 0 {
+		var parentID sql.NullInt64
+		if err := tx.QueryRow(`SELECT parentID FROM comments WHERE idComment = ?`, commentID).Scan(&parentID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`DELETE FROM comment_revisions WHERE idComment = ?`, commentID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`DELETE FROM comments WHERE idComment = ?`, commentID); err != nil {
+			return false, err
+		}
+
+		if !parentID.Valid {
+			break
+		}
+
+		// Continue only if the parent is a tombstone that no longer has replies
+		var orphaned bool
+		query := `
+            SELECT deleted_at IS NOT NULL AND NOT EXISTS(SELECT 1 FROM comments WHERE parentID = ?)
+            FROM comments WHERE idComment = ?`
+		if err := tx.QueryRow(query, parentID.Int64, parentID.Int64).Scan(&orphaned); err != nil {
+			return false, err
+		}
+		if !orphaned {
+			break
+		}
+		commentID = int(parentID.Int64)
+	}
+
+	return false, nil
+}
+
+// commentHistoryVisible reports whether the viewer may see a comment's edit
+// history. The comment has to show up in its thread as itself, so deleted,
+// removed and hidden comments keep their history private, as do comments on
+// posts the viewer can't see.
+func commentHistoryVisible(commentID, viewerID int) (bool, error) {
+	visible, visibleArgs := postVisibleSQL("p", viewerID)
+	query := `
+        SELECT EXISTS(SELECT 1 FROM comments cm
+        JOIN posts p ON p.idPost = cm.idPost
+        WHERE cm.idComment = ? AND cm.deleted_at IS NULL AND cm.removed_at IS NULL AND (cm.held_at IS NULL OR cm.idUser = ?)
+          AND ` + notBlockedSQL("cm.idUser") + ` AND ` + notShadowbannedSQL("cm.idUser") + `
+          AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + `)`
+	args := append([]interface{}{commentID, viewerID, viewerID, viewerID, viewerID}, visibleArgs...)
+	var exists bool
+	err := db.QueryRow(query, args...).Scan(&exists)
+	return exists, err
+}
+
+func GetCommentRevisions(c echo.Context) error {
+	commentID, err := strconv.Atoi(c.QueryParam("idComment"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid comment ID format",
+		})
+	}
+	visible, err := commentHistoryVisible(commentID, viewerID(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to query comment",
+		})
+	}
+	if !visible {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "Comment not found",
+		})
+	}
+
+	query := `
+        SELECT idRevision, idComment, content_text, created_at
+        FROM comment_revisions
+        WHERE idComment = ?
+        ORDER BY idRevision DESC`
+	rows, err := db.Query(query, commentID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to query comment revisions",
+		})
+	}
+	defer rows.Close()
+
+	revisions := []CommentRevision{}
+	for rows.Next() {
+		var revision CommentRevision
+		if err := rows.Scan(&revision.IDRevision, &revision.IDComment, &revision.ContentText, &revision.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to scan comment revision",
+			})
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Error iterating over rows",
+		})
+	}
+
+	return c.JSON(http.StatusOK, revisions)
+}
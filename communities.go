@@ -0,0 +1,558 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Public communities can be read and posted to by anyone, restricted ones
+	// can be read by anyone but only members post, private ones are members only
+	communityPublic     = "public"
+	communityRestricted = "restricted"
+	communityPrivate    = "private"
+
+	communityRoleOwner     = "owner"
+	communityRoleModerator = "moderator"
+	communityRoleMember    = "member"
+
+	membershipAccepted = "accepted"
+	membershipPending  = "pending"
+
+	communityMembersPageLimit = 50
+)
+
+// communityColumns selects a Category for categories aliased c
+const communityColumns = `c.idCategory, c.name, COALESCE(c.description, ''), COALESCE(c.ownerID, 0), COALESCE(c.rules, ''),
+            COALESCE(c.bannerURL, ''), COALESCE(c.iconURL, ''), c.mode, COALESCE(c.created_at, ''),
+            (SELECT COUNT(*) FROM community_members cm WHERE cm.idCategory = c.idCategory AND cm.status = 'accepted')`
+
+type CommunityMember struct {
+	IDUser      int    `json:"idUser"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Role        string `json:"role"`
+	Status      string `json:"status"`
+	JoinedAt    string `json:"joined_at"`
+}
+
+func createCommunityMembersTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS community_members (
+		"idCategory" INTEGER,
+		"idUser" INTEGER,
+		"role" TEXT NOT NULL DEFAULT 'member',
+		"status" TEXT NOT NULL DEFAULT 'accepted',
+		"joined_at" TEXT,
+		PRIMARY KEY(idCategory, idUser),
+		FOREIGN KEY(idCategory) REFERENCES categories(idCategory) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Community members table created")
+}
+
+// parseCommunityMode validates a requested community mode, defaulting to public
+func parseCommunityMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return communityPublic, nil
+	case communityPublic, communityRestricted, communityPrivate:
+		return mode, nil
+	}
+	return "", errors.New("Mode must be public, restricted or private")
+}
+
+func scanCommunity(row interface{ Scan(...interface{}) error }) (Category, error) {
+	var category Category
+	err := row.Scan(&category.IDCategory, &category.Name, &category.Description, &category.OwnerID, &category.Rules,
+		&category.BannerURL, &category.IconURL, &category.Mode, &category.CreatedAt, &category.MemberCount)
+	return category, err
+}
+
+// loadCommunity returns the community with the given ID, or nil when there is none
+func loadCommunity(categoryID interface{}) (*Category, error) {
+	category, err := scanCommunity(db.QueryRow(`SELECT `+communityColumns+` FROM categories c WHERE c.idCategory = ?`, categoryID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// communityMembership returns a user's role and membership status in a
+// community, both empty when the user never joined
+func communityMembership(categoryID, userID int) (string, string, error) {
+	var role, status string
+	err := db.QueryRow(`SELECT role, status FROM community_members WHERE idCategory = ? AND idUser = ?`,
+		categoryID, userID).Scan(&role, &status)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return role, status, err
+}
+
+// isCommunityModerator reports whether a user moderates a community. Owners
+// count as moderators.
+func isCommunityModerator(categoryID, userID int) (bool, error) {
+	role, status, err := communityMembership(categoryID, userID)
+	return status == membershipAccepted && (role == communityRoleOwner || role == communityRoleModerator), err
+}
+
+// communityVisibleSQL is the condition that a post row is not in a private
+// community the viewer isn't a member of. It takes the viewer ID once.
+func communityVisibleSQL(alias string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM categories vc
+            WHERE vc.idCategory = %s.categoryID AND vc.mode = 'private' AND NOT EXISTS (SELECT 1 FROM community_members vcm
+                WHERE vcm.idCategory = vc.idCategory AND vcm.idUser = ? AND vcm.status = 'accepted'))`, alias)
+}
+
+// checkCanPost returns the status and error to respond with when a user may
+// not post to a community. Restricted and private communities only take posts
+// from members.
+func checkCanPost(categoryID string, userID int) (int, error) {
+	id, err := strconv.Atoi(categoryID)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("Invalid category ID")
+	}
+	community, err := loadCommunity(id)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Failed to query community")
+	}
+	if community == nil {
+		return http.StatusNotFound, errors.New("Community not found")
+	}
+	banned, err := isBannedFromCommunity(id, userID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Failed to query bans")
+	}
+	if banned {
+		return http.StatusForbidden, errors.New("You are banned from this community")
+	}
+	if community.Mode == communityPublic {
+		return 0, nil
+	}
+	_, status, err := communityMembership(id, userID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Failed to query membership")
+	}
+	if status != membershipAccepted {
+		return http.StatusForbidden, errors.New("Only members can post in this community")
+	}
+	return 0, nil
+}
+
+// canViewCommunity reports whether the viewer may read a community's posts
+// and members
+func canViewCommunity(community *Category, viewerID int) (bool, error) {
+	if community.Mode != communityPrivate {
+		return true, nil
+	}
+	_, status, err := communityMembership(community.IDCategory, viewerID)
+	return status == membershipAccepted, err
+}
+
+func bindCommunityMember(c echo.Context) (int, int, error) {
+	type MemberRequest struct {
+		CategoryID int `json:"categoryID"`
+		UserID     int `json:"userID"`
+	}
+
+	var req MemberRequest
+	if err := c.Bind(&req); err != nil {
+		return 0, 0, err
+	}
+	if req.CategoryID == 0 {
+		return 0, 0, errors.New("Category ID is required")
+	}
+	return req.CategoryID, req.UserID, nil
+}
+
+// requireCommunityModerator responds with an error and returns false unless
+// the current user moderates the community. Site moderators and admins can
+// moderate every community.
+func requireCommunityModerator(c echo.Context, categoryID int) bool {
+	if isSiteModerator(c) {
+		return true
+	}
+	moderator, err := isCommunityModerator(categoryID, currentUser(c).UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+		return false
+	}
+	if !moderator {
+		c.JSON(http.StatusForbidden, echo.Map{"error": "Only moderators can do that"})
+		return false
+	}
+	return true
+}
+
+// UpdateCommunity changes a community's settings. Moderators can edit the
+// description, rules and images, only the owner can change the mode.
+func UpdateCommunity(c echo.Context) error {
+	type CommunityRequest struct {
+		CategoryID  int     `json:"categoryID"`
+		Description *string `json:"description"`
+		Rules       *string `json:"rules"`
+		BannerURL   *string `json:"bannerURL"`
+		IconURL     *string `json:"iconURL"`
+		Mode        *string `json:"mode"`
+	}
+
+	var req CommunityRequest
+	if err := c.Bind(&req); err != nil || req.CategoryID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID is required"})
+	}
+
+	if !requireCommunityModerator(c, req.CategoryID) {
+		return nil
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	columns := []string{"description", "rules", "bannerURL", "iconURL"}
+	for i, value := range []*string{req.Description, req.Rules, req.BannerURL, req.IconURL} {
+		if value != nil {
+			sets = append(sets, columns[i]+" = ?")
+			args = append(args, *value)
+		}
+	}
+	if req.Mode != nil {
+		role, _, err := communityMembership(req.CategoryID, currentUser(c).UserID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+		}
+		if role != communityRoleOwner {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Only the owner can change the mode"})
+		}
+		mode, err := parseCommunityMode(*req.Mode)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+		sets = append(sets, "mode = ?")
+		args = append(args, mode)
+	}
+	if len(sets) == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Nothing to update"})
+	}
+
+	before := snapshot("category", req.CategoryID)
+	query := `UPDATE categories SET ` + strings.Join(sets, ", ") + ` WHERE idCategory = ?`
+	if _, err := db.Exec(query, append(args, req.CategoryID)...); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update community: " + err.Error()})
+	}
+	audit(c, auditActionUpdateCommunity, "category", req.CategoryID, before)
+
+	community, err := loadCommunity(req.CategoryID)
+	if err != nil || community == nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query community"})
+	}
+
+	return c.JSON(http.StatusOK, community)
+}
+
+// JoinCommunity makes the current user a member. Restricted and private
+// communities turn the join into a request for the moderators to approve.
+func JoinCommunity(c echo.Context) error {
+	categoryID, _, err := bindCommunityMember(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	community, err := loadCommunity(categoryID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query community"})
+	}
+	if community == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Community not found"})
+	}
+
+	userID := currentUser(c).UserID
+	banned, err := isBannedFromCommunity(categoryID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query bans"})
+	}
+	if banned {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "You are banned from this community"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	status := membershipAccepted
+	if community.Mode != communityPublic {
+		status = membershipPending
+	}
+	result, err := tx.Exec(`INSERT OR IGNORE INTO community_members (idCategory, idUser, role, status, joined_at) VALUES (?, ?, ?, ?, ?)`,
+		categoryID, userID, communityRoleMember, status, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to join community: " + err.Error()})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Already a member or waiting for approval"})
+	}
+
+	if status == membershipPending {
+		_, err := tx.Exec(`
+            INSERT INTO notifications (idUser, actorID, type, targetID, message, created_at)
+            SELECT idUser, ?, ?, ?, ?, ? FROM community_members
+            WHERE idCategory = ? AND status = 'accepted' AND role IN ('owner', 'moderator')`,
+			userID, notificationCommunityJoinRequest, categoryID, "Requested to join "+community.Name,
+			time.Now().UTC().Format(time.RFC3339), categoryID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to notify moderators: " + err.Error()})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to join community"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Joined community",
+		"pending": status == membershipPending,
+	})
+}
+
+// LeaveCommunity removes the current user's membership or cancels a pending
+// join request. Owners can't leave their own community.
+func LeaveCommunity(c echo.Context) error {
+	categoryID, _, err := bindCommunityMember(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	userID := currentUser(c).UserID
+	role, _, err := communityMembership(categoryID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+	}
+	if role == "" {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Not a member of this community"})
+	}
+	if role == communityRoleOwner {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "The owner cannot leave the community"})
+	}
+
+	if _, err := db.Exec(`DELETE FROM community_members WHERE idCategory = ? AND idUser = ?`, categoryID, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to leave community"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Left community"})
+}
+
+func listCommunityMembers(c echo.Context, categoryID int, status string, offset int) error {
+	query := `
+        SELECT u.idUser, u.username, u.displayName, m.role, m.status, COALESCE(m.joined_at, '')
+        FROM community_members m
+        JOIN users u ON u.idUser = m.idUser
+        WHERE m.idCategory = ? AND m.status = ?
+        ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'moderator' THEN 1 ELSE 2 END, m.joined_at
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, categoryID, status, communityMembersPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query members"})
+	}
+	defer rows.Close()
+
+	members := []CommunityMember{}
+	for rows.Next() {
+		var member CommunityMember
+		if err := rows.Scan(&member.IDUser, &member.Username, &member.DisplayName, &member.Role,
+			&member.Status, &member.JoinedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan member data"})
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, members)
+}
+
+func bindCommunityQuery(c echo.Context) (int, int, error) {
+	categoryID, err := strconv.Atoi(c.QueryParam("categoryID"))
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		if offset, err = strconv.Atoi(c.QueryParam("offset")); err != nil {
+			return 0, 0, err
+		}
+	}
+	return categoryID, offset, nil
+}
+
+// GetCommunityMembers lists a community's members, moderators first. Members
+// of private communities are only listed to other members.
+func GetCommunityMembers(c echo.Context) error {
+	categoryID, offset, err := bindCommunityQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID or offset"})
+	}
+
+	community, err := loadCommunity(categoryID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query community"})
+	}
+	if community == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Community not found"})
+	}
+	allowed, err := canViewCommunity(community, viewerID(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+	}
+	if !allowed {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "This community is private"})
+	}
+
+	return listCommunityMembers(c, categoryID, membershipAccepted, offset)
+}
+
+// GetPendingCommunityMembers lists join requests waiting for a moderator
+func GetPendingCommunityMembers(c echo.Context) error {
+	categoryID, offset, err := bindCommunityQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID or offset"})
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+	return listCommunityMembers(c, categoryID, membershipPending, offset)
+}
+
+// resolveJoinRequest approves or denies a pending join request and lets the
+// requester know
+func resolveJoinRequest(c echo.Context, accept bool) error {
+	categoryID, userID, err := bindCommunityMember(c)
+	if err != nil || userID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID and user ID are required"})
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+	before := snapshotRow(auditMemberSnapshotQuery, categoryID, userID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM community_members WHERE idCategory = ? AND idUser = ? AND status = 'pending'`
+	notificationType, message := notificationCommunityJoinDenied, "Your request to join was denied"
+	if accept {
+		query = `UPDATE community_members SET status = 'accepted', joined_at = ? WHERE idCategory = ? AND idUser = ? AND status = 'pending'`
+		notificationType, message = notificationCommunityJoinApproved, "Your request to join was approved"
+	}
+	args := []interface{}{categoryID, userID}
+	if accept {
+		args = append([]interface{}{time.Now().UTC().Format(time.RFC3339)}, args...)
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update join request"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Join request not found"})
+	}
+	if err := notify(tx, userID, currentUser(c).UserID, notificationType, categoryID, message); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to send notification"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update join request"})
+	}
+	action := auditActionDenyMember
+	if accept {
+		action = auditActionApproveMember
+	}
+	recordAudit(c, currentUser(c).UserID, action, "user", userID, before,
+		snapshotRow(auditMemberSnapshotQuery, categoryID, userID))
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Join request updated", "accepted": accept})
+}
+
+func ApproveCommunityMember(c echo.Context) error {
+	return resolveJoinRequest(c, true)
+}
+
+func DenyCommunityMember(c echo.Context) error {
+	return resolveJoinRequest(c, false)
+}
+
+// setModerator promotes a member to moderator or demotes a moderator back to
+// member. Only the owner can change who moderates.
+func setModerator(c echo.Context, promote bool) error {
+	categoryID, userID, err := bindCommunityMember(c)
+	if err != nil || userID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID and user ID are required"})
+	}
+
+	role, _, err := communityMembership(categoryID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+	}
+	if role != communityRoleOwner {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Only the owner can change moderators"})
+	}
+
+	from, to, action := communityRoleMember, communityRoleModerator, modActionAddModerator
+	if !promote {
+		from, to, action = to, from, modActionRemoveModerator
+	}
+	before := snapshotRow(auditMemberSnapshotQuery, categoryID, userID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE community_members SET role = ? WHERE idCategory = ? AND idUser = ? AND role = ? AND status = 'accepted'`,
+		to, categoryID, userID, from)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update moderators"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "No " + from + " with that user ID"})
+	}
+	if err := logModAction(tx, categoryID, currentUser(c).UserID, action, "user", userID, ""); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log action"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update moderators"})
+	}
+	recordAudit(c, currentUser(c).UserID, action, "user", userID, before,
+		snapshotRow(auditMemberSnapshotQuery, categoryID, userID))
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Moderators updated", "role": to})
+}
+
+func AddCommunityModerator(c echo.Context) error {
+	return setModerator(c, true)
+}
+
+func RemoveCommunityModerator(c echo.Context) error {
+	return setModerator(c, false)
+}
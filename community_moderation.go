@@ -0,0 +1,620 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// communityPinLimit is how many posts a community can pin at once
+	communityPinLimit = 3
+
+	maxRemovalReasonLength = 500
+	modLogPageLimit        = 50
+
+	modActionRemovePost      = "remove_post"
+	modActionRemoveComment   = "remove_comment"
+	modActionLockPost        = "lock_post"
+	modActionUnlockPost      = "unlock_post"
+	modActionPinPost         = "pin_post"
+	modActionUnpinPost       = "unpin_post"
+	modActionBanUser         = "ban_user"
+	modActionUnbanUser       = "unban_user"
+	modActionAddModerator    = "add_moderator"
+	modActionRemoveModerator = "remove_moderator"
+	modActionDismissReports  = "dismiss_reports"
+	modActionWarnUser        = "warn_user"
+)
+
+// removedCommentText replaces comments taken down by a moderator
+const removedCommentText = "[removed]"
+
+type CommunityBan struct {
+	IDUser    int    `json:"idUser"`
+	Username  string `json:"username"`
+	BannedBy  int    `json:"bannedBy"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"created_at"`
+	// ExpiresAt is empty for permanent bans
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+type ModLogEntry struct {
+	IDLog       int    `json:"idLog"`
+	ModeratorID int    `json:"moderatorID"`
+	Moderator   string `json:"moderator"`
+	Action      string `json:"action"`
+	TargetType  string `json:"targetType"`
+	TargetID    int    `json:"targetID"`
+	Reason      string `json:"reason"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func createCommunityModerationTables(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS community_bans (
+		"idCategory" INTEGER,
+		"idUser" INTEGER,
+		"bannedBy" INTEGER,
+		"reason" TEXT,
+		"created_at" TEXT,
+		"expires_at" TEXT,
+		PRIMARY KEY(idCategory, idUser),
+		FOREIGN KEY(idCategory) REFERENCES categories(idCategory) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`,
+		`CREATE TABLE IF NOT EXISTS community_mod_log (
+		"idLog" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idCategory" INTEGER,
+		"moderatorID" INTEGER,
+		"action" TEXT,
+		"targetType" TEXT,
+		"targetID" INTEGER,
+		"reason" TEXT,
+		"created_at" TEXT,
+		FOREIGN KEY(idCategory) REFERENCES categories(idCategory) ON DELETE CASCADE
+	);`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Community ban and moderation log tables created")
+}
+
+// logModAction records a moderator action in the community's moderation log
+func logModAction(exec execer, categoryID, moderatorID int, action, targetType string, targetID int, reason string) error {
+	// Site staff acting outside any community have no community log to write to
+	if categoryID == 0 {
+		return nil
+	}
+	_, err := exec.Exec(`INSERT INTO community_mod_log (idCategory, moderatorID, action, targetType, targetID, reason, created_at)
+              VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		categoryID, moderatorID, action, targetType, targetID, reason, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// isBannedFromCommunity reports whether a user has an active ban in a community
+func isBannedFromCommunity(categoryID, userID int) (bool, error) {
+	var banned bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM community_bans
+            WHERE idCategory = ? AND idUser = ? AND (expires_at IS NULL OR expires_at > ?))`,
+		categoryID, userID, time.Now().UTC().Format(time.RFC3339)).Scan(&banned)
+	return banned, err
+}
+
+// postCommunity returns the community and author of a live post, with a
+// categoryID of 0 for posts outside any community
+func postCommunity(postID int) (int, int, error) {
+	var categoryID, authorID int
+	err := db.QueryRow(`SELECT COALESCE(categoryID, 0), userID FROM posts WHERE idPost = ? AND deleted_at IS NULL`, postID).
+		Scan(&categoryID, &authorID)
+	return categoryID, authorID, err
+}
+
+// checkCanComment returns the status and error to respond with when a user
+// may not comment on a post. Locked posts only take comments from moderators
+// and users banned from the post's community can't comment at all.
+func checkCanComment(postID, userID int) (int, error) {
+	var categoryID int
+	var locked bool
+	err := db.QueryRow(`SELECT COALESCE(categoryID, 0), locked FROM posts WHERE idPost = ?`, postID).Scan(&categoryID, &locked)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Database error")
+	}
+	if categoryID == 0 {
+		return 0, nil
+	}
+
+	banned, err := isBannedFromCommunity(categoryID, userID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Database error")
+	}
+	if banned {
+		return http.StatusForbidden, errors.New("You are banned from this community")
+	}
+	if locked {
+		moderator, err := isCommunityModerator(categoryID, userID)
+		if err != nil {
+			return http.StatusInternalServerError, errors.New("Database error")
+		}
+		if !moderator {
+			return http.StatusForbidden, errors.New("Comments on this post are locked")
+		}
+	}
+	return 0, nil
+}
+
+func validateRemovalReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" || len([]rune(reason)) > maxRemovalReasonLength {
+		return "", fmt.Errorf("Reason must be between 1 and %d characters", maxRemovalReasonLength)
+	}
+	return reason, nil
+}
+
+// parseExpiry validates an optional RFC3339 expiry, returning nil for none.
+// Expiries are stored in UTC so active rows can be found by comparing text.
+func parseExpiry(value string) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, errors.New("Invalid expiry, expected RFC3339")
+	}
+	if !at.After(time.Now()) {
+		return nil, errors.New("Expiry must be in the future")
+	}
+	return at.UTC().Format(time.RFC3339), nil
+}
+
+// removePost soft deletes a post on behalf of a moderator, logs it and tells
+// the author why
+func removePost(tx *sql.Tx, categoryID, moderatorID, postID, authorID int, reason string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := tx.Exec(`UPDATE posts SET deleted_at = ?, removed_at = ?, removed_by = ?, removal_reason = ?, pinned_at = NULL
+              WHERE idPost = ? AND deleted_at IS NULL`, now, now, moderatorID, reason, postID)
+	if err != nil {
+		return err
+	}
+	if err := logModAction(tx, categoryID, moderatorID, modActionRemovePost, "post", postID, reason); err != nil {
+		return err
+	}
+	return notify(tx, authorID, moderatorID, notificationPostRemoved, postID, "Your post was removed: "+reason)
+}
+
+// removeComment marks a comment removed on behalf of a moderator, logs it and
+// tells the author why
+func removeComment(tx *sql.Tx, categoryID, moderatorID, commentID, authorID int, reason string) error {
+	_, err := tx.Exec(`UPDATE comments SET removed_at = ?, removed_by = ?, removal_reason = ? WHERE idComment = ?`,
+		time.Now().UTC().Format(time.RFC3339), moderatorID, reason, commentID)
+	if err != nil {
+		return err
+	}
+	if err := logModAction(tx, categoryID, moderatorID, modActionRemoveComment, "comment", commentID, reason); err != nil {
+		return err
+	}
+	return notify(tx, authorID, moderatorID, notificationCommentRemoved, commentID, "Your comment was removed: "+reason)
+}
+
+// banUser bans a user from a community, dropping their membership. A nil
+// expiresAt bans for good.
+func banUser(tx *sql.Tx, categoryID, moderatorID, userID int, reason string, expiresAt interface{}) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO community_bans (idCategory, idUser, bannedBy, reason, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		categoryID, userID, moderatorID, reason, time.Now().UTC().Format(time.RFC3339), expiresAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM community_members WHERE idCategory = ? AND idUser = ?`, categoryID, userID); err != nil {
+		return err
+	}
+	if err := logModAction(tx, categoryID, moderatorID, modActionBanUser, "user", userID, reason); err != nil {
+		return err
+	}
+	return notify(tx, userID, moderatorID, notificationCommunityBan, categoryID, "You were banned: "+reason)
+}
+
+// requirePostModerator looks up a post's community and responds with an
+// error unless the current user moderates it
+func requirePostModerator(c echo.Context, postID int) (int, int, bool) {
+	categoryID, authorID, err := postCommunity(postID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+		return 0, 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		return 0, 0, false
+	}
+	if categoryID == 0 {
+		c.JSON(http.StatusBadRequest, echo.Map{"error": "Post is not in a community"})
+		return 0, 0, false
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return 0, 0, false
+	}
+	return categoryID, authorID, true
+}
+
+// RemoveCommunityPost takes a post down from its community. The post is soft
+// deleted like an author deletion but its author can't restore it.
+func RemoveCommunityPost(c echo.Context) error {
+	type RemoveRequest struct {
+		PostID int    `json:"postID"`
+		Reason string `json:"reason"`
+	}
+
+	var req RemoveRequest
+	if err := c.Bind(&req); err != nil || req.PostID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Post ID is required"})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	categoryID, authorID, ok := requirePostModerator(c, req.PostID)
+	if !ok {
+		return nil
+	}
+	before := snapshot("post", req.PostID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if err := removePost(tx, categoryID, currentUser(c).UserID, req.PostID, authorID, reason); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove post: " + err.Error()})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove post"})
+	}
+	audit(c, modActionRemovePost, "post", req.PostID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post removed"})
+}
+
+// RemoveCommunityComment takes down a comment on a community post. It stays
+// in the thread as a placeholder so replies keep their parent.
+func RemoveCommunityComment(c echo.Context) error {
+	type RemoveRequest struct {
+		CommentID int    `json:"commentID"`
+		Reason    string `json:"reason"`
+	}
+
+	var req RemoveRequest
+	if err := c.Bind(&req); err != nil || req.CommentID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Comment ID is required"})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var postID, authorID int
+	err = db.QueryRow(`SELECT idPost, idUser FROM comments WHERE idComment = ? AND deleted_at IS NULL AND removed_at IS NULL`,
+		req.CommentID).Scan(&postID, &authorID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Comment not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	categoryID, _, ok := requirePostModerator(c, postID)
+	if !ok {
+		return nil
+	}
+	before := snapshot("comment", req.CommentID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if err := removeComment(tx, categoryID, currentUser(c).UserID, req.CommentID, authorID, reason); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove comment: " + err.Error()})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove comment"})
+	}
+	audit(c, modActionRemoveComment, "comment", req.CommentID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Comment removed"})
+}
+
+func bindPostToggle(c echo.Context) (int, bool, error) {
+	type ToggleRequest struct {
+		PostID int   `json:"postID"`
+		Value  *bool `json:"value"`
+	}
+
+	var req ToggleRequest
+	if err := c.Bind(&req); err != nil {
+		return 0, false, err
+	}
+	if req.PostID == 0 || req.Value == nil {
+		return 0, false, errors.New("Post ID and value are required")
+	}
+	return req.PostID, *req.Value, nil
+}
+
+// LockCommunityPost stops or allows new comments on a community post
+func LockCommunityPost(c echo.Context) error {
+	postID, locked, err := bindPostToggle(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	categoryID, _, ok := requirePostModerator(c, postID)
+	if !ok {
+		return nil
+	}
+	before := snapshot("post", postID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE posts SET locked = ? WHERE idPost = ?`, locked, postID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update post: " + err.Error()})
+	}
+	action := modActionLockPost
+	if !locked {
+		action = modActionUnlockPost
+	}
+	if err := logModAction(tx, categoryID, currentUser(c).UserID, action, "post", postID, ""); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log action"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update post"})
+	}
+	audit(c, action, "post", postID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post updated", "locked": locked})
+}
+
+// PinCommunityPost pins a published post to the top of its community, or
+// unpins it. At most communityPinLimit posts can be pinned at once.
+func PinCommunityPost(c echo.Context) error {
+	postID, pinned, err := bindPostToggle(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	categoryID, _, ok := requirePostModerator(c, postID)
+	if !ok {
+		return nil
+	}
+	before := snapshot("post", postID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	action := modActionUnpinPost
+	var pinnedAt interface{}
+	if pinned {
+		var count int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM posts WHERE categoryID = ? AND pinned_at IS NOT NULL AND deleted_at IS NULL AND idPost != ?`,
+			categoryID, postID).Scan(&count)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+		}
+		if count >= communityPinLimit {
+			return c.JSON(http.StatusConflict, echo.Map{
+				"error": fmt.Sprintf("A community can pin at most %d posts", communityPinLimit),
+			})
+		}
+		action = modActionPinPost
+		pinnedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	result, err := tx.Exec(`UPDATE posts SET pinned_at = ? WHERE idPost = ? AND status = 'published'`, pinnedAt, postID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update post: " + err.Error()})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Only published posts can be pinned"})
+	}
+	if err := logModAction(tx, categoryID, currentUser(c).UserID, action, "post", postID, ""); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log action"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update post"})
+	}
+	audit(c, action, "post", postID, before)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post updated", "pinned": pinned})
+}
+
+// BanFromCommunity bans a user from a community until expiresAt, or for good
+// when no expiry is given. Banned users lose their membership and can't
+// post, comment or join again. Moderators have to be demoted first.
+func BanFromCommunity(c echo.Context) error {
+	type BanRequest struct {
+		CategoryID int    `json:"categoryID"`
+		UserID     int    `json:"userID"`
+		Reason     string `json:"reason"`
+		ExpiresAt  string `json:"expiresAt"`
+	}
+
+	var req BanRequest
+	if err := c.Bind(&req); err != nil || req.CategoryID == 0 || req.UserID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID and user ID are required"})
+	}
+	reason, err := validateRemovalReason(req.Reason)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if !requireCommunityModerator(c, req.CategoryID) {
+		return nil
+	}
+	targetIsModerator, err := isCommunityModerator(req.CategoryID, req.UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+	}
+	if targetIsModerator {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Moderators cannot be banned"})
+	}
+	before := snapshotRow(auditBanSnapshotQuery, req.CategoryID, req.UserID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if err := banUser(tx, req.CategoryID, currentUser(c).UserID, req.UserID, reason, expiresAt); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to ban user: " + err.Error()})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to ban user"})
+	}
+	recordAudit(c, currentUser(c).UserID, modActionBanUser, "user", req.UserID, before,
+		snapshotRow(auditBanSnapshotQuery, req.CategoryID, req.UserID))
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User banned", "expires_at": expiresAt})
+}
+
+func UnbanFromCommunity(c echo.Context) error {
+	categoryID, userID, err := bindCommunityMember(c)
+	if err != nil || userID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Category ID and user ID are required"})
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+	before := snapshotRow(auditBanSnapshotQuery, categoryID, userID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM community_bans WHERE idCategory = ? AND idUser = ?`, categoryID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unban user"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User is not banned"})
+	}
+	if err := logModAction(tx, categoryID, currentUser(c).UserID, modActionUnbanUser, "user", userID, ""); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log action"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unban user"})
+	}
+	recordAudit(c, currentUser(c).UserID, modActionUnbanUser, "user", userID, before, nil)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "User unbanned"})
+}
+
+// GetCommunityBans lists a community's active bans for its moderators
+func GetCommunityBans(c echo.Context) error {
+	categoryID, _, err := bindCommunityQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID"})
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+
+	query := `
+        SELECT u.idUser, u.username, COALESCE(b.bannedBy, 0), COALESCE(b.reason, ''), b.created_at, COALESCE(b.expires_at, '')
+        FROM community_bans b
+        JOIN users u ON u.idUser = b.idUser
+        WHERE b.idCategory = ? AND (b.expires_at IS NULL OR b.expires_at > ?)
+        ORDER BY b.created_at DESC`
+	rows, err := db.Query(query, categoryID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query bans"})
+	}
+	defer rows.Close()
+
+	bans := []CommunityBan{}
+	for rows.Next() {
+		var ban CommunityBan
+		if err := rows.Scan(&ban.IDUser, &ban.Username, &ban.BannedBy, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan ban data"})
+		}
+		bans = append(bans, ban)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, bans)
+}
+
+// GetModLog lists a community's moderation log, newest first. Only
+// moderators can read it.
+func GetModLog(c echo.Context) error {
+	categoryID, offset, err := bindCommunityQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID or offset"})
+	}
+	if !requireCommunityModerator(c, categoryID) {
+		return nil
+	}
+
+	query := `
+        SELECT l.idLog, l.moderatorID, COALESCE(u.username, ''), l.action, l.targetType, l.targetID,
+               COALESCE(l.reason, ''), l.created_at
+        FROM community_mod_log l
+        LEFT JOIN users u ON u.idUser = l.moderatorID
+        WHERE l.idCategory = ?
+        ORDER BY l.idLog DESC
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, categoryID, modLogPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query moderation log"})
+	}
+	defer rows.Close()
+
+	entries := []ModLogEntry{}
+	for rows.Next() {
+		var entry ModLogEntry
+		if err := rows.Scan(&entry.IDLog, &entry.ModeratorID, &entry.Moderator, &entry.Action, &entry.TargetType,
+			&entry.TargetID, &entry.Reason, &entry.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan log entry"})
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
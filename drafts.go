@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	postStatusPublished = "published"
+	postStatusDraft     = "draft"
+	postStatusScheduled = "scheduled"
+	// Held by automatic moderation until a moderator lets the post through
+	postStatusHeld = "held"
+
+	schedulerInterval = 30 * time.Second
+)
+
+// parsePublishState works out the initial status of a post. A publish time
+// takes precedence over the draft flag and has to lie in the future.
+func parsePublishState(draft bool, publishAt string) (string, interface{}, error) {
+	if publishAt != "" {
+		at, err := time.Parse(time.RFC3339, publishAt)
+		if err != nil {
+			return "", nil, errors.New("Invalid publish time, expected RFC3339")
+		}
+		if !at.After(time.Now()) {
+			return "", nil, errors.New("Publish time must be in the future")
+		}
+		// Stored in UTC so the scheduler can compare timestamps as text
+		return postStatusScheduled, at.UTC().Format(time.RFC3339), nil
+	}
+	if draft {
+		return postStatusDraft, nil, nil
+	}
+	return postStatusPublished, nil, nil
+}
+
+// GetDrafts lists the current user's drafts, scheduled posts and posts held
+// for review
+func GetDrafts(c echo.Context) error {
+	type Draft struct {
+		IDPost          int      `json:"idPost"`
+		ContentText     string   `json:"content_text"`
+		CreatedAt       string   `json:"created_at"`
+		CategoryID      int      `json:"categoryID"`
+		Category        string   `json:"category"`
+		ImageURL        string   `json:"imageURL"`
+		SecondaryImages []string `json:"secondaryImages"`
+		Status          string   `json:"status"`
+		PublishAt       string   `json:"publish_at"`
+	}
+
+	query := `
+        SELECT p.idPost, p.content_text, p.created_at, COALESCE(p.categoryID, 0),
+               COALESCE(c.name, ''), COALESCE(p.imageURL, ''), p.status, COALESCE(p.publish_at, '')
+        FROM posts p
+        LEFT JOIN categories c ON p.categoryID = c.idCategory
+        WHERE p.userID = ? AND p.status != 'published' AND p.deleted_at IS NULL
+        ORDER BY p.status = 'scheduled' DESC, p.publish_at, p.created_at DESC`
+	rows, err := db.Query(query, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query drafts"})
+	}
+	defer rows.Close()
+
+	drafts := []Draft{}
+	for rows.Next() {
+		var draft Draft
+		if err := rows.Scan(&draft.IDPost, &draft.ContentText, &draft.CreatedAt, &draft.CategoryID,
+			&draft.Category, &draft.ImageURL, &draft.Status, &draft.PublishAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan draft data"})
+		}
+		drafts = append(drafts, draft)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+	rows.Close()
+
+	for i := range drafts {
+		drafts[i].SecondaryImages = []string{}
+		imageRows, err := db.Query(`SELECT imageURL FROM images WHERE postID = ?`, drafts[i].IDPost)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query secondary images"})
+		}
+		for imageRows.Next() {
+			var imageURL string
+			if err := imageRows.Scan(&imageURL); err != nil {
+				imageRows.Close()
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan image data"})
+			}
+			drafts[i].SecondaryImages = append(drafts[i].SecondaryImages, imageURL)
+		}
+		imageRows.Close()
+	}
+
+	return c.JSON(http.StatusOK, drafts)
+}
+
+// SchedulePost sets or changes the publish time of a draft or scheduled post.
+// An empty publish time turns it back into a draft.
+func SchedulePost(c echo.Context) error {
+	type ScheduleRequest struct {
+		PostID    string `json:"postID"`
+		PublishAt string `json:"publishAt"`
+	}
+
+	var req ScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.PostID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Post ID is required"})
+	}
+
+	status, publishAt, err := parsePublishState(true, req.PublishAt)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	query := `
+        UPDATE posts SET status = ?, publish_at = ?
+        WHERE idPost = ? AND userID = ? AND status IN ('draft', 'scheduled') AND deleted_at IS NULL`
+	result, err := db.Exec(query, status, publishAt, req.PostID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to schedule post: " + err.Error()})
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm update"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Draft not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message":    "Post schedule updated",
+		"status":     status,
+		"publish_at": publishAt,
+	})
+}
+
+// PublishPost publishes a draft or scheduled post right away
+func PublishPost(c echo.Context) error {
+	type PublishRequest struct {
+		PostID string `json:"postID"`
+	}
+
+	var req PublishRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.PostID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Post ID is required"})
+	}
+
+	query := `
+        UPDATE posts SET status = 'published', publish_at = NULL, created_at = ?
+        WHERE idPost = ? AND userID = ? AND status IN ('draft', 'scheduled') AND deleted_at IS NULL`
+	result, err := db.Exec(query, time.Now().UTC().Format(time.RFC3339), req.PostID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to publish post: " + err.Error()})
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm update"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Draft not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post published"})
+}
+
+// publishDuePosts publishes every scheduled post whose time has come. The
+// schedule lives in the database, so posts that fell due while the server
+// was down go out on the first run after a restart.
+func publishDuePosts(now time.Time) (int64, error) {
+	query := `
+        UPDATE posts SET status = 'published', created_at = publish_at, publish_at = NULL
+        WHERE status = 'scheduled' AND publish_at <= ? AND deleted_at IS NULL`
+	result, err := db.Exec(query, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func startScheduledPostPublisher() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		published, err := publishDuePosts(time.Now())
+		if err != nil {
+			log.Printf("Failed to publish scheduled posts: %v", err)
+		} else if published > 0 {
+			log.Printf("Published %d scheduled posts", published)
+		}
+		<-ticker.C
+	}
+}
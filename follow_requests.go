@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type FollowRequest struct {
+	UserID      int    `json:"userID"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	RequestedAt string `json:"requested_at"`
+}
+
+func bindFollowRequestUser(c echo.Context) (int, error) {
+	type FollowRequestBody struct {
+		UserID int `json:"userID"`
+	}
+
+	var req FollowRequestBody
+	if err := c.Bind(&req); err != nil {
+		return 0, err
+	}
+	return req.UserID, nil
+}
+
+// listFollowRequests returns pending requests, joining on the other party:
+// the requester for incoming requests, the account asked for outgoing ones
+func listFollowRequests(c echo.Context, incoming bool) error {
+	query := `
+        SELECT u.idUser, u.username, u.displayName, COALESCE(s.created_at, '')
+        FROM subscriptions s
+        JOIN users u ON u.idUser = s.subscriberID
+        WHERE s.subscribedToID = ? AND s.status = 'pending'
+        ORDER BY s.idSubscription DESC`
+	if !incoming {
+		query = `
+        SELECT u.idUser, u.username, u.displayName, COALESCE(s.created_at, '')
+        FROM subscriptions s
+        JOIN users u ON u.idUser = s.subscribedToID
+        WHERE s.subscriberID = ? AND s.status = 'pending'
+        ORDER BY s.idSubscription DESC`
+	}
+
+	rows, err := db.Query(query, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query follow requests"})
+	}
+	defer rows.Close()
+
+	requests := []FollowRequest{}
+	for rows.Next() {
+		var request FollowRequest
+		if err := rows.Scan(&request.UserID, &request.Username, &request.DisplayName, &request.RequestedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan follow request"})
+		}
+		requests = append(requests, request)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, requests)
+}
+
+// GetIncomingFollowRequests lists users waiting for the current user's approval
+func GetIncomingFollowRequests(c echo.Context) error {
+	return listFollowRequests(c, true)
+}
+
+// GetOutgoingFollowRequests lists private accounts the current user asked to follow
+func GetOutgoingFollowRequests(c echo.Context) error {
+	return listFollowRequests(c, false)
+}
+
+// resolveFollowRequest changes a pending request in one transaction and
+// notifies the other party. When accept is false the request row is removed.
+func resolveFollowRequest(c echo.Context, subscriberID, subscribedToID, notifyUserID int, accept bool, notificationType, message string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ? AND status = 'pending'`
+	if accept {
+		query = `UPDATE subscriptions SET status = 'accepted' WHERE subscriberID = ? AND subscribedToID = ? AND status = 'pending'`
+	}
+	result, err := tx.Exec(query, subscriberID, subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update follow request"})
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm update"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Follow request not found"})
+	}
+
+	if err := notify(tx, notifyUserID, currentUser(c).UserID, notificationType, 0, message); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to send notification"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update follow request"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// ApproveFollowRequest lets the requester follow the current user
+func ApproveFollowRequest(c echo.Context) error {
+	requesterID, err := bindFollowRequestUser(c)
+	if err != nil || requesterID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "User ID is required"})
+	}
+	userID := currentUser(c).UserID
+	return resolveFollowRequest(c, requesterID, userID, requesterID, true,
+		notificationFollowRequestApproved, "Follow request approved")
+}
+
+// DenyFollowRequest rejects a pending request to follow the current user
+func DenyFollowRequest(c echo.Context) error {
+	requesterID, err := bindFollowRequestUser(c)
+	if err != nil || requesterID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "User ID is required"})
+	}
+	userID := currentUser(c).UserID
+	return resolveFollowRequest(c, requesterID, userID, requesterID, false,
+		notificationFollowRequestDenied, "Follow request denied")
+}
+
+// CancelFollowRequest withdraws the current user's pending request
+func CancelFollowRequest(c echo.Context) error {
+	targetID, err := bindFollowRequestUser(c)
+	if err != nil || targetID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "User ID is required"})
+	}
+	userID := currentUser(c).UserID
+	return resolveFollowRequest(c, userID, targetID, targetID, false,
+		notificationFollowRequestCancelled, "Follow request cancelled")
+}
+
+// subscriptionStatus returns the state of a follow between two users, "" when
+// there is none
+func subscriptionStatus(subscriberID, subscribedToID interface{}) (string, error) {
+	var status string
+	err := db.QueryRow(`SELECT status FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ?`,
+		subscriberID, subscribedToID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
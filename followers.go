@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const followPageLimit = 20
+
+// UserCard is a user as shown in follower lists, with flags relative to the viewer
+type UserCard struct {
+	IDUser      int    `json:"idUser"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Private     bool   `json:"private"`
+	FollowsYou  bool   `json:"followsYou"`
+	YouFollow   bool   `json:"youFollow"`
+}
+
+// userCardColumns selects a card for users aliased u; it takes the viewer ID twice
+const userCardColumns = `u.idUser, u.username, u.displayName, u.private,
+            EXISTS (SELECT 1 FROM subscriptions fy WHERE fy.subscriberID = u.idUser AND fy.subscribedToID = ? AND fy.status = 'accepted'),
+            EXISTS (SELECT 1 FROM subscriptions yf WHERE yf.subscriberID = ? AND yf.subscribedToID = u.idUser AND yf.status = 'accepted')`
+
+func queryUserCards(query string, args ...interface{}) ([]UserCard, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []UserCard{}
+	for rows.Next() {
+		var card UserCard
+		if err := rows.Scan(&card.IDUser, &card.Username, &card.DisplayName, &card.Private,
+			&card.FollowsYou, &card.YouFollow); err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+// canSeeConnections reports whether the viewer may list who a user follows
+// and is followed by. Private accounts only show them to accepted followers.
+func canSeeConnections(userID, viewerID int) (bool, error) {
+	if userID == viewerID {
+		return true, nil
+	}
+	private, err := isPrivateAccount(strconv.Itoa(userID))
+	if err != nil || !private {
+		return !private, err
+	}
+	status, err := subscriptionStatus(viewerID, userID)
+	return status == subscriptionAccepted, err
+}
+
+func bindConnectionsQuery(c echo.Context) (int, int, error) {
+	userID, err := strconv.Atoi(c.QueryParam("userID"))
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		if offset, err = strconv.Atoi(c.QueryParam("offset")); err != nil {
+			return 0, 0, err
+		}
+	}
+	return userID, offset, nil
+}
+
+// listConnections serves both directions of the follow graph. For followers the
+// listed users are the subscribers, for following they are the accounts
+// subscribed to.
+func listConnections(c echo.Context, followers bool) error {
+	userID, offset, err := bindConnectionsQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user ID or offset"})
+	}
+
+	viewer := viewerID(c)
+	allowed, err := canSeeConnections(userID, viewer)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !allowed {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "This account is private"})
+	}
+
+	listed, owner := "s.subscriberID", "s.subscribedToID"
+	if !followers {
+		listed, owner = owner, listed
+	}
+	query := `
+        SELECT ` + userCardColumns + `
+        FROM subscriptions s
+        JOIN users u ON u.idUser = ` + listed + `
+        WHERE ` + owner + ` = ? AND s.status = 'accepted'
+        ORDER BY s.idSubscription DESC
+        LIMIT ? OFFSET ?`
+	cards, err := queryUserCards(query, viewer, viewer, userID, followPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query users"})
+	}
+
+	return c.JSON(http.StatusOK, cards)
+}
+
+// GetFollowers lists the accounts following a user, newest first
+func GetFollowers(c echo.Context) error {
+	return listConnections(c, true)
+}
+
+// GetFollowing lists the accounts a user follows, newest first
+func GetFollowing(c echo.Context) error {
+	return listConnections(c, false)
+}
+
+// GetMutualFollowers lists the accounts the current user follows that also
+// follow the given user, for "followed by X and Y you know". It reveals part
+// of the user's followers, so private accounts are checked the same way.
+func GetMutualFollowers(c echo.Context) error {
+	userID, offset, err := bindConnectionsQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid user ID or offset"})
+	}
+
+	viewer := currentUser(c).UserID
+	allowed, err := canSeeConnections(userID, viewer)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !allowed {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "This account is private"})
+	}
+	mutual := `
+        FROM subscriptions s
+        JOIN subscriptions mine ON mine.subscribedToID = s.subscriberID
+            AND mine.subscriberID = ? AND mine.status = 'accepted'
+        JOIN users u ON u.idUser = s.subscriberID
+        WHERE s.subscribedToID = ? AND s.status = 'accepted' AND s.subscriberID != ?`
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) `+mutual, viewer, userID, viewer).Scan(&total); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to count mutual followers"})
+	}
+
+	query := `SELECT ` + userCardColumns + mutual + `
+        ORDER BY s.idSubscription DESC
+        LIMIT ? OFFSET ?`
+	cards, err := queryUserCards(query, viewer, viewer, viewer, userID, viewer, followPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query mutual followers"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"total": total,
+		"users": cards,
+	})
+}
+
+// RemoveFollower makes a user stop following the current user, without
+// notifying them
+func RemoveFollower(c echo.Context) error {
+	followerID, err := bindFollowRequestUser(c)
+	if err != nil || followerID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "User ID is required"})
+	}
+
+	result, err := db.Exec(`DELETE FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ? AND status = 'accepted'`,
+		followerID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove follower"})
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm removal"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Follower not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Follower removed"})
+}
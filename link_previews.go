@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	unfurlTimeout      = 5 * time.Second
+	unfurlMaxBytes     = 1 << 20
+	unfurlMaxRedirects = 3
+	unfurlUserAgent    = "TwitterRedditCloneBot/1.0 (+link preview)"
+
+	// linkPreviewTTL is how long a fetched preview is reused before refetching,
+	// failedPreviewTTL keeps broken links from being hammered
+	linkPreviewTTL   = 7 * 24 * time.Hour
+	failedPreviewTTL = time.Hour
+
+	maxPreviewTitle       = 300
+	maxPreviewDescription = 1000
+)
+
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"imageURL"`
+	SiteName    string `json:"siteName"`
+}
+
+var (
+	urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+	// linkPreviewQueue feeds URLs from AddPost and EditPost to the worker
+	linkPreviewQueue = make(chan string, 256)
+
+	// Ranges that are not covered by the net.IP helpers
+	blockedNetworks = mustParseCIDRs(
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // carrier grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved
+	)
+)
+
+func createLinkPreviewsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS link_previews (
+		"url" TEXT NOT NULL PRIMARY KEY,
+		"title" TEXT,
+		"description" TEXT,
+		"imageURL" TEXT,
+		"siteName" TEXT,
+		"ok" INTEGER NOT NULL DEFAULT 0,
+		"fetched_at" TEXT
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Link previews table created")
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// extractFirstURL returns the first http(s) URL in a post's text, without
+// trailing punctuation that usually belongs to the sentence
+func extractFirstURL(text string) string {
+	match := urlPattern.FindString(text)
+	return strings.TrimRight(match, ".,;:!?)]}'\"")
+}
+
+// isPublicIP reports whether an address is safe for the unfurler to connect to
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// unfurler fetches pages and reads their OpenGraph and Twitter card tags
+type unfurler struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// newUnfurler builds the HTTP client used for previews. Every connection is
+// checked with allowIP after DNS resolution, so neither hostnames pointing at
+// internal addresses nor redirects to them get through. The server passes
+// isPublicIP.
+func newUnfurler(allowIP func(net.IP) bool) *unfurler {
+	dialer := &net.Dialer{
+		Timeout: unfurlTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// No proxy, it would connect on our behalf and bypass the address check
+		Proxy:                  nil,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    unfurlTimeout,
+		ResponseHeaderTimeout:  unfurlTimeout,
+		MaxResponseHeaderBytes: 64 << 10,
+		DisableKeepAlives:      true,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   unfurlTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= unfurlMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to unsupported scheme")
+			}
+			return nil
+		},
+	}
+
+	return &unfurler{client: client, maxBytes: unfurlMaxBytes}
+}
+
+func (u *unfurler) fetch(ctx context.Context, rawURL string) (*LinkPreview, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || target.User != nil {
+		return nil, errors.New("unsupported URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	preview := parsePreview(io.LimitReader(resp.Body, u.maxBytes), resp.Request.URL)
+	preview.URL = rawURL
+	if preview.Title == "" && preview.Description == "" && preview.ImageURL == "" {
+		return nil, errors.New("no preview metadata found")
+	}
+	return preview, nil
+}
+
+// parsePreview reads the document head. OpenGraph tags win over Twitter card
+// tags, which win over the plain <title> and description.
+func parsePreview(body io.Reader, pageURL *url.URL) *LinkPreview {
+	meta := map[string]string{}
+	var title string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(body)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+		if tokenType == html.EndTagToken && token.Data == "head" {
+			break
+		}
+		if tokenType == html.EndTagToken && token.Data == "title" {
+			inTitle = false
+			continue
+		}
+		if tokenType == html.TextToken && inTitle && title == "" {
+			title = strings.TrimSpace(token.Data)
+			continue
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		switch token.Data {
+		case "title":
+			inTitle = true
+		case "meta":
+			var key, content string
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "property", "name":
+					key = strings.ToLower(attr.Val)
+				case "content":
+					content = strings.TrimSpace(attr.Val)
+				}
+			}
+			if key != "" && content != "" {
+				if _, seen := meta[key]; !seen {
+					meta[key] = content
+				}
+			}
+		}
+	}
+
+	first := func(values ...string) string {
+		for _, value := range values {
+			if value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	preview := &LinkPreview{
+		Title:       truncateRunes(first(meta["og:title"], meta["twitter:title"], title), maxPreviewTitle),
+		Description: truncateRunes(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxPreviewDescription),
+		SiteName:    truncateRunes(first(meta["og:site_name"], pageURL.Hostname()), maxPreviewTitle),
+	}
+
+	// Relative image paths resolve against the page after redirects
+	if image := first(meta["og:image"], meta["og:image:url"], meta["twitter:image"], meta["twitter:image:src"]); image != "" {
+		if imageURL, err := pageURL.Parse(image); err == nil && (imageURL.Scheme == "http" || imageURL.Scheme == "https") {
+			preview.ImageURL = imageURL.String()
+		}
+	}
+	return preview
+}
+
+func truncateRunes(value string, limit int) string {
+	runes := []rune(value)
+	if len(runes) <= limit {
+		return value
+	}
+	return string(runes[:limit])
+}
+
+// queueLinkPreview hands a URL to the background worker. Posting never waits
+// on it; if the queue is full the URL is picked up on the next edit.
+func queueLinkPreview(rawURL string) {
+	if rawURL == "" {
+		return
+	}
+	select {
+	case linkPreviewQueue <- rawURL:
+	default:
+		log.Printf("Link preview queue full, skipping %s", rawURL)
+	}
+}
+
+// previewIsFresh reports whether the cache already holds a usable result
+func previewIsFresh(rawURL string, now time.Time) (bool, error) {
+	var ok bool
+	var fetchedAt string
+	err := db.QueryRow(`SELECT ok, fetched_at FROM link_previews WHERE url = ?`, rawURL).Scan(&ok, &fetchedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fetched, err := time.Parse(time.RFC3339, fetchedAt)
+	if err != nil {
+		return false, nil
+	}
+	ttl := linkPreviewTTL
+	if !ok {
+		ttl = failedPreviewTTL
+	}
+	return now.Sub(fetched) < ttl, nil
+}
+
+func storeLinkPreview(rawURL string, preview *LinkPreview, now time.Time) error {
+	if preview == nil {
+		preview = &LinkPreview{}
+	}
+	query := `
+        INSERT OR REPLACE INTO link_previews (url, title, description, imageURL, siteName, ok, fetched_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, rawURL, preview.Title, preview.Description, preview.ImageURL, preview.SiteName,
+		preview.URL != "", now.UTC().Format(time.RFC3339))
+	return err
+}
+
+func startLinkPreviewWorker(u *unfurler) {
+	for rawURL := range linkPreviewQueue {
+		fresh, err := previewIsFresh(rawURL, time.Now())
+		if err != nil {
+			log.Printf("Failed to check link preview cache: %v", err)
+			continue
+		}
+		if fresh {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+		preview, err := u.fetch(ctx, rawURL)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to unfurl %s: %v", rawURL, err)
+		}
+
+		if err := storeLinkPreview(rawURL, preview, time.Now()); err != nil {
+			log.Printf("Failed to store link preview: %v", err)
+		}
+	}
+}
+
+// loadLinkPreview returns the cached preview for a post's first link, nil if
+// there is none yet or the link could not be unfurled
+func loadLinkPreview(postID int) (*LinkPreview, error) {
+	preview := &LinkPreview{}
+	query := `
+        SELECT lp.url, lp.title, lp.description, lp.imageURL, lp.siteName
+        FROM posts p
+        JOIN link_previews lp ON lp.url = p.previewURL
+        WHERE p.idPost = ? AND lp.ok = 1`
+	err := db.QueryRow(query, postID).Scan(&preview.URL, &preview.Title, &preview.Description,
+		&preview.ImageURL, &preview.SiteName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Once failures pass the free attempts, each further attempt has to wait.
+	// The wait starts at loginBaseDelay and doubles with every failure.
+	loginBaseDelay = time.Second
+	loginMaxDelay  = time.Minute
+	// Failures are forgotten once there hasn't been one for this long
+	loginFailureWindow   = time.Hour
+	loginLockoutDuration = 15 * time.Minute
+)
+
+// throttleLimits says how many failures a counter allows before attempts are
+// delayed and before it locks
+type throttleLimits struct {
+	FreeAttempts int
+	Lockout      int
+}
+
+// IP addresses get more room than accounts, many users can share one address
+var (
+	accountThrottleLimits = throttleLimits{FreeAttempts: 3, Lockout: 10}
+	ipThrottleLimits      = throttleLimits{FreeAttempts: 20, Lockout: 50}
+)
+
+// loginThrottle tracks failed logins per account and per IP address. Its
+// clock can be swapped so delays and lockouts can be checked without waiting.
+// mu makes recording a failure one step, so failures arriving together
+// can't overwrite each other's count.
+type loginThrottle struct {
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+var loginGuard = &loginThrottle{now: time.Now}
+
+// throttleState is the failure count behind one account or IP address
+type throttleState struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func createLoginThrottleTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS login_throttle (
+		"throttleKey" TEXT NOT NULL PRIMARY KEY,
+		"failures" INTEGER NOT NULL DEFAULT 0,
+		"last_failure" TEXT,
+		"locked_until" TEXT
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Login throttle table created")
+}
+
+func accountThrottleKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// throttleCounter is one of the counters a login attempt counts against
+type throttleCounter struct {
+	Key     string
+	Limits  throttleLimits
+	Account bool
+}
+
+// throttleCounters are the IP address's counter and the account's when the
+// account exists
+func throttleCounters(ip string, userID int) []throttleCounter {
+	counters := []throttleCounter{{Key: "ip:" + ip, Limits: ipThrottleLimits}}
+	if userID != 0 {
+		counters = append(counters, throttleCounter{Key: accountThrottleKey(userID), Limits: accountThrottleLimits, Account: true})
+	}
+	return counters
+}
+
+func (t *loginThrottle) load(key string) (throttleState, error) {
+	var state throttleState
+	var lastFailure, lockedUntil string
+	err := db.QueryRow(`SELECT failures, COALESCE(last_failure, ''), COALESCE(locked_until, '') FROM login_throttle WHERE throttleKey = ?`,
+		key).Scan(&state.Failures, &lastFailure, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.LastFailure, _ = time.Parse(time.RFC3339, lastFailure)
+	state.LockedUntil, _ = time.Parse(time.RFC3339, lockedUntil)
+
+	now := t.now()
+	if now.Sub(state.LastFailure) > loginFailureWindow && !now.Before(state.LockedUntil) {
+		return throttleState{}, nil
+	}
+	return state, nil
+}
+
+// wait is how long the next attempt has to wait at now, and whether that is
+// because of a lockout rather than a delay
+func (s throttleState) wait(limits throttleLimits, now time.Time) (time.Duration, bool) {
+	if now.Before(s.LockedUntil) {
+		return s.LockedUntil.Sub(now), true
+	}
+	if s.Failures < limits.FreeAttempts {
+		return 0, false
+	}
+	delay := loginMaxDelay
+	if shift := s.Failures - limits.FreeAttempts; shift < 16 {
+		delay = min(loginMaxDelay, loginBaseDelay<<shift)
+	}
+	if ready := s.LastFailure.Add(delay); now.Before(ready) {
+		return ready.Sub(now), false
+	}
+	return 0, false
+}
+
+// check reports how long a login from ip to userID, 0 when no such account
+// exists, has to wait before it may be tried
+func (t *loginThrottle) check(ip string, userID int) (time.Duration, bool, error) {
+	now := t.now()
+	var longest time.Duration
+	var locked bool
+	for _, counter := range throttleCounters(ip, userID) {
+		state, err := t.load(counter.Key)
+		if err != nil {
+			return 0, false, err
+		}
+		wait, lockout := state.wait(counter.Limits, now)
+		longest = max(longest, wait)
+		locked = locked || lockout
+	}
+	return longest, locked, nil
+}
+
+// recordFailure counts a failed login and locks the account or IP address
+// once it reaches its threshold. It returns when the account was locked, zero
+// unless this failure locked it. Locking starts the count over, so the
+// lockout is the penalty rather than the start of a longer one.
+func (t *loginThrottle) recordFailure(ip string, userID int) (time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var accountLockedUntil time.Time
+	for _, counter := range throttleCounters(ip, userID) {
+		state, err := t.load(counter.Key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		state.Failures++
+		state.LastFailure = now
+
+		var lockedUntil interface{}
+		if state.Failures >= counter.Limits.Lockout {
+			state.Failures = 0
+			state.LockedUntil = now.Add(loginLockoutDuration)
+			if counter.Account {
+				accountLockedUntil = state.LockedUntil
+			}
+		}
+		if !state.LockedUntil.IsZero() {
+			lockedUntil = state.LockedUntil.UTC().Format(time.RFC3339)
+		}
+
+		_, err = db.Exec(`INSERT OR REPLACE INTO login_throttle (throttleKey, failures, last_failure, locked_until) VALUES (?, ?, ?, ?)`,
+			counter.Key, state.Failures, now.UTC().Format(time.RFC3339), lockedUntil)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return accountLockedUntil, nil
+}
+
+// resetAccountThrottle forgets an account's failures and lifts its lockout.
+// The IP address keeps its count, one good password shouldn't clear an
+// address that has been guessing at other accounts.
+func resetAccountThrottle(exec execer, userID int) error {
+	_, err := exec.Exec(`DELETE FROM login_throttle WHERE throttleKey = ?`, accountThrottleKey(userID))
+	return err
+}
+
+// rejectThrottledLogin answers a login attempt on userID that has to wait.
+// It returns whether it did, and the response if so. Details are added to
+// the audit entry.
+func rejectThrottledLogin(c echo.Context, userID int, details echo.Map) (bool, error) {
+	wait, locked, err := loginGuard.check(c.RealIP(), userID)
+	if err != nil {
+		return true, c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to check login attempts",
+		})
+	}
+	if wait <= 0 {
+		return false, nil
+	}
+	after := echo.Map{"locked": locked}
+	for key, value := range details {
+		after[key] = value
+	}
+	recordAudit(c, 0, auditActionLoginThrottled, "user", userID, nil, after)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+	message := "Too many failed login attempts, try again later"
+	if locked {
+		message = "Account temporarily locked after too many failed login attempts"
+	}
+	return true, c.JSON(http.StatusTooManyRequests, echo.Map{
+		"error":  message,
+		"locked": locked,
+	})
+}
+
+// countLoginFailure records a wrong password or code, and tells the owner if
+// it locked their account
+func countLoginFailure(c echo.Context, userID int) {
+	lockedUntil, err := loginGuard.recordFailure(c.RealIP(), userID)
+	if err != nil {
+		log.Printf("Failed to record failed login: %v", err)
+	} else if !lockedUntil.IsZero() {
+		loginGuard.announceLockout(c, userID, lockedUntil)
+	}
+}
+
+// announceLockout tells the owner of a locked account what happened, in the
+// app and by email with a link that unlocks the account straight away
+func (t *loginThrottle) announceLockout(c echo.Context, userID int, lockedUntil time.Time) {
+	recordAudit(c, 0, auditActionAccountLocked, "user", userID, nil, echo.Map{"lockedUntil": lockedUntil.UTC().Format(time.RFC3339)})
+
+	message := fmt.Sprintf("Your account was locked until %s after too many failed login attempts",
+		lockedUntil.UTC().Format(time.RFC3339))
+	if err := notify(db, userID, 0, notificationAccountLocked, userID, message); err != nil {
+		log.Printf("Failed to notify user %d of lockout: %v", userID, err)
+	}
+
+	token, err := issueAccountToken(db, userID, accountTokenUnlock, "", unlockTokenTTL, t.now())
+	if err != nil {
+		log.Printf("Failed to issue unlock token for user %d: %v", userID, err)
+		return
+	}
+	sendEmail(userID, "Your account was locked", message+".\n\n"+
+		"If this was you, you can unlock your account now:\n"+
+		appLink("/unlock", url.Values{"token": {token}})+"\n\n"+
+		"If it wasn't, someone may be trying to guess your password. Consider changing it once you're back in.")
+}
+
+// UnlockAccount lifts a lockout with the token emailed to the account owner
+func UnlockAccount(c echo.Context) error {
+	type UnlockRequest struct {
+		Token string `json:"token"`
+	}
+
+	var req UnlockRequest
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Token is required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	userID, _, err := consumeAccountToken(tx, accountTokenUnlock, req.Token, loginGuard.now())
+	if err == errInvalidAccountToken {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check token"})
+	}
+	if err := resetAccountThrottle(tx, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unlock account"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to unlock account"})
+	}
+	recordAudit(c, userID, auditActionAccountUnlocked, "user", userID, nil, nil)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Account unlocked"})
+}
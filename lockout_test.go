@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recordingMailer keeps the email it is asked to send
+type recordingMailer struct {
+	subjects []string
+	bodies   []string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.subjects = append(m.subjects, subject)
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+// lockoutTest runs the login handlers against a fresh database with one
+// account, alice with the password "pw", and a clock that only moves when
+// the test moves it
+type lockoutTest struct {
+	t      *testing.T
+	clock  time.Time
+	mailer *recordingMailer
+}
+
+func newLockoutTest(t *testing.T) *lockoutTest {
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedNow, savedMailer := db, loginGuard.now, mailer
+	t.Cleanup(func() {
+		database.Close()
+		db, loginGuard.now, mailer = savedDB, savedNow, savedMailer
+	})
+	db = database
+
+	createUsersTable(database)
+	createNotificationsTable(database)
+	createAuditLogTable(database)
+	createAccountTokensTable(database)
+	createLoginThrottleTable(database)
+	createRecoveryCodesTable(database)
+	_, err = db.Exec(`INSERT INTO users (username, displayName, email, password) VALUES ('alice', 'Alice', 'alice@example.com', 'pw')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt := &lockoutTest{t: t, clock: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), mailer: &recordingMailer{}}
+	loginGuard.now = func() time.Time { return lt.clock }
+	mailer = lt.mailer
+	return lt
+}
+
+func (lt *lockoutTest) advance(d time.Duration) {
+	lt.clock = lt.clock.Add(d)
+}
+
+func (lt *lockoutTest) post(handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = "203.0.113.7:4321"
+	rec := httptest.NewRecorder()
+	if err := handler(e.NewContext(req, rec)); err != nil {
+		lt.t.Fatal(err)
+	}
+	return rec
+}
+
+func (lt *lockoutTest) login(password string) *httptest.ResponseRecorder {
+	return lt.post(Login, `{"username":"alice","password":"`+password+`"}`)
+}
+
+// expectLogin tries a password and checks the status and, for throttled
+// attempts, the Retry-After header
+func (lt *lockoutTest) expectLogin(password string, status int, retryAfter string) {
+	lt.t.Helper()
+	rec := lt.login(password)
+	if rec.Code != status {
+		lt.t.Fatalf("login at %s = %d %s, want %d", lt.clock.Format(time.TimeOnly), rec.Code, rec.Body, status)
+	}
+	if got := rec.Header().Get("Retry-After"); got != retryAfter {
+		lt.t.Fatalf("login at %s Retry-After = %q, want %q", lt.clock.Format(time.TimeOnly), got, retryAfter)
+	}
+}
+
+// lockOut fails logins, waiting out each delay, until the account locks
+func (lt *lockoutTest) lockOut() {
+	lt.t.Helper()
+	for i := 0; i < accountThrottleLimits.Lockout; i++ {
+		wait, _, err := loginGuard.check("203.0.113.7", 1)
+		if err != nil {
+			lt.t.Fatal(err)
+		}
+		lt.advance(wait)
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+}
+
+func TestLoginFreeAttempts(t *testing.T) {
+	lt := newLockoutTest(t)
+	for i := 0; i < accountThrottleLimits.FreeAttempts; i++ {
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+	// Even the right password has to wait once the free attempts are used
+	lt.expectLogin("pw", http.StatusTooManyRequests, "1")
+	lt.advance(loginBaseDelay)
+	lt.expectLogin("pw", http.StatusOK, "")
+
+	// Logging in starts the count over
+	for i := 0; i < accountThrottleLimits.FreeAttempts; i++ {
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+}
+
+func TestLoginDelayDoubles(t *testing.T) {
+	lt := newLockoutTest(t)
+	for i := 0; i < accountThrottleLimits.FreeAttempts; i++ {
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+
+	// Each failure past the free ones doubles the wait, up to loginMaxDelay
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, loginMaxDelay} {
+		lt.expectLogin("wrong", http.StatusTooManyRequests, strconv.Itoa(ceilSeconds(delay)))
+		lt.advance(delay - time.Second)
+		lt.expectLogin("wrong", http.StatusTooManyRequests, "1")
+		lt.advance(time.Second)
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	lt := newLockoutTest(t)
+	lt.lockOut()
+
+	if len(lt.mailer.subjects) != 1 || lt.mailer.subjects[0] != "Your account was locked" {
+		t.Fatalf("sent %v, want the lockout email", lt.mailer.subjects)
+	}
+	rec := lt.login("pw")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), `"locked":true`) {
+		t.Fatalf("login while locked = %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(ceilSeconds(loginLockoutDuration)) {
+		t.Fatalf("Retry-After while locked = %q, want the lockout duration", got)
+	}
+
+	lt.advance(loginLockoutDuration - time.Second)
+	lt.expectLogin("pw", http.StatusTooManyRequests, "1")
+	lt.advance(time.Second)
+	lt.expectLogin("pw", http.StatusOK, "")
+}
+
+func TestLoginFailuresExpire(t *testing.T) {
+	lt := newLockoutTest(t)
+	for i := 0; i < accountThrottleLimits.FreeAttempts+2; i++ {
+		wait, _, err := loginGuard.check("203.0.113.7", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt.advance(wait)
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+
+	// Still counted right up to the end of the window
+	lt.advance(loginFailureWindow)
+	lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	lt.expectLogin("wrong", http.StatusTooManyRequests, "8")
+
+	// A quiet window forgets them, the free attempts are back
+	lt.advance(loginFailureWindow + time.Second)
+	for i := 0; i < accountThrottleLimits.FreeAttempts; i++ {
+		lt.expectLogin("wrong", http.StatusUnauthorized, "")
+	}
+	lt.expectLogin("wrong", http.StatusTooManyRequests, "1")
+}
+
+var unlockLinkPattern = regexp.MustCompile(`\S*/unlock\?\S+`)
+
+func TestUnlockToken(t *testing.T) {
+	lt := newLockoutTest(t)
+	lt.lockOut()
+	if len(lt.mailer.bodies) != 1 {
+		t.Fatalf("sent %d emails, want the lockout email", len(lt.mailer.bodies))
+	}
+	link, err := url.Parse(unlockLinkPattern.FindString(lt.mailer.bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+	if token == "" {
+		t.Fatalf("no unlock link in %q", lt.mailer.bodies[0])
+	}
+
+	if rec := lt.post(UnlockAccount, `{"token":"not-the-token"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unlock with a wrong token = %d %s", rec.Code, rec.Body)
+	}
+	if rec := lt.post(UnlockAccount, `{"token":"`+token+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("unlock = %d %s", rec.Code, rec.Body)
+	}
+	lt.expectLogin("pw", http.StatusOK, "")
+
+	// The token works once
+	if rec := lt.post(UnlockAccount, `{"token":"`+token+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("second unlock = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUnlockTokenExpires(t *testing.T) {
+	lt := newLockoutTest(t)
+	lt.lockOut()
+	link, err := url.Parse(unlockLinkPattern.FindString(lt.mailer.bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt.advance(unlockTokenTTL + time.Second)
+	if rec := lt.post(UnlockAccount, `{"token":"`+link.Query().Get("token")+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unlock with an expired token = %d %s", rec.Code, rec.Body)
+	}
+}
+
+// recordFailuresTogether records n failures from ip on userID at once
+func recordFailuresTogether(t *testing.T, n int, ip string, userID int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := loginGuard.recordFailure(ip, userID); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentLoginFailuresAllCount(t *testing.T) {
+	lt := newLockoutTest(t)
+
+	// Failures arriving together must each count, none may overwrite another
+	for _, tc := range []struct {
+		key    string
+		ip     string
+		userID int
+		n      int
+	}{
+		{"ip:198.51.100.1", "198.51.100.1", 0, ipThrottleLimits.Lockout - 1},
+		{accountThrottleKey(1), "203.0.113.7", 1, accountThrottleLimits.Lockout - 1},
+	} {
+		recordFailuresTogether(t, tc.n, tc.ip, tc.userID)
+		state, err := loginGuard.load(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Failures != tc.n {
+			t.Fatalf("%s recorded %d failures, want %d", tc.key, state.Failures, tc.n)
+		}
+	}
+
+	lockedUntil, err := loginGuard.recordFailure("203.0.113.7", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lockedUntil.Equal(lt.clock.Add(loginLockoutDuration)) {
+		t.Fatalf("last failure locked until %v, want the account locked", lockedUntil)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mailer sends plain text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailer sends the app's email, see configureMailer
+var mailer Mailer = consoleMailer{}
+
+// consoleMailer writes email to the server log instead of sending it, for
+// local development
+type consoleMailer struct{}
+
+func (consoleMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// fileMailer writes each email to its own .eml file in Dir, for local
+// development and tests that need to read what was sent
+type fileMailer struct {
+	Dir  string
+	From string
+	sent atomic.Int64
+}
+
+func (m *fileMailer) Send(to, subject, body string) error {
+	message, err := formatEmail(m.From, to, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405"), m.sent.Add(1))
+	return os.WriteFile(filepath.Join(m.Dir, name), message, 0o600)
+}
+
+// smtpMailer sends email through an SMTP server. Username can be empty for
+// servers that don't need to log in.
+type smtpMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	message, err := formatEmail(m.From, to, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, message)
+}
+
+// formatEmail builds a plain text message. Line breaks in the addresses or
+// subject are refused, they would let a caller inject headers.
+func formatEmail(from, to, subject, body string, now time.Time) ([]byte, error) {
+	if strings.ContainsAny(from+to+subject, "\r\n") {
+		return nil, errors.New("line break in email header")
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(message.String()), nil
+}
+
+// configureMailer picks how email goes out. SMTP_HOST sends it through an
+// SMTP server (with SMTP_PORT, SMTP_USERNAME and SMTP_PASSWORD), MAIL_DIR
+// writes it to files, and otherwise it is only logged. MAIL_FROM sets the
+// sender.
+func configureMailer() {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = &smtpMailer{
+			Addr:     net.JoinHostPort(host, port),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+		fmt.Printf("Sending email through %s:%s\n", host, port)
+		return
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			log.Fatal(err)
+		}
+		mailer = &fileMailer{Dir: dir, From: from}
+		fmt.Printf("Writing email to %s\n", dir)
+	}
+}
+
+// parseEmail checks an address is a bare, well formed email address
+func parseEmail(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value {
+		return "", errors.New("Invalid email address")
+	}
+	return value, nil
+}
+
+// appLink builds a link into the frontend, which lives at PUBLIC_URL
+func appLink(path string, query url.Values) string {
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return strings.TrimSuffix(base, "/") + path + "?" + query.Encode()
+}
+
+// sendEmail sends an email to a user, logging failures rather than failing
+// whatever the email is about
+func sendEmail(userID int, subject, body string) {
+	var email string
+	if err := db.QueryRow(`SELECT email FROM users WHERE idUser = ?`, userID).Scan(&email); err != nil {
+		log.Printf("Failed to look up email for user %d: %v", userID, err)
+		return
+	}
+	sendEmailTo(email, subject, body)
+}
+
+func sendEmailTo(email, subject, body string) {
+	if err := mailer.Send(email, subject, body); err != nil {
+		log.Printf("Failed to send %q to %s: %v", subject, email, err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
@@ -20,7 +22,6 @@ import (
 var db *sql.DB
 
 const (
-	testing         = true
 	testingLogin    = "test"
 	testingPassword = "test"
 	jwtSecret       = "secrete"
@@ -31,6 +32,7 @@ const (
 type JwtCustomClaims struct {
 	UserID   int    `json:"userId"`
 	Username string `json:"username"`
+	Role     string `json:"role"`
 	jwt.StandardClaims
 }
 
@@ -40,8 +42,10 @@ func generateToken(user User) (string, error) {
 	claims := &JwtCustomClaims{
 		UserID:   user.IDUser,
 		Username: user.Username,
+		Role:     user.Role,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(tokenExpiration).Unix(),
+			IssuedAt:  time.Now().Unix(),
 		},
 	}
 
@@ -58,6 +62,8 @@ type User struct {
 	DisplayName string `json:"displayName"`
 	Email       string `json:"email"`
 	Password    string `json:"password"`
+	Private     bool   `json:"private"`
+	Role        string `json:"role,omitempty"`
 }
 
 type Post struct {
@@ -76,13 +82,23 @@ type Image struct {
 }
 
 type PostWithCategory struct {
-	IDPost      int    `json:"idPost"`
-	UserID      int    `json:"userID"`
-	CategoryID  int    `json:"categoryID"`
-	Category    string `json:"category"`
-	ImageURL    string `json:"imageURL"`
-	ContentText string `json:"content_text"`
-	CreatedAt   string `json:"created_at"`
+	IDPost       int          `json:"idPost"`
+	UserID       int          `json:"userID"`
+	CategoryID   int          `json:"categoryID"`
+	Category     string       `json:"category"`
+	ImageURL     string       `json:"imageURL"`
+	ContentText  string       `json:"content_text"`
+	CreatedAt    string       `json:"created_at"`
+	Edited       bool         `json:"edited"`
+	EditedAt     string       `json:"edited_at"`
+	QuotedPostID int          `json:"quotedPostID"`
+	QuotedPost   *QuotedPost  `json:"quotedPost,omitempty"`
+	Preview      *LinkPreview `json:"preview,omitempty"`
+	RepostCount  int          `json:"repostCount"`
+	QuoteCount   int          `json:"quoteCount"`
+	InReplyToID  int          `json:"inReplyToID"`
+	ReplyCount   int          `json:"replyCount"`
+	Visibility   string       `json:"visibility"`
 }
 
 type SubscribeUser struct {
@@ -105,14 +121,35 @@ type Comment struct {
 	IDComment   int    `json:"idComment"`
 	IDPost      int    `json:"idPost"`
 	IDUser      int    `json:"idUser"`
+	ParentID    int    `json:"parentID"`
 	ContentText string `json:"content_text"`
 	CreatedAt   string `json:"created_at"`
-}
-
+	EditedAt    string `json:"edited_at"`
+	Deleted     bool   `json:"deleted"`
+	// Hidden marks comments from users the viewer blocked or is blocked by
+	Hidden bool `json:"hidden"`
+	// Filtered marks comments that matched one of the viewer's muted words
+	Filtered bool `json:"filtered,omitempty"`
+	// Removed marks comments taken down by a community moderator
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Category is a community. Categories created before communities existed
+// have no owner and are public.
 type Category struct {
 	IDCategory  int    `json:"idCategory"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	OwnerID     int    `json:"ownerID"`
+	Rules       string `json:"rules"`
+	BannerURL   string `json:"bannerURL"`
+	IconURL     string `json:"iconURL"`
+	Mode        string `json:"mode"`
+	CreatedAt   string `json:"created_at"`
+	MemberCount int    `json:"memberCount"`
+	// Role and MembershipStatus describe the viewer, only set for a single community
+	Role             string `json:"role,omitempty"`
+	MembershipStatus string `json:"membershipStatus,omitempty"`
 }
 
 type LikeDislike struct {
@@ -138,13 +175,26 @@ type Message struct {
 
 func GetAllPosts(c echo.Context) error {
 	type Post struct {
-		IDPost          int      `json:"idPost"`
-		ContentText     string   `json:"content_text"`
-		CreatedAt       string   `json:"created_at"`
-		UserID          int      `json:"userID"`
-		Category        string   `json:"category"`
-		ImageURL        string   `json:"imageURL"`
-		SecondaryImages []string `json:"secondaryImages"`
+		IDPost          int          `json:"idPost"`
+		ContentText     string       `json:"content_text"`
+		CreatedAt       string       `json:"created_at"`
+		UserID          int          `json:"userID"`
+		Category        string       `json:"category"`
+		ImageURL        string       `json:"imageURL"`
+		SecondaryImages []string     `json:"secondaryImages"`
+		Edited          bool         `json:"edited"`
+		EditedAt        string       `json:"edited_at"`
+		QuotedPostID    int          `json:"quotedPostID"`
+		QuotedPost      *QuotedPost  `json:"quotedPost,omitempty"`
+		Preview         *LinkPreview `json:"preview,omitempty"`
+		RepostCount     int          `json:"repostCount"`
+		QuoteCount      int          `json:"quoteCount"`
+		InReplyToID     int          `json:"inReplyToID"`
+		ReplyCount      int          `json:"replyCount"`
+		Visibility      string       `json:"visibility"`
+		Poll            *Poll        `json:"poll,omitempty"`
+		// Filtered posts matched a muted word and only keep their metadata
+		Filtered bool `json:"filtered,omitempty"`
 	}
 
 	offset := c.QueryParam("offset")
@@ -158,6 +208,14 @@ func GetAllPosts(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
 	}
 
+	filter, err := loadWordFilter(viewerID(c), mutedWordScopeHome)
+	if err != nil {
+		log.Printf("Muted words query error: %v", err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+
+	visible, visibleArgs := postVisibleSQL("p", viewerID(c))
+	notMuted, notMutedArgs := notMutedSQL("p.userID", viewerID(c))
 	query := `
         SELECT 
             p.idPost,
@@ -165,13 +223,25 @@ func GetAllPosts(c echo.Context) error {
             p.created_at,
             p.userID,
             COALESCE(c.name, '') as category,
-            COALESCE(p.imageURL, '') as imageURL
+            COALESCE(p.imageURL, '') as imageURL,
+            COALESCE(p.edited_at, '') as edited_at,
+            COALESCE(p.quotedPostID, 0) as quotedPostID,
+            (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as repostCount,
+            (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as quoteCount,
+            COALESCE(p.inReplyToID, 0) as inReplyToID,
+            (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount,
+            p.visibility
         FROM posts p
         LEFT JOIN categories c ON p.categoryID = c.idCategory
+        WHERE p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + ` AND ` + notMuted + `
         ORDER BY p.created_at DESC 
         LIMIT 10 OFFSET ?`
 
-	rows, err := db.Query(query, offsetInt)
+	args := append(visibleArgs, notMutedArgs...)
+	rows, err := db.Query(query, append(args, offsetInt)...)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query posts"})
@@ -189,10 +259,37 @@ func GetAllPosts(c echo.Context) error {
 			&post.UserID,
 			&post.Category,
 			&post.ImageURL,
+			&post.EditedAt,
+			&post.QuotedPostID,
+			&post.RepostCount,
+			&post.QuoteCount,
+			&post.InReplyToID,
+			&post.ReplyCount,
+			&post.Visibility,
 		); err != nil {
 			log.Printf("Scan error: %v", err)
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan post data"})
 		}
+		post.Edited = post.EditedAt != ""
+		if filtered, hide := filter.match(post.ContentText); hide {
+			continue
+		} else if filtered {
+			posts = append(posts, Post{IDPost: post.IDPost, CreatedAt: post.CreatedAt, UserID: post.UserID,
+				Category: post.Category, SecondaryImages: []string{}, Visibility: post.Visibility, Filtered: true})
+			continue
+		}
+		if post.QuotedPost, err = loadQuotedPost(post.QuotedPostID, viewerID(c)); err != nil {
+			log.Printf("Quoted post query error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query quoted post"})
+		}
+		if post.Preview, err = loadLinkPreview(post.IDPost); err != nil {
+			log.Printf("Link preview query error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query link preview"})
+		}
+		if post.Poll, err = loadPoll(post.IDPost, viewerID(c)); err != nil {
+			log.Printf("Poll query error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query poll"})
+		}
 
 		post.SecondaryImages = []string{}
 
@@ -237,12 +334,27 @@ func GetAllPostsForCategory(c echo.Context) error {
 	}
 
 	type Post struct {
-		IDPost      int    `json:"idPost"`
-		ContentText string `json:"content_text"`
-		CreatedAt   string `json:"created_at"`
-		UserID      int    `json:"userID"`
-		Category    string `json:"category"`
-		ImageURL    string `json:"imageURL"`
+		IDPost       int          `json:"idPost"`
+		ContentText  string       `json:"content_text"`
+		CreatedAt    string       `json:"created_at"`
+		UserID       int          `json:"userID"`
+		Category     string       `json:"category"`
+		ImageURL     string       `json:"imageURL"`
+		Edited       bool         `json:"edited"`
+		EditedAt     string       `json:"edited_at"`
+		QuotedPostID int          `json:"quotedPostID"`
+		QuotedPost   *QuotedPost  `json:"quotedPost,omitempty"`
+		Preview      *LinkPreview `json:"preview,omitempty"`
+		RepostCount  int          `json:"repostCount"`
+		QuoteCount   int          `json:"quoteCount"`
+		InReplyToID  int          `json:"inReplyToID"`
+		ReplyCount   int          `json:"replyCount"`
+		Visibility   string       `json:"visibility"`
+		// Pinned posts come first, locked ones take no new comments
+		Pinned bool `json:"pinned"`
+		Locked bool `json:"locked"`
+		// Filtered posts matched a muted word and only keep their metadata
+		Filtered bool `json:"filtered,omitempty"`
 	}
 
 	offset := c.QueryParam("offset")
@@ -256,6 +368,29 @@ func GetAllPostsForCategory(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
 	}
 
+	var communityID int
+	if err := db.QueryRow(`SELECT idCategory FROM categories WHERE name = ?`, category).Scan(&communityID); err == nil {
+		community, err := loadCommunity(communityID)
+		if err != nil || community == nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query community"})
+		}
+		allowed, err := canViewCommunity(community, viewerID(c))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+		}
+		if !allowed {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "This community is private"})
+		}
+	}
+
+	filter, err := loadWordFilter(viewerID(c), mutedWordScopeCategory)
+	if err != nil {
+		log.Printf("Muted words query error: %v", err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+
+	visible, visibleArgs := postVisibleSQL("p", viewerID(c))
+	notMuted, notMutedArgs := notMutedSQL("p.userID", viewerID(c))
 	query := `
         SELECT 
             p.idPost,
@@ -263,14 +398,27 @@ func GetAllPostsForCategory(c echo.Context) error {
             p.created_at,
             p.userID,
             COALESCE(c.name, '') as category,
-            COALESCE(p.imageURL, '') as imageURL
+            COALESCE(p.imageURL, '') as imageURL,
+            COALESCE(p.edited_at, '') as edited_at,
+            COALESCE(p.quotedPostID, 0) as quotedPostID,
+            (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as repostCount,
+            (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as quoteCount,
+            COALESCE(p.inReplyToID, 0) as inReplyToID,
+            (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount,
+            p.visibility,
+            p.pinned_at IS NOT NULL,
+            p.locked
         FROM posts p
         LEFT JOIN categories c ON p.categoryID = c.idCategory
-        WHERE c.name = ?
-        ORDER BY p.created_at DESC 
+        WHERE c.name = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + ` AND ` + notMuted + `
+        ORDER BY p.pinned_at IS NULL, p.pinned_at DESC, p.created_at DESC 
         LIMIT 10 OFFSET ?`
 
-	rows, err := db.Query(query, category, offsetInt)
+	args := append(append([]interface{}{category}, visibleArgs...), notMutedArgs...)
+	rows, err := db.Query(query, append(args, offsetInt)...)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query posts"})
@@ -287,10 +435,35 @@ func GetAllPostsForCategory(c echo.Context) error {
 			&post.UserID,
 			&post.Category,
 			&post.ImageURL,
+			&post.EditedAt,
+			&post.QuotedPostID,
+			&post.RepostCount,
+			&post.QuoteCount,
+			&post.InReplyToID,
+			&post.ReplyCount,
+			&post.Visibility,
+			&post.Pinned,
+			&post.Locked,
 		); err != nil {
 			log.Printf("Scan error: %v", err)
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan post data"})
 		}
+		post.Edited = post.EditedAt != ""
+		if filtered, hide := filter.match(post.ContentText); hide {
+			continue
+		} else if filtered {
+			posts = append(posts, Post{IDPost: post.IDPost, CreatedAt: post.CreatedAt, UserID: post.UserID,
+				Category: post.Category, Visibility: post.Visibility, Pinned: post.Pinned, Locked: post.Locked, Filtered: true})
+			continue
+		}
+		if post.QuotedPost, err = loadQuotedPost(post.QuotedPostID, viewerID(c)); err != nil {
+			log.Printf("Quoted post query error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query quoted post"})
+		}
+		if post.Preview, err = loadLinkPreview(post.IDPost); err != nil {
+			log.Printf("Link preview query error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query link preview"})
+		}
 		posts = append(posts, post)
 	}
 
@@ -332,7 +505,7 @@ func GetAllCategories(c echo.Context) error {
 
 func GetCategories() []Category {
 	// Get all categories from the database
-	query := `SELECT idCategory, name, description FROM categories`
+	query := `SELECT ` + communityColumns + ` FROM categories c`
 	rows, err := db.Query(query)
 	if err != nil {
 		log.Fatal(err)
@@ -341,8 +514,8 @@ func GetCategories() []Category {
 
 	var categories []Category
 	for rows.Next() {
-		var category Category
-		if err := rows.Scan(&category.IDCategory, &category.Name, &category.Description); err != nil {
+		category, err := scanCommunity(rows)
+		if err != nil {
 			log.Fatal(err)
 		}
 		categories = append(categories, category)
@@ -356,7 +529,7 @@ func GetCategories() []Category {
 
 func GetPosts() []Post {
 	// Get all posts from the database
-	query := `SELECT idPost, content_text, created_at, userID FROM posts`
+	query := `SELECT idPost, content_text, created_at, userID FROM posts WHERE deleted_at IS NULL AND status = 'published'`
 	rows, err := db.Query(query)
 	if err != nil {
 		log.Fatal(err)
@@ -381,21 +554,32 @@ func GetPosts() []Post {
 func GetPostByUserID(c echo.Context) error {
 	userID := c.QueryParam("id")
 
+	visible, visibleArgs := postVisibleSQL("p", viewerID(c))
 	query := `
         SELECT 
             p.idPost, 
             p.content_text, 
             p.created_at, 
             p.userID, 
-            p.imageURL,
-            p.categoryID,
-            COALESCE(c.name, '') as category_name
+            COALESCE(p.imageURL, '') as imageURL,
+            COALESCE(p.categoryID, 0) as categoryID,
+            COALESCE(c.name, '') as category_name,
+            COALESCE(p.edited_at, '') as edited_at,
+            COALESCE(p.quotedPostID, 0) as quotedPostID,
+            (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as repostCount,
+            (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as quoteCount,
+            COALESCE(p.inReplyToID, 0) as inReplyToID,
+            (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount,
+            p.visibility
         FROM posts p
         LEFT JOIN categories c ON p.categoryID = c.idCategory
-        WHERE p.userID = ?
+        WHERE p.userID = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + `
         ORDER BY p.created_at DESC`
 
-	rows, err := db.Query(query, userID)
+	rows, err := db.Query(query, append([]interface{}{userID}, visibleArgs...)...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to query posts",
@@ -414,11 +598,29 @@ func GetPostByUserID(c echo.Context) error {
 			&post.ImageURL,
 			&post.CategoryID,
 			&post.Category,
+			&post.EditedAt,
+			&post.QuotedPostID,
+			&post.RepostCount,
+			&post.QuoteCount,
+			&post.InReplyToID,
+			&post.ReplyCount,
+			&post.Visibility,
 		); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{
 				"error": "Failed to scan post data",
 			})
 		}
+		post.Edited = post.EditedAt != ""
+		if post.QuotedPost, err = loadQuotedPost(post.QuotedPostID, viewerID(c)); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to query quoted post",
+			})
+		}
+		if post.Preview, err = loadLinkPreview(post.IDPost); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to query link preview",
+			})
+		}
 		posts = append(posts, post)
 	}
 	if err := rows.Err(); err != nil {
@@ -434,13 +636,18 @@ func GetCategoryByID(c echo.Context) error {
 	categoryID := c.QueryParam("categoryId")
 
 	// Get category from the database
-	query := `SELECT idCategory, name, description FROM categories WHERE idCategory = ?`
-	row := db.QueryRow(query, categoryID)
-
-	var category Category
-	if err := row.Scan(&category.IDCategory, &category.Name, &category.Description); err != nil {
+	category, err := loadCommunity(categoryID)
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan category data"})
 	}
+	if category == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Category not found"})
+	}
+
+	category.Role, category.MembershipStatus, err = communityMembership(category.IDCategory, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query membership"})
+	}
 
 	// Return category as JSON response
 	return c.JSON(http.StatusOK, category)
@@ -449,9 +656,33 @@ func GetCategoryByID(c echo.Context) error {
 func GetAllCommentsToPost(c echo.Context) error {
 	postID := c.QueryParam("idPost")
 
-	// Get all comments from the database
-	query := `SELECT idComment, idPost, idUser, content_text, created_at FROM comments WHERE idPost = ?`
-	rows, err := db.Query(query, postID)
+	postIDInt, err := strconv.Atoi(postID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+	exists, err := publishedPostExists(postIDInt, viewerID(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
+
+	// Get all comments from the database, tombstones included so replies keep their parent
+	viewer := viewerID(c)
+	filter, err := loadWordFilter(viewer, mutedWordScopeComments)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+
+	query := `
+        SELECT idComment, idPost, idUser, COALESCE(parentID, 0), content_text, created_at,
+               COALESCE(edited_at, ''), deleted_at IS NOT NULL, NOT ` + notBlockedSQL("comments.idUser") + `,
+               removed_at IS NOT NULL
+        FROM comments
+        WHERE idPost = ? AND ` + notShadowbannedSQL("comments.idUser") + ` AND (held_at IS NULL OR idUser = ?)
+        ORDER BY created_at`
+	rows, err := db.Query(query, viewer, viewer, postID, viewer, viewer)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query comments"})
 	}
@@ -460,9 +691,41 @@ func GetAllCommentsToPost(c echo.Context) error {
 	var comments []Comment
 	for rows.Next() {
 		var comment Comment
-		if err := rows.Scan(&comment.IDComment, &comment.IDPost, &comment.IDUser, &comment.ContentText, &comment.CreatedAt); err != nil {
+		if err := rows.Scan(
+			&comment.IDComment,
+			&comment.IDPost,
+			&comment.IDUser,
+			&comment.ParentID,
+			&comment.ContentText,
+			&comment.CreatedAt,
+			&comment.EditedAt,
+			&comment.Deleted,
+			&comment.Hidden,
+			&comment.Removed,
+		); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan comment data"})
 		}
+		if comment.Deleted {
+			comment.IDUser = 0
+			comment.ContentText = deletedCommentText
+			comment.EditedAt = ""
+			comment.Hidden = false
+			comment.Removed = false
+		} else if comment.Removed {
+			comment.IDUser = 0
+			comment.ContentText = removedCommentText
+			comment.EditedAt = ""
+			comment.Hidden = false
+		} else if comment.Hidden {
+			// Kept as a placeholder so replies stay in place
+			comment.IDUser = 0
+			comment.ContentText = hiddenCommentText
+			comment.EditedAt = ""
+		} else if filtered, _ := filter.match(comment.ContentText); filtered {
+			// Muted comments always become placeholders, removing them would orphan replies
+			comment.ContentText = ""
+			comment.Filtered = true
+		}
 		comments = append(comments, comment)
 	}
 	if err := rows.Err(); err != nil {
@@ -477,11 +740,11 @@ func GetUserByID(c echo.Context) error {
 	userID := c.QueryParam("id")
 
 	// Get user from the database
-	query := `SELECT idUser, username, displayName, email FROM users WHERE idUser = ?`
+	query := `SELECT idUser, username, displayName, email, private FROM users WHERE idUser = ?`
 	row := db.QueryRow(query, userID)
 
 	var user User
-	if err := row.Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.Email); err != nil {
+	if err := row.Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.Email, &user.Private); err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan user data"})
 	}
 
@@ -523,7 +786,7 @@ func NumberOfSubscribers(c echo.Context) error {
 		})
 	}
 
-	query := `SELECT COUNT(*) FROM subscriptions WHERE subscribedToID = ?`
+	query := `SELECT COUNT(*) FROM subscriptions WHERE subscribedToID = ? AND status = 'accepted'`
 	var count int
 	err := db.QueryRow(query, userID).Scan(&count)
 	if err != nil {
@@ -546,7 +809,7 @@ func NumberOfSubscribeTo(c echo.Context) error {
 		})
 	}
 
-	query := `SELECT COUNT(*) FROM subscriptions WHERE subscriberID = ?`
+	query := `SELECT COUNT(*) FROM subscriptions WHERE subscriberID = ? AND status = 'accepted'`
 	var count int
 	err := db.QueryRow(query, userID).Scan(&count)
 	if err != nil {
@@ -567,6 +830,17 @@ func AddPost(c echo.Context) error {
 		UserID          string   `json:"userID"`
 		CategoryID      string   `json:"categoryID"`
 		SecondaryImages []string `json:"secondaryImages"`
+		// Draft keeps the post private, PublishAt (RFC3339) schedules it
+		Draft     bool   `json:"draft"`
+		PublishAt string `json:"publishAt"`
+		// Set to embed another post, turning this one into a quote post
+		QuotedPostID int `json:"quotedPostID"`
+		// Set to publish the post as a reply in another post's conversation
+		InReplyToID int `json:"inReplyToID"`
+		// Optional poll attached to the post
+		Poll *PollRequest `json:"poll"`
+		// public (default), followers or mentioned
+		Visibility string `json:"visibility"`
 	}
 
 	postReq := new(PostRequest)
@@ -574,45 +848,146 @@ func AddPost(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request data"})
 	}
 
-	query := `INSERT INTO posts (content_text, imageURL, created_at, userID, categoryID)
-              VALUES (?, ?, ?, ?, ?)`
-	_, err := db.Exec(query,
+	// The author is always the logged in user. userID is still accepted from
+	// older clients, but only when it names them.
+	userID := currentUser(c).UserID
+	if postReq.UserID != "" && postReq.UserID != strconv.Itoa(userID) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "You can only post as yourself"})
+	}
+	postReq.UserID = strconv.Itoa(userID)
+
+	if postReq.Poll != nil {
+		if err := validatePollRequest(postReq.Poll); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+	}
+
+	status, publishAt, err := parsePublishState(postReq.Draft, postReq.PublishAt)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	visibility, err := parseVisibility(postReq.Visibility)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if nullableID(postReq.CategoryID) != nil {
+		if status, err := checkCanPost(postReq.CategoryID, userID); err != nil {
+			return c.JSON(status, echo.Map{"error": err.Error()})
+		}
+	}
+
+	categoryID, _ := strconv.Atoi(postReq.CategoryID)
+	verdict, ok := checkAutomod(c, automodContent{
+		TargetType: reportTargetPost,
+		UserID:     userID,
+		CategoryID: categoryID,
+		Text:       postReq.ContentText,
+	})
+	if !ok {
+		return nil
+	}
+	if err := verdict.scoreSpam(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to score post: " + err.Error()})
+	}
+
+	var quotedPostID, inReplyToID interface{}
+	if postReq.QuotedPostID != 0 {
+		exists, err := publishedPostExists(postReq.QuotedPostID, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+		if !exists {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Quoted post not found"})
+		}
+		quotedPostID = postReq.QuotedPostID
+	}
+	if postReq.InReplyToID != 0 {
+		exists, err := publishedPostExists(postReq.InReplyToID, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+		if !exists {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Post to reply to not found"})
+		}
+		inReplyToID = postReq.InReplyToID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+	defer tx.Rollback()
+
+	previewURL := extractFirstURL(postReq.ContentText)
+
+	query := `INSERT INTO posts (content_text, imageURL, created_at, userID, categoryID, status, publish_at, quotedPostID, inReplyToID, previewURL, visibility)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query,
 		postReq.ContentText,
 		postReq.ImageURL,
-		time.Now().Format(time.RFC3339),
-		postReq.UserID,
-		postReq.CategoryID,
+		time.Now().UTC().Format(time.RFC3339),
+		userID,
+		nullableID(postReq.CategoryID),
+		status,
+		publishAt,
+		quotedPostID,
+		inReplyToID,
+		nullableString(previewURL),
+		visibility,
 	)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
 
-	// get id of latest post
-	var postID int
-	query = `SELECT idPost FROM posts WHERE content_text = ? AND userID = ? ORDER BY created_at DESC LIMIT 1`
-	err = db.QueryRow(query, postReq.ContentText, postReq.UserID).Scan(&postID)
+	postID, err := result.LastInsertId()
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
 
+	if err := storeMentions(tx, postID, postReq.ContentText); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
 	// Insert secondary images if provided
 	if len(postReq.SecondaryImages) > 0 {
 		for _, imageURL := range postReq.SecondaryImages {
 			query := `INSERT INTO images (postID, imageURL) VALUES (?, ?)`
-			_, err := db.Exec(query, postID, imageURL)
+			_, err := tx.Exec(query, postID, imageURL)
 			if err != nil {
 				return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 			}
 		}
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{"message": "Post created", "post": postReq})
+	if postReq.Poll != nil {
+		if err := insertPoll(tx, postID, postReq.Poll); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+	}
+
+	if err := verdict.apply(tx, postID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+	if verdict.Action == automodHold {
+		status = postStatusHeld
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	queueLinkPreview(previewURL)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post created", "post": postReq, "idPost": postID, "status": status})
 }
 
 func AddComment(c echo.Context) error {
 	type CommentRequest struct {
 		PostID      string `json:"postID"`
 		UserID      string `json:"userID"`
+		ParentID    int    `json:"parentID"`
 		ContentText string `json:"contentText"`
 	}
 
@@ -625,15 +1000,96 @@ func AddComment(c echo.Context) error {
 	}
 
 	// Validate input
-	if comment.PostID == "" || comment.UserID == "" || comment.ContentText == "" {
+	if comment.PostID == "" || comment.ContentText == "" {
 		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "PostID, userID, and content text are required",
+			"error": "PostID and content text are required",
 		})
 	}
 
+	// The author is always the logged in user. userID is still accepted from
+	// older clients, but only when it names them.
+	userID := currentUser(c).UserID
+	if comment.UserID != "" && comment.UserID != strconv.Itoa(userID) {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only comment as yourself",
+		})
+	}
+
+	postIDInt, err := strconv.Atoi(comment.PostID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid post ID format",
+		})
+	}
+	// publishedPostExists also fails when the author and commenter block each other
+	postExists, err := publishedPostExists(postIDInt, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if !postExists {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "Post not found",
+		})
+	}
+	if status, err := checkCanComment(postIDInt, userID); err != nil {
+		return c.JSON(status, echo.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Replies must point at a live comment on the same post
+	var parentID interface{}
+	if comment.ParentID != 0 {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM comments WHERE idComment = ? AND idPost = ? AND deleted_at IS NULL)`,
+			comment.ParentID, comment.PostID).Scan(&exists)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Database error",
+			})
+		}
+		if !exists {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "Parent comment not found",
+			})
+		}
+		parentID = comment.ParentID
+	}
+
+	categoryID, _, err := postCommunity(postIDInt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	verdict, ok := checkAutomod(c, automodContent{
+		TargetType: reportTargetComment,
+		UserID:     userID,
+		CategoryID: categoryID,
+		Text:       comment.ContentText,
+	})
+	if !ok {
+		return nil
+	}
+	if err := verdict.scoreSpam(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to score comment: " + err.Error(),
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
 	// Insert comment into the database
-	query := `INSERT INTO comments (idPost, idUser, content_text, created_at) VALUES (?, ?, ?, ?)`
-	result, err := db.Exec(query, comment.PostID, comment.UserID, comment.ContentText, time.Now().Format(time.RFC3339))
+	query := `INSERT INTO comments (idPost, idUser, parentID, content_text, created_at) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, comment.PostID, userID, parentID, comment.ContentText, time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to insert comment: " + err.Error(),
@@ -641,8 +1097,19 @@ func AddComment(c echo.Context) error {
 	}
 
 	// Check if the insert was successful
-	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to confirm comment insertion",
+		})
+	}
+
+	if err := verdict.apply(tx, commentID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to apply automatic moderation: " + err.Error(),
+		})
+	}
+	if err := tx.Commit(); err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to confirm comment insertion",
 		})
@@ -651,6 +1118,7 @@ func AddComment(c echo.Context) error {
 	// Return success response
 	return c.JSON(http.StatusOK, echo.Map{
 		"message": "Comment added successfully",
+		"held":    verdict.Action == automodHold,
 	})
 }
 
@@ -661,6 +1129,10 @@ func EditPost(c echo.Context) error {
 		ContentText string `json:"contentText"`
 		ImageURL    string `json:"imageURL"`
 		CategoryID  string `json:"categoryID"`
+		// nil leaves the secondary images untouched
+		SecondaryImages *[]string `json:"secondaryImages"`
+		// Empty keeps the current visibility
+		Visibility string `json:"visibility"`
 	}
 
 	// Parse request body
@@ -687,8 +1159,83 @@ func EditPost(c echo.Context) error {
 	fmt.Printf("Executing query with values: content=%s, image=%s, category=%s, postID=%s\n",
 		req.ContentText, req.ImageURL, req.CategoryID, req.PostID)
 
-	query := `UPDATE posts SET content_text = ?, imageURL = ?, categoryID = ? WHERE idPost = ?`
-	result, err := db.Exec(query, req.ContentText, req.ImageURL, req.CategoryID, req.PostID)
+	var visibility interface{}
+	if req.Visibility != "" {
+		parsed, err := parseVisibility(req.Visibility)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": err.Error(),
+			})
+		}
+		visibility = parsed
+	}
+
+	var ownerID, categoryID int
+	var createdAt, status string
+	err := db.QueryRow(`SELECT userID, created_at, status, COALESCE(categoryID, 0) FROM posts WHERE idPost = ? AND deleted_at IS NULL`, req.PostID).
+		Scan(&ownerID, &createdAt, &status, &categoryID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "Post not found",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if ownerID != currentUser(c).UserID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only edit your own posts",
+		})
+	}
+
+	// Moving a post into another community needs the same rights as posting there
+	if nullableID(req.CategoryID) != nil && req.CategoryID != strconv.Itoa(categoryID) {
+		if status, err := checkCanPost(req.CategoryID, ownerID); err != nil {
+			return c.JSON(status, echo.Map{"error": err.Error()})
+		}
+	}
+
+	postID, _ := strconv.Atoi(req.PostID)
+	newCategoryID, _ := strconv.Atoi(req.CategoryID)
+	verdict, ok := checkAutomod(c, automodContent{
+		TargetType: reportTargetPost,
+		UserID:     ownerID,
+		CategoryID: newCategoryID,
+		PostID:     postID,
+		Text:       req.ContentText,
+	})
+	if !ok {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	// Drafts are private and edits right after publishing fix typos,
+	// neither shows up as a revision
+	var editedAt interface{}
+	if status == postStatusPublished && !withinEditGracePeriod(createdAt) {
+		if err := snapshotPostRevision(tx, req.PostID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to store post revision: " + err.Error(),
+			})
+		}
+		editedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	previewURL := extractFirstURL(req.ContentText)
+
+	query := `UPDATE posts SET content_text = ?, imageURL = ?, categoryID = ?, edited_at = COALESCE(?, edited_at), previewURL = ?,
+              visibility = COALESCE(?, visibility) WHERE idPost = ?`
+	_, err = tx.Exec(query, req.ContentText, req.ImageURL, nullableID(req.CategoryID), editedAt, nullableString(previewURL),
+		visibility, req.PostID)
 	if err != nil {
 		fmt.Printf("Database error: %v\n", err)
 		return c.JSON(http.StatusInternalServerError, echo.Map{
@@ -696,25 +1243,50 @@ func EditPost(c echo.Context) error {
 		})
 	}
 
-	// Verify update
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+	if err := storeMentions(tx, req.PostID, req.ContentText); err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
-			"error": "Failed to confirm update",
+			"error": "Failed to update mentions: " + err.Error(),
 		})
 	}
-	if rowsAffected == 0 {
-		return c.JSON(http.StatusNotFound, echo.Map{
-			"error": "Post not found",
+
+	if req.SecondaryImages != nil {
+		if _, err := tx.Exec(`DELETE FROM images WHERE postID = ?`, req.PostID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to update images: " + err.Error(),
+			})
+		}
+		for _, imageURL := range *req.SecondaryImages {
+			if _, err := tx.Exec(`INSERT INTO images (postID, imageURL) VALUES (?, ?)`, req.PostID, imageURL); err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"error": "Failed to update images: " + err.Error(),
+				})
+			}
+		}
+	}
+
+	if err := verdict.apply(tx, int64(postID)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to apply automatic moderation: " + err.Error(),
 		})
 	}
 
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to confirm update",
+		})
+	}
+
+	queueLinkPreview(previewURL)
+
 	return c.JSON(http.StatusOK, echo.Map{
 		"message": "Post updated successfully",
+		"edited":  editedAt != nil,
+		"held":    verdict.Action == automodHold,
 	})
 }
 
-// In main.go, update the DeletePost function:
+// DeletePost soft deletes a post; the author can restore it within
+// postRestoreWindow and purgeDeletedPosts removes it for good later
 func DeletePost(c echo.Context) error {
 	// Create struct for request body
 	type DeleteRequest struct {
@@ -736,9 +1308,12 @@ func DeletePost(c echo.Context) error {
 		})
 	}
 
-	// Delete post from database
-	query := `DELETE FROM posts WHERE idPost = ?`
-	result, err := db.Exec(query, req.PostID)
+	postID, _ := strconv.Atoi(req.PostID)
+	before := snapshot("post", postID)
+
+	// Mark the post as deleted, only its author may do so
+	query := `UPDATE posts SET deleted_at = ? WHERE idPost = ? AND userID = ? AND deleted_at IS NULL`
+	result, err := db.Exec(query, time.Now().UTC().Format(time.RFC3339), req.PostID, currentUser(c).UserID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to delete post: " + err.Error(),
@@ -757,6 +1332,7 @@ func DeletePost(c echo.Context) error {
 			"error": "Post not found",
 		})
 	}
+	audit(c, auditActionDeletePost, "post", postID, before)
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"message": "Post deleted successfully",
@@ -765,13 +1341,29 @@ func DeletePost(c echo.Context) error {
 
 func GetPostById(c echo.Context) error {
 	type Post struct {
-		IDPost          int      `json:"idPost"`
-		ContentText     string   `json:"content_text"`
-		CreatedAt       string   `json:"created_at"`
-		UserID          int      `json:"userID"`
-		Category        string   `json:"category"`
-		ImageURL        string   `json:"imageURL"`
-		SecondaryImages []string `json:"secondaryImages"`
+		IDPost          int          `json:"idPost"`
+		ContentText     string       `json:"content_text"`
+		CreatedAt       string       `json:"created_at"`
+		UserID          int          `json:"userID"`
+		Category        string       `json:"category"`
+		ImageURL        string       `json:"imageURL"`
+		SecondaryImages []string     `json:"secondaryImages"`
+		Edited          bool         `json:"edited"`
+		EditedAt        string       `json:"edited_at"`
+		QuotedPostID    int          `json:"quotedPostID"`
+		QuotedPost      *QuotedPost  `json:"quotedPost,omitempty"`
+		Preview         *LinkPreview `json:"preview,omitempty"`
+		RepostCount     int          `json:"repostCount"`
+		QuoteCount      int          `json:"quoteCount"`
+		InReplyToID     int          `json:"inReplyToID"`
+		ReplyCount      int          `json:"replyCount"`
+		Visibility      string       `json:"visibility"`
+		Poll            *Poll        `json:"poll,omitempty"`
+		// Locked posts take no new comments
+		Locked bool `json:"locked"`
+		// Only filled in for the author of an unpublished post
+		Status    string `json:"status,omitempty"`
+		PublishAt string `json:"publish_at,omitempty"`
 	}
 
 	postID := c.QueryParam("id")
@@ -779,22 +1371,47 @@ func GetPostById(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Post ID is required"})
 	}
 
+	// Posts the viewer may not see are reported as missing, not forbidden
+	visible, visibleArgs := postVisibleSQL("p", viewerID(c))
 	query := `
         SELECT p.idPost, p.content_text, p.created_at, p.userID, 
                COALESCE(c.name, '') as category_name,
-               COALESCE(p.imageURL, '') as imageURL
+               COALESCE(p.imageURL, '') as imageURL,
+               COALESCE(p.edited_at, '') as edited_at,
+               COALESCE(p.quotedPostID, 0) as quotedPostID,
+               (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                   AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as repostCount,
+               (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                   AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as quoteCount,
+               COALESCE(p.inReplyToID, 0) as inReplyToID,
+               (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                   AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount,
+               p.visibility,
+               p.status,
+               COALESCE(p.publish_at, '') as publish_at,
+               p.locked
         FROM posts p 
         LEFT JOIN categories c ON p.categoryID = c.idCategory
-        WHERE p.idPost = ?`
+        WHERE p.idPost = ? AND p.deleted_at IS NULL AND ` + visible
 
 	var post Post
-	err := db.QueryRow(query, postID).Scan(
+	err := db.QueryRow(query, append([]interface{}{postID}, visibleArgs...)...).Scan(
 		&post.IDPost,
 		&post.ContentText,
 		&post.CreatedAt,
 		&post.UserID,
 		&post.Category,
 		&post.ImageURL,
+		&post.EditedAt,
+		&post.QuotedPostID,
+		&post.RepostCount,
+		&post.QuoteCount,
+		&post.InReplyToID,
+		&post.ReplyCount,
+		&post.Visibility,
+		&post.Status,
+		&post.PublishAt,
+		&post.Locked,
 	)
 
 	if err == sql.ErrNoRows {
@@ -803,6 +1420,24 @@ func GetPostById(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan post data"})
 	}
+	post.Edited = post.EditedAt != ""
+	if post.QuotedPost, err = loadQuotedPost(post.QuotedPostID, viewerID(c)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query quoted post"})
+	}
+	if post.Preview, err = loadLinkPreview(post.IDPost); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query link preview"})
+	}
+	if post.Poll, err = loadPoll(post.IDPost, viewerID(c)); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query poll"})
+	}
+
+	// Drafts and scheduled posts don't exist for anyone but their author
+	if post.Status == postStatusPublished {
+		post.Status = ""
+		post.PublishAt = ""
+	} else if viewer := optionalUser(c); viewer == nil || viewer.UserID != post.UserID {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
 
 	imagesQuery := `
         SELECT imageURL FROM images 
@@ -837,6 +1472,11 @@ func AddCategory(c echo.Context) error {
 	type CategoryRequest struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
+		Rules       string `json:"rules"`
+		BannerURL   string `json:"bannerURL"`
+		IconURL     string `json:"iconURL"`
+		// public (default), restricted or private
+		Mode string `json:"mode"`
 	}
 
 	// Bind request body
@@ -854,9 +1494,31 @@ func AddCategory(c echo.Context) error {
 		})
 	}
 
-	// Insert category
-	query := `INSERT INTO categories (name, description) VALUES (?, ?)`
-	result, err := db.Exec(query, category.Name, category.Description)
+	mode, err := parseCommunityMode(category.Mode)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var taken bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories WHERE name = ? COLLATE NOCASE)`, category.Name).Scan(&taken); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if taken {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "A category with that name already exists"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	// Insert category, the creator becomes its owner
+	ownerID := currentUser(c).UserID
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	query := `INSERT INTO categories (name, description, ownerID, rules, bannerURL, iconURL, mode, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, category.Name, category.Description, ownerID, category.Rules,
+		nullableString(category.BannerURL), nullableString(category.IconURL), mode, createdAt)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to insert category",
@@ -870,6 +1532,16 @@ func AddCategory(c echo.Context) error {
 		})
 	}
 
+	_, err = tx.Exec(`INSERT INTO community_members (idCategory, idUser, role, status, joined_at) VALUES (?, ?, ?, ?, ?)`,
+		id, ownerID, communityRoleOwner, membershipAccepted, createdAt)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to add owner"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to insert category"})
+	}
+
 	return c.JSON(http.StatusOK, echo.Map{
 		"message":    "Category added successfully",
 		"categoryId": id,
@@ -878,22 +1550,39 @@ func AddCategory(c echo.Context) error {
 
 func UpdatePassword(c echo.Context) error {
 	type PasswordRequest struct {
-		UserID   int    `json:"userID"`
-		Password string `json:"password"`
+		CurrentPassword string `json:"currentPassword"`
+		Password        string `json:"password"`
 	}
 
 	passwordReq := new(PasswordRequest)
-	if err := c.Bind(passwordReq); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request data"})
+	if err := c.Bind(passwordReq); err != nil || passwordReq.CurrentPassword == "" || passwordReq.Password == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Current and new password are required"})
 	}
+	userID := currentUser(c).UserID
 
-	fmt.Println(passwordReq)
+	// A wrong current password counts towards the login lockout, so a stolen
+	// session can't be used to guess it
+	if throttled, err := rejectThrottledLogin(c, userID, nil); throttled {
+		return err
+	}
+	var passwordMatches bool
+	err := db.QueryRow(`SELECT password = ? FROM users WHERE idUser = ?`, passwordReq.CurrentPassword, userID).Scan(&passwordMatches)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if !passwordMatches {
+		recordAudit(c, userID, auditActionLoginFailed, "user", userID, nil, echo.Map{"reason": "update_password"})
+		countLoginFailure(c, userID)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Current password is incorrect"})
+	}
 
-	query := `UPDATE users SET password = ? WHERE idUser = ?`
-	_, err := db.Exec(query, passwordReq.Password, passwordReq.UserID)
+	before := snapshot("user", userID)
+	query := `UPDATE users SET password = ?, must_reset_password = 0 WHERE idUser = ?`
+	_, err = db.Exec(query, passwordReq.Password, userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
 	}
+	audit(c, auditActionUpdatePassword, "user", userID, before)
 	return c.JSON(http.StatusOK, echo.Map{"message": "Password updated"})
 }
 
@@ -1029,13 +1718,25 @@ func GetUsersSavedPosts(c echo.Context) error {
 	}
 
 	// Updated query to join with posts table
+	visible, visibleArgs := postVisibleSQL("p", viewerID(c))
 	query := `
-        SELECT p.idPost, p.content_text, p.imageURL, p.created_at, p.userID, p.categoryID 
+        SELECT p.idPost, p.content_text, COALESCE(p.imageURL, ''), p.created_at, p.userID,
+               COALESCE(p.categoryID, 0), COALESCE(c.name, ''), COALESCE(p.edited_at, ''),
+               COALESCE(p.quotedPostID, 0),
+               (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                   AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)),
+               (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                   AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)),
+               COALESCE(p.inReplyToID, 0),
+               (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                   AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)),
+               p.visibility
         FROM saved_posts sp
         JOIN posts p ON sp.idPost = p.idPost
-        WHERE sp.idUser = ?`
+        LEFT JOIN categories c ON p.categoryID = c.idCategory
+        WHERE sp.idUser = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
 
-	rows, err := db.Query(query, userID)
+	rows, err := db.Query(query, append([]interface{}{userID}, visibleArgs...)...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to query saved posts",
@@ -1046,26 +1747,28 @@ func GetUsersSavedPosts(c echo.Context) error {
 	var savedPosts []PostWithCategory
 	for rows.Next() {
 		var post PostWithCategory
-		if err := rows.Scan(&post.IDPost, &post.ContentText, &post.ImageURL, &post.CreatedAt, &post.UserID, &post.CategoryID); err != nil {
+		if err := rows.Scan(&post.IDPost, &post.ContentText, &post.ImageURL, &post.CreatedAt, &post.UserID, &post.CategoryID,
+			&post.Category, &post.EditedAt, &post.QuotedPostID, &post.RepostCount, &post.QuoteCount,
+			&post.InReplyToID, &post.ReplyCount, &post.Visibility); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{
 				"error": "Failed to scan saved post data",
 			})
 		}
+		post.Edited = post.EditedAt != ""
 		savedPosts = append(savedPosts, post)
 	}
 
-	// Get category name for each post
 	for i, post := range savedPosts {
-		query := `SELECT name FROM categories WHERE idCategory = ?`
-		row := db.QueryRow(query, post.CategoryID)
-		var categoryName string
-		err := row.Scan(&categoryName)
-		if err != nil {
+		if savedPosts[i].QuotedPost, err = loadQuotedPost(post.QuotedPostID, viewerID(c)); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to query quoted post",
+			})
+		}
+		if savedPosts[i].Preview, err = loadLinkPreview(post.IDPost); err != nil {
 			return c.JSON(http.StatusInternalServerError, echo.Map{
-				"error": "Failed to scan category name",
+				"error": "Failed to query link preview",
 			})
 		}
-		savedPosts[i].Category = categoryName
 	}
 
 	return c.JSON(http.StatusOK, savedPosts)
@@ -1081,73 +1784,148 @@ func CheckIfUserSubscribed(c echo.Context) error {
 		})
 	}
 
-	query := `SELECT COUNT(*) FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ?`
-	var count int
-	err := db.QueryRow(query, subscriberID, subscribedToID).Scan(&count)
+	status, err := subscriptionStatus(subscriberID, subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to check subscription status",
+		})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"subscribed": status == subscriptionAccepted,
+		"pending":    status == subscriptionPending,
+	})
+}
+
+func SubscribeORUnsubscribe(c echo.Context) error {
+	subscribedToID := c.QueryParam("subscribedToID")
+
+	if subscribedToID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "User ID is required",
+		})
+	}
+
+	// The follower is always the logged in user. subscriberID is still
+	// accepted from older clients, but only when it names them.
+	subscriberIDInt := currentUser(c).UserID
+	subscriberID := strconv.Itoa(subscriberIDInt)
+	if requested := c.QueryParam("subscriberID"); requested != "" && requested != subscriberID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only follow as yourself",
+		})
+	}
+	subscribedToIDInt, err := strconv.Atoi(subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid user ID format",
+		})
+	}
+
+	// Check if the subscription already exists
+	status, err := subscriptionStatus(subscriberID, subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to check subscription status",
+		})
+	}
+	if status == subscriptionPending {
+		// Toggling a pending request withdraws it
+		return resolveFollowRequest(c, subscriberIDInt, subscribedToIDInt, subscribedToIDInt, false,
+			notificationFollowRequestCancelled, "Follow request cancelled")
+	}
+	if status != "" {
+		// If it exists, unsubscribe
+		query := `DELETE FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ?`
+		_, err := db.Exec(query, subscriberID, subscribedToID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to unsubscribe",
+			})
+		}
+		return c.JSON(http.StatusOK, echo.Map{
+			"message": "Subscription status changed successfully",
+		})
+	}
+
+	blocked, err := isBlockedBetween(subscriberID, subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if blocked {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You cannot follow this user",
+		})
+	}
+
+	// If it doesn't exist, subscribe. Private accounts get a follow request instead
+	private, err := isPrivateAccount(subscribedToID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to check account privacy",
+		})
+	}
+	status, notificationType, message := subscriptionAccepted, notificationFollow, "Subscription status changed successfully"
+	if private {
+		status, notificationType, message = subscriptionPending, notificationFollowRequest, "Follow request sent"
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
-			"error": "Failed to check subscription status",
+			"error": "Database error",
 		})
 	}
+	defer tx.Rollback()
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"subscribed": count > 0,
-	})
-}
-
-func SubscribeORUnsubscribe(c echo.Context) error {
-	subscribedToID := c.QueryParam("subscribedToID")
-	subscriberID := c.QueryParam("subscriberID")
-
-	if subscribedToID == "" || subscriberID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "User ID and Subscriber ID are required",
+	query := `INSERT INTO subscriptions (subscriberID, subscribedToID, status, created_at) VALUES (?, ?, ?, ?)`
+	_, err = tx.Exec(query, subscriberID, subscribedToID, status, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to subscribe",
 		})
 	}
-
-	// Check if the subscription already exists
-	query := `SELECT COUNT(*) FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ?`
-	var count int
-	err := db.QueryRow(query, subscriberID, subscribedToID).Scan(&count)
-	if err != nil {
+	if err := notify(tx, subscribedToIDInt, subscriberIDInt, notificationType, 0, ""); err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
-			"error": "Failed to check subscription status",
+			"error": "Failed to send notification",
 		})
 	}
-	if count > 0 {
-		// If it exists, unsubscribe
-		query = `DELETE FROM subscriptions WHERE subscriberID = ? AND subscribedToID = ?`
-		_, err := db.Exec(query, subscriberID, subscribedToID)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{
-				"error": "Failed to unsubscribe",
-			})
-		}
-	} else {
-		// If it doesn't exist, subscribe
-		query = `INSERT INTO subscriptions (subscriberID, subscribedToID) VALUES (?, ?)`
-		_, err := db.Exec(query, subscriberID, subscribedToID)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{
-				"error": "Failed to subscribe",
-			})
-		}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to subscribe",
+		})
 	}
+
 	return c.JSON(http.StatusOK, echo.Map{
-		"message": "Subscription status changed successfully",
+		"message": message,
+		"pending": private,
 	})
 }
 
+// GetListOfSubscribers returns the IDs of the accounts a user follows, kept
+// for older clients. GetFollowing returns the same list as user cards.
 func GetListOfSubscribers(c echo.Context) error {
-	userID := c.QueryParam("userID")
-
-	if userID == "" {
+	userID, err := strconv.Atoi(c.QueryParam("userID"))
+	if err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "User ID is required",
 		})
 	}
+	allowed, err := canSeeConnections(userID, viewerID(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if !allowed {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "This account is private",
+		})
+	}
 
-	query := `SELECT subscribedToID FROM subscriptions WHERE subscriberID = ?`
+	query := `SELECT subscribedToID FROM subscriptions WHERE subscriberID = ? AND status = 'accepted'`
 	rows, err := db.Query(query, userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
@@ -1294,25 +2072,71 @@ func jwtMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			})
 		}
 
+		// Role and suspension are read fresh, the token may predate a change
+		state, err := loadAccountState(claims.UserID)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusUnauthorized, echo.Map{
+				"error": "Account no longer exists",
+			})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to load account",
+			})
+		}
+		if status, body := checkAccountState(state, claims.IssuedAt, c.Path()); status != 0 {
+			return c.JSON(status, body)
+		}
+
 		// Set user info in context for use in protected routes
 		c.Set("user", claims)
+		c.Set("role", state.Role)
 
 		return next(c)
 	}
 }
 
-func main() {
+// currentUser returns the claims stored by jwtMiddleware, or nil on public routes
+func currentUser(c echo.Context) *JwtCustomClaims {
+	claims, _ := c.Get("user").(*JwtCustomClaims)
+	return claims
+}
 
-	// Open a connection to the SQLite database
-	database, err := sql.Open("sqlite3", "db.db")
-	if err != nil {
-		log.Fatal(err)
+// optionalUser identifies the viewer on public routes. A missing or invalid
+// token is not an error there, the request is simply treated as anonymous.
+func optionalUser(c echo.Context) *JwtCustomClaims {
+	if claims := currentUser(c); claims != nil {
+		return claims
 	}
-	defer database.Close()
 
-	db = database
+	tokenString, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	token, err := jwt.ParseWithClaims(tokenString, &JwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecret), nil
+	})
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims, _ := token.Claims.(*JwtCustomClaims)
+	return claims
+}
 
-	// Create tables
+// viewerID is the ID of the user making the request, 0 when anonymous
+func viewerID(c echo.Context) int {
+	if claims := optionalUser(c); claims != nil {
+		return claims.UserID
+	}
+	return 0
+}
+
+// createTables creates every table the app uses, and brings older databases
+// up to date
+func createTables(database *sql.DB) {
 	createUsersTable(database)
 	CreateImagesTable(database)
 	createSavedPostsTable(database)
@@ -1322,6 +2146,52 @@ func main() {
 	createLikesDislikesTable(database)
 	createMessagesTable(database)
 	createSubscriptionsTable(database)
+	createCommentRevisionsTable(database)
+	createPostRevisionsTable(database)
+	createRepostsTable(database)
+	createPollTables(database)
+	createLinkPreviewsTable(database)
+	createPostMentionsTable(database)
+	createNotificationsTable(database)
+	createBlockTables(database)
+	createMutedWordsTable(database)
+	createCommunityMembersTable(database)
+	createCommunityModerationTables(database)
+	createReportsTable(database)
+	createAutomodTables(database)
+	createContentFingerprintsTable(database)
+	createAuditLogTable(database)
+	createAccountTokensTable(database)
+	createLoginThrottleTable(database)
+	createRecoveryCodesTable(database)
+}
+
+func main() {
+	// Offline evaluation of spam scoring, no database or server involved
+	spamEval := flag.String("spam-eval", "", "score a JSON lines spam corpus and exit")
+	flag.Parse()
+	if *spamEval != "" {
+		if err := runSpamEvaluation(*spamEval); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Open a connection to the SQLite database
+	// Foreign keys are off by default in SQLite and must be enabled per connection
+	database, err := sql.Open("sqlite3", "db.db?_foreign_keys=on")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close()
+
+	db = database
+
+	createTables(database)
+	bootstrapAdmin(database)
+	loadRateLimitConfig()
+	loadPostEditGracePeriod()
+	configureMailer()
 
 	// // Generate random users, posts, and comments
 	// n := 20 // Number of random entries to generate
@@ -1342,8 +2212,16 @@ func main() {
 
 	// InsertTestUser()
 
+	go startDeletedPostPurger()
+	go startScheduledPostPublisher()
+	go startLinkPreviewWorker(newUnfurler(isPublicIP))
+	if store, ok := rateLimiter.(*memoryRateLimitStore); ok {
+		go startRateLimitSweeper(store)
+	}
+
 	// Start the server
 	e := echo.New()
+	e.IPExtractor = clientIPExtractor()
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"http://localhost:8080", "http://127.0.0.1:8080", "http://138.68.76.63:8080"},
@@ -1356,7 +2234,7 @@ func main() {
 			"X-Requested-With",
 		},
 		AllowCredentials: true,
-		ExposeHeaders:    []string{"Authorization"},
+		ExposeHeaders:    []string{"Authorization", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
 	}))
 
 	// public routes
@@ -1364,19 +2242,32 @@ func main() {
 	e.GET("/posts", GetAllPosts)
 	e.GET("/posts/category", GetAllPostsForCategory)
 	e.GET("/comments", GetAllCommentsToPost)
+	e.GET("/comments/revisions", GetCommentRevisions)
 	e.GET("/user", GetUserByID)
 	e.GET("/users", GetAllUsers)
 	e.GET("/posts/user", GetPostByUserID)
 	e.GET("/post", GetPostById)
-	e.POST("/login", Login)
+	e.GET("/post/revisions", GetPostRevisions)
+	e.GET("/post/conversation", GetConversation)
+	e.GET("/post/revisions/diff", DiffPostRevisions)
+	e.POST("/login", Login, rateLimit("login"))
+	e.POST("/login/2fa", LoginTwoFactor, rateLimit("login"))
 	e.GET("/likesDislikes", getLikesDislikes)
 	e.GET("/userLikeDislike", getUserLikeDislikeForPost)
-	e.POST("/register", Register)
+	e.POST("/register", Register, rateLimit("register"))
+	e.POST("/unlockAccount", UnlockAccount)
+	e.POST("/verifyEmail", VerifyEmail)
+	e.POST("/forgotPassword", ForgotPassword, rateLimit("accountEmail"))
+	e.POST("/resetPassword", ResetPassword)
+	e.POST("/confirmEmailChange", ConfirmEmailChange)
 	e.GET("/listOfSubscribers", GetListOfSubscribers)
 	e.GET("/numberOfSubscribers", NumberOfSubscribers)
 	e.GET("/numberOfSubscribeTo", NumberOfSubscribeTo)
 	e.GET("/checkSubscription", CheckIfUserSubscribed)
+	e.GET("/followers", GetFollowers)
+	e.GET("/following", GetFollowing)
 	e.GET("/categories", GetAllCategories)
+	e.GET("/community/members", GetCommunityMembers)
 
 	// Create a group for protected routes
 	protected := e.Group("")
@@ -1384,22 +2275,99 @@ func main() {
 
 	// protected routes
 	protected.POST("/addCategory", AddCategory)
-	protected.POST("/addPost", AddPost)
-	protected.POST("/addComment", AddComment)
+	protected.POST("/addPost", AddPost, rateLimit("addPost"))
+	protected.POST("/addThread", AddThread, rateLimit("addThread"))
+	protected.POST("/addComment", AddComment, rateLimit("addComment"))
+	protected.PUT("/editComment", EditComment)
+	protected.DELETE("/deleteComment", DeleteComment)
 	protected.DELETE("/deletePost", DeletePost)
+	protected.PUT("/restorePost", RestorePost)
+	protected.GET("/deletedPosts", GetDeletedPosts)
+	protected.GET("/drafts", GetDrafts)
+	protected.POST("/poll/vote", VotePoll)
+	protected.POST("/repost", Repost)
+	protected.DELETE("/repost", UndoRepost)
+	protected.GET("/feed", GetHomeFeed)
+	protected.PUT("/schedulePost", SchedulePost)
+	protected.PUT("/publishPost", PublishPost)
 	protected.PUT("/editPost", EditPost)
 	protected.PUT("/userEdit", UpdateUser)
-	protected.GET("/like", like)
+	protected.PUT("/privacy", SetAccountPrivacy)
+	protected.GET("/like", like, rateLimit("like"))
 	protected.GET("/dislike", dislike)
 	protected.GET("/messages", getMessages)
-	protected.POST("/sendMessage", SendMessages)
+	protected.POST("/sendMessage", SendMessages, rateLimit("sendMessage"))
 	protected.GET("/conversations", GetUserConversations)
 	protected.GET("/category", GetCategoryByID)
+	protected.PUT("/community", UpdateCommunity)
+	protected.POST("/community/join", JoinCommunity)
+	protected.DELETE("/community/join", LeaveCommunity)
+	protected.GET("/community/members/pending", GetPendingCommunityMembers)
+	protected.PUT("/community/members/approve", ApproveCommunityMember)
+	protected.PUT("/community/members/deny", DenyCommunityMember)
+	protected.POST("/community/moderators", AddCommunityModerator)
+	protected.DELETE("/community/moderators", RemoveCommunityModerator)
+	protected.PUT("/community/posts/remove", RemoveCommunityPost)
+	protected.PUT("/community/comments/remove", RemoveCommunityComment)
+	protected.PUT("/community/posts/lock", LockCommunityPost)
+	protected.PUT("/community/posts/pin", PinCommunityPost)
+	protected.GET("/community/bans", GetCommunityBans)
+	protected.POST("/community/bans", BanFromCommunity)
+	protected.DELETE("/community/bans", UnbanFromCommunity)
+	protected.GET("/community/modlog", GetModLog)
+	protected.POST("/reports", CreateReport)
+	protected.GET("/reports", GetMyReports)
+	protected.GET("/reports/queue", GetReportQueue)
+	protected.PUT("/reports/resolve", ResolveReports)
+	protected.GET("/automod/rules", GetAutomodRules)
+	protected.POST("/automod/rules", CreateAutomodRule)
+	protected.PUT("/automod/rules", UpdateAutomodRule)
+	protected.DELETE("/automod/rules", DeleteAutomodRule)
+	protected.PUT("/automod/overrides", SetAutomodOverride)
+	protected.GET("/automod/log", GetAutomodLog)
+
+	admin := protected.Group("/admin", requireRole(roleAdmin))
+	admin.GET("/users", AdminListUsers)
+	admin.PUT("/users/role", AdminSetRole)
+	admin.PUT("/users/suspend", AdminSuspendUser)
+	admin.PUT("/users/unsuspend", AdminUnsuspendUser)
+	admin.PUT("/users/forcePasswordReset", AdminForcePasswordReset)
+	admin.PUT("/users/shadowban", AdminShadowbanUser)
+	admin.DELETE("/posts", AdminDeletePost)
+	admin.DELETE("/comments", AdminDeleteComment)
+	admin.PUT("/categories", AdminUpdateCategory)
+	admin.DELETE("/categories", AdminDeleteCategory)
+	admin.GET("/audit", GetAuditLog)
+	admin.GET("/audit/verify", VerifyAuditLog)
 	protected.POST("/updatePassword", UpdatePassword)
+	protected.POST("/resendVerification", ResendVerification, rateLimit("accountEmail"))
+	protected.POST("/changeEmail", ChangeEmail, rateLimit("accountEmail"))
+	protected.POST("/2fa/enroll", EnrollTwoFactor)
+	protected.POST("/2fa/confirm", ConfirmTwoFactor)
+	protected.POST("/2fa/disable", DisableTwoFactor)
+	protected.POST("/2fa/recoveryCodes", RegenerateRecoveryCodes)
 	protected.POST("/savePost", AddPostToSavedPosts)
 	protected.GET("/checkPostSaved", CheckIfPostIsSaved)
 	protected.GET("/savedPosts", GetUsersSavedPosts)
 	protected.GET("/subscribe", SubscribeORUnsubscribe)
+	protected.GET("/followRequests/incoming", GetIncomingFollowRequests)
+	protected.GET("/followRequests/outgoing", GetOutgoingFollowRequests)
+	protected.PUT("/followRequests/approve", ApproveFollowRequest)
+	protected.PUT("/followRequests/deny", DenyFollowRequest)
+	protected.DELETE("/followRequests", CancelFollowRequest)
+	protected.GET("/followers/mutual", GetMutualFollowers)
+	protected.DELETE("/followers", RemoveFollower)
+	protected.POST("/block", BlockUser)
+	protected.DELETE("/block", UnblockUser)
+	protected.GET("/blocks", GetBlockedUsers)
+	protected.POST("/mute", MuteUser)
+	protected.DELETE("/mute", UnmuteUser)
+	protected.GET("/mutes", GetMutedUsers)
+	protected.GET("/mutedWords", GetMutedWords)
+	protected.POST("/mutedWords", AddMutedWord)
+	protected.DELETE("/mutedWords", DeleteMutedWord)
+	protected.GET("/notifications", GetNotifications)
+	protected.PUT("/notifications/read", MarkNotificationsRead)
 
 	e.Logger.Fatal(e.Start(":5533"))
 
@@ -1420,13 +2388,20 @@ func Register(c echo.Context) error {
 			"error": "All fields are required",
 		})
 	}
+	email, err := parseEmail(user.Email)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	user.Email = email
 
 	// Debug log incoming request
 	fmt.Printf("Register attempt - Username: %s, Email: %s\n", user.Username, user.Email)
 
 	// Check if user already exists
 	var exists int
-	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ? OR email = ?",
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ? OR email = ? COLLATE NOCASE",
 		user.Username, user.Email).Scan(&exists)
 	if err != nil {
 		fmt.Printf("Database error checking user existence: %v\n", err)
@@ -1442,8 +2417,8 @@ func Register(c echo.Context) error {
 	}
 
 	// Insert user into database
-	query := `INSERT INTO users (username, displayName, email, password) VALUES (?, ?, ?, ?)`
-	result, err := db.Exec(query, user.Username, user.DisplayName, user.Email, user.Password)
+	query := `INSERT INTO users (username, displayName, email, password, created_at) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, user.Username, user.DisplayName, user.Email, user.Password, time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
 		fmt.Printf("Error inserting new user: %v\n", err)
 		return c.JSON(http.StatusInternalServerError, echo.Map{
@@ -1453,15 +2428,16 @@ func Register(c echo.Context) error {
 
 	id, _ := result.LastInsertId()
 	fmt.Printf("Successfully registered new user with ID: %d\n", id)
+	sendVerificationEmail(int(id), user.Email)
 
 	return c.JSON(http.StatusOK, echo.Map{
-		"message": "User registered successfully",
+		"message": "User registered successfully, check your email to confirm your address",
 	})
 }
 
 func InsertTestUser() {
-	_, err := db.Exec(`INSERT INTO users (username, displayName, email, password) VALUES (?, ?, ?, ?)`,
-		testingLogin, testingLogin, testingLogin+"@gmail.com", testingPassword)
+	_, err := db.Exec(`INSERT INTO users (username, displayName, email, password, role) VALUES (?, ?, ?, ?, ?)`,
+		testingLogin, testingLogin, testingLogin+"@gmail.com", testingPassword, roleAdmin)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1470,13 +2446,13 @@ func InsertTestUser() {
 
 	// insert random post and comment for test user
 	_, err = db.Exec(`INSERT INTO posts (content_text, created_at, userID) VALUES (?, ?, ?)`,
-		faker.Sentence(), time.Now().Format(time.RFC3339), 1)
+		faker.Sentence(), time.Now().UTC().Format(time.RFC3339), 1)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	_, err = db.Exec(`INSERT INTO comments (idPost, idUser, content_text, created_at) VALUES (?, ?, ?, ?)`,
-		1, 1, faker.Sentence(), time.Now().Format(time.RFC3339))
+		1, 1, faker.Sentence(), time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1499,6 +2475,29 @@ func UpdateUser(c echo.Context) error {
 		})
 	}
 
+	userID := currentUser(c).UserID
+	if req.ID != 0 && req.ID != userID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only edit your own profile",
+		})
+	}
+
+	before := snapshot("user", userID)
+
+	// A new email address only takes effect once it's confirmed, until then
+	// the account keeps its current one
+	currentEmail, _ := before["email"].(string)
+	newEmail := ""
+	if req.Email != "" && !strings.EqualFold(strings.TrimSpace(req.Email), currentEmail) {
+		email, status, err := validateNewEmail(req.Email, userID)
+		if err != nil {
+			return c.JSON(status, echo.Map{
+				"error": err.Error(),
+			})
+		}
+		newEmail = email
+	}
+
 	// Update the user in the database
 	stmt, err := db.Prepare("UPDATE users SET username = ?, displayName = ?, email = ? WHERE idUser = ?")
 	if err != nil {
@@ -1508,7 +2507,7 @@ func UpdateUser(c echo.Context) error {
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(req.Username, req.DisplayName, req.Email, req.ID)
+	res, err := stmt.Exec(req.Username, req.DisplayName, currentEmail, userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to update user",
@@ -1530,13 +2529,19 @@ func UpdateUser(c echo.Context) error {
 
 	// Retrieve the updated user
 	var updatedUser User
-	err = db.QueryRow("SELECT idUser, username, displayName, email FROM users WHERE idUser = ?", req.ID).
+	err = db.QueryRow("SELECT idUser, username, displayName, email FROM users WHERE idUser = ?", userID).
 		Scan(&updatedUser.IDUser, &updatedUser.Username, &updatedUser.DisplayName, &updatedUser.Email)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to retrieve updated user",
 		})
 	}
+	audit(c, auditActionUpdateUser, "user", userID, before)
+	if newEmail != "" {
+		if err := startEmailChange(c, userID, newEmail); err != nil {
+			log.Printf("Failed to start email change for user %d: %v", userID, err)
+		}
+	}
 
 	return c.JSON(http.StatusOK, updatedUser)
 }
@@ -1548,7 +2553,7 @@ type LoginRequest struct {
 
 func getLikesDislikes(c echo.Context) error {
 	postId := c.QueryParam("idPost")
-	query := `SELECT like FROM likes_dislikes WHERE idPost = ?`
+	query := `SELECT like FROM likes_dislikes WHERE idPost = ? AND idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)`
 	rows, err := db.Query(query, postId)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
@@ -1606,7 +2611,8 @@ func getUserLikeDislikeForPost(c echo.Context) error {
 
 func like(c echo.Context) error {
 	postId := c.QueryParam("postId")
-	userId := c.QueryParam("userId")
+	// Votes are always cast by the logged in user
+	userIdInt := currentUser(c).UserID
 
 	// Add debug logging
 	// fmt.Printf("Received like request - postId: %s, userId: %s\n", postId, userId)
@@ -1619,16 +2625,8 @@ func like(c echo.Context) error {
 		})
 	}
 
-	userIdInt, err := strconv.Atoi(userId)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "Invalid user ID format",
-		})
-	}
-
 	// Check if post exists
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE idPost = ?)", postIdInt).Scan(&exists)
+	exists, err := publishedPostExists(postIdInt, userIdInt)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Database error",
@@ -1640,19 +2638,6 @@ func like(c echo.Context) error {
 		})
 	}
 
-	// Check if user exists
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE idUser = ?)", userIdInt).Scan(&exists)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{
-			"error": "Database error",
-		})
-	}
-	if !exists {
-		return c.JSON(http.StatusNotFound, echo.Map{
-			"error": "User not found",
-		})
-	}
-
 	// Check existing like/dislike
 	query := `SELECT idLikeDislike, like FROM likes_dislikes WHERE idPost = ? AND idUser = ?`
 	row := db.QueryRow(query, postIdInt, userIdInt)
@@ -1709,11 +2694,13 @@ func like(c echo.Context) error {
 
 func dislike(c echo.Context) error {
 	postId := c.QueryParam("postId")
-	userId := c.QueryParam("userId")
+	// Votes are always cast by the logged in user
+	userId := currentUser(c).UserID
 
 	// Check if post exists
-	query := `SELECT idPost FROM posts WHERE idPost = ?`
-	row := db.QueryRow(query, postId)
+	visible, visibleArgs := postVisibleSQL("p", userId)
+	query := `SELECT p.idPost FROM posts p WHERE p.idPost = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
+	row := db.QueryRow(query, append([]interface{}{postId}, visibleArgs...)...)
 	var post Post
 	if err := row.Scan(&post.IDPost); err != nil {
 		return c.JSON(http.StatusNotFound, echo.Map{
@@ -1721,16 +2708,6 @@ func dislike(c echo.Context) error {
 		})
 	}
 
-	// Check if user exists
-	query = `SELECT idUser FROM users WHERE idUser = ?`
-	row = db.QueryRow(query, userId)
-	var user User
-	if err := row.Scan(&user.IDUser); err != nil {
-		return c.JSON(http.StatusNotFound, echo.Map{
-			"error": "User not found",
-		})
-	}
-
 	// Check existing like/dislike
 	query = `SELECT idLikeDislike, like FROM likes_dislikes WHERE idPost = ? AND idUser = ?`
 	row = db.QueryRow(query, postId, userId)
@@ -1800,17 +2777,68 @@ func Login(c echo.Context) error {
 		})
 	}
 
+	// Find the account being logged into, if there is one, and make sure it
+	// isn't locked or being guessed at too quickly
+	var targetID int
+	err := db.QueryRow(`SELECT idUser FROM users WHERE username = ? OR email = ?`, req.Username, req.Username).Scan(&targetID)
+	if err != nil && err != sql.ErrNoRows {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to load account",
+		})
+	}
+	if throttled, err := rejectThrottledLogin(c, targetID, echo.Map{"username": req.Username}); throttled {
+		return err
+	}
+
 	// Check if user exists
 	query := `SELECT idUser, username, displayName, email FROM users WHERE (username = ? OR email = ?) AND password = ?`
 	row := db.QueryRow(query, req.Username, req.Username, req.Password)
 
 	var user User
 	if err := row.Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.Email); err != nil {
+		recordAudit(c, 0, auditActionLoginFailed, "user", targetID, nil, echo.Map{"username": req.Username})
+		countLoginFailure(c, targetID)
 		return c.JSON(http.StatusUnauthorized, echo.Map{
 			"error": "Invalid username or password",
 		})
 	}
 
+	state, err := loadAccountState(user.IDUser)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to load account",
+		})
+	}
+	if state.Suspended {
+		recordAudit(c, user.IDUser, auditActionLoginFailed, "user", user.IDUser, nil, echo.Map{
+			"username": req.Username,
+			"reason":   "suspended",
+		})
+		status, body := checkAccountState(state, time.Now().Unix(), "")
+		return c.JSON(status, body)
+	}
+
+	// With 2FA on, the password only gets as far as asking for a code
+	enabled, err := twoFactorEnabled(user.IDUser)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to load account",
+		})
+	}
+	if enabled {
+		return startTwoFactorLogin(c, user.IDUser)
+	}
+	return finishLogin(c, user, state, nil)
+}
+
+// finishLogin issues the token once a user has fully proven who they are,
+// which also clears their failed login attempts
+func finishLogin(c echo.Context, user User, state *accountState, details echo.Map) error {
+	if err := resetAccountThrottle(db, user.IDUser); err != nil {
+		log.Printf("Failed to reset login attempts for user %d: %v", user.IDUser, err)
+	}
+	user.Role = state.Role
+
 	// generate JWT token
 	token, err := generateToken(user)
 	if err != nil {
@@ -1818,10 +2846,14 @@ func Login(c echo.Context) error {
 			"error": "Failed to generate token",
 		})
 	}
+	recordAudit(c, user.IDUser, auditActionLogin, "user", user.IDUser, nil, details)
+
 	// Return user data and token
 	return c.JSON(http.StatusOK, echo.Map{
-		"user":  user,
-		"token": token,
+		"user":                  user,
+		"token":                 token,
+		"passwordResetRequired": state.MustResetPassword,
+		"emailVerified":         state.EmailVerified,
 	})
 }
 
@@ -1832,13 +2864,30 @@ func createUsersTable(db *sql.DB) {
 		"username" TEXT UNIQUE,
 		"displayName" TEXT UNIQUE,
 		"email" TEXT UNIQUE,
-		"password" TEXT
+		"password" TEXT,
+		"private" INTEGER NOT NULL DEFAULT 0
 	);`
 	statement, err := db.Prepare(createTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	addColumnIfMissing(db, "users", "private", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	addColumnIfMissing(db, "users", "suspended_at", "TEXT")
+	addColumnIfMissing(db, "users", "suspended_until", "TEXT")
+	addColumnIfMissing(db, "users", "suspension_reason", "TEXT")
+	addColumnIfMissing(db, "users", "must_reset_password", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "users", "tokens_invalid_before", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "users", "shadowbanned_at", "TEXT")
+	addColumnIfMissing(db, "users", "email_verified_at", "TEXT")
+	addColumnIfMissing(db, "users", "totp_secret", "TEXT")
+	addColumnIfMissing(db, "users", "totp_pending_secret", "TEXT")
+	addColumnIfMissing(db, "users", "totp_enabled_at", "TEXT")
+	// The time step of the last accepted code, so a code can't be used twice
+	addColumnIfMissing(db, "users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0")
+	// Accounts from before this column have no registration time
+	addColumnIfMissing(db, "users", "created_at", "TEXT")
 	fmt.Println("Users table created")
 }
 
@@ -1847,13 +2896,14 @@ func CreateImagesTable(db *sql.DB) {
 		"idImage" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"imageURL" TEXT,
 		"postID" INTEGER,
-		FOREIGN KEY(postID) REFERENCES posts(idPost)
+		FOREIGN KEY(postID) REFERENCES posts(idPost) ON DELETE CASCADE
 	);`
 	statement, err := db.Prepare(image)
 	if err != nil {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	rebuildTableForDeleteRules(db, "images", image)
 	fmt.Println("Images table created")
 }
 
@@ -1863,14 +2913,15 @@ func createSavedPostsTable(db *sql.DB) {
 		"idSavedPost" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
 		"idPost" INTEGER,
 		"idUser" INTEGER,
-		FOREIGN KEY(idPost) REFERENCES posts(idPost),
-		FOREIGN KEY(idUser) REFERENCES users(idUser)
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
 	);`
 	statement, err := db.Prepare(createTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	rebuildTableForDeleteRules(db, "saved_posts", createTableSQL)
 	fmt.Println("Saved posts table created")
 }
 
@@ -1884,14 +2935,43 @@ func createPostsTable(db *sql.DB) {
         "created_at" TEXT,
         "userID" INTEGER,
         "categoryID" INTEGER,
-        FOREIGN KEY ("userID") REFERENCES users(idUser),
-        FOREIGN KEY ("categoryID") REFERENCES categories(idCategory)
+        "deleted_at" TEXT,
+        "edited_at" TEXT,
+        "status" TEXT NOT NULL DEFAULT 'published',
+        "publish_at" TEXT,
+        "quotedPostID" INTEGER,
+        "inReplyToID" INTEGER,
+        "previewURL" TEXT,
+        "visibility" TEXT NOT NULL DEFAULT 'public',
+        "removed_at" TEXT,
+        "removed_by" INTEGER,
+        "removal_reason" TEXT,
+        "locked" INTEGER NOT NULL DEFAULT 0,
+        "pinned_at" TEXT,
+        FOREIGN KEY ("userID") REFERENCES users(idUser) ON DELETE CASCADE,
+        FOREIGN KEY ("categoryID") REFERENCES categories(idCategory) ON DELETE SET NULL
     );`
 	stmt, err := db.Prepare(createTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	stmt.Exec()
+	addColumnIfMissing(db, "posts", "deleted_at", "TEXT")
+	addColumnIfMissing(db, "posts", "edited_at", "TEXT")
+	addColumnIfMissing(db, "posts", "status", "TEXT NOT NULL DEFAULT 'published'")
+	addColumnIfMissing(db, "posts", "publish_at", "TEXT")
+	addColumnIfMissing(db, "posts", "quotedPostID", "INTEGER")
+	addColumnIfMissing(db, "posts", "inReplyToID", "INTEGER")
+	addColumnIfMissing(db, "posts", "previewURL", "TEXT")
+	addColumnIfMissing(db, "posts", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	addColumnIfMissing(db, "posts", "removed_at", "TEXT")
+	addColumnIfMissing(db, "posts", "removed_by", "INTEGER")
+	addColumnIfMissing(db, "posts", "removal_reason", "TEXT")
+	addColumnIfMissing(db, "posts", "locked", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "posts", "pinned_at", "TEXT")
+	// The status a held post goes back to once a moderator releases it
+	addColumnIfMissing(db, "posts", "held_status", "TEXT")
+	rebuildTableForDeleteRules(db, "posts", createTableSQL)
 	fmt.Println("Posts table created")
 }
 
@@ -1902,19 +2982,177 @@ func createCommentsTable(db *sql.DB) {
 		"idComment" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
 		"idPost" INTEGER,
 		"idUser" INTEGER,
+		"parentID" INTEGER,
 		"content_text" TEXT,
 		"created_at" TEXT,
-		FOREIGN KEY(idPost) REFERENCES posts(idPost),
-		FOREIGN KEY(idUser) REFERENCES users(idUser)
+		"edited_at" TEXT,
+		"deleted_at" TEXT,
+		"removed_at" TEXT,
+		"removed_by" INTEGER,
+		"removal_reason" TEXT,
+		"held_at" TEXT,
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE,
+		FOREIGN KEY(parentID) REFERENCES comments(idComment) ON DELETE CASCADE
 	);`
 	statement, err := db.Prepare(createTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	addColumnIfMissing(db, "comments", "parentID", "INTEGER REFERENCES comments(idComment)")
+	addColumnIfMissing(db, "comments", "edited_at", "TEXT")
+	addColumnIfMissing(db, "comments", "deleted_at", "TEXT")
+	addColumnIfMissing(db, "comments", "removed_at", "TEXT")
+	addColumnIfMissing(db, "comments", "removed_by", "INTEGER")
+	addColumnIfMissing(db, "comments", "removal_reason", "TEXT")
+	addColumnIfMissing(db, "comments", "held_at", "TEXT")
+	rebuildTableForDeleteRules(db, "comments", createTableSQL)
 	fmt.Println("Comments table created")
 }
 
+// addColumnIfMissing brings tables created by older versions up to date,
+// since CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			log.Fatal(err)
+		}
+		if name == column {
+			return
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN "%s" %s`, table, column, definition)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Added column %s.%s\n", table, column)
+}
+
+// rebuildTableForDeleteRules recreates a table from createTableSQL when the
+// existing one predates its ON DELETE rules. SQLite cannot alter foreign keys in
+// place, so rows are copied into a fresh table that then replaces the old one.
+func rebuildTableForDeleteRules(db *sql.DB, table, createTableSQL string) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA foreign_key_list(%s)`, table))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hasRules := false
+	for rows.Next() {
+		var (
+			id, seq                       int
+			refTable, from, to            string
+			onUpdate, onDelete, matchRule string
+		)
+		if err := rows.Scan(&id, &seq, &refTable, &from, &to, &onUpdate, &onDelete, &matchRule); err != nil {
+			log.Fatal(err)
+		}
+		if onDelete != "NO ACTION" {
+			hasRules = true
+		}
+	}
+	rows.Close()
+	if hasRules {
+		return
+	}
+
+	var columns []string
+	rows, err = db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var (
+			cid, notNull, primaryKey int
+			name, columnType         string
+			defaultVal               sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			log.Fatal(err)
+		}
+		columns = append(columns, `"`+name+`"`)
+	}
+	rows.Close()
+
+	newTable := table + "_rebuild"
+	createNewSQL := strings.Replace(createTableSQL, "CREATE TABLE IF NOT EXISTS "+table+" ", "CREATE TABLE "+newTable+" ", 1)
+	columnList := strings.Join(columns, ", ")
+
+	// The pragma has no effect inside a transaction, so pin a single connection
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		log.Fatal(err)
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statements := []string{
+		createNewSQL,
+		fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`, newTable, columnList, columnList, table),
+		fmt.Sprintf(`DROP TABLE %s`, table),
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, newTable, table),
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			log.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Rebuilt table %s with ON DELETE rules\n", table)
+}
+
+// publishedPostExists reports whether a post is live and visible to the viewer
+func publishedPostExists(postID, viewerID int) (bool, error) {
+	visible, visibleArgs := postVisibleSQL("p", viewerID)
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM posts p WHERE p.idPost = ? AND p.deleted_at IS NULL AND p.status = 'published' AND `+visible+`)`,
+		append([]interface{}{postID}, visibleArgs...)...).Scan(&exists)
+	return exists, err
+}
+
+// nullableID maps an empty or zero ID from a request to NULL so optional
+// references don't trip foreign key checks
+func nullableID(id string) interface{} {
+	if id == "" || id == "0" {
+		return nil
+	}
+	return id
+}
+
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
 func createCategoriesTable(db *sql.DB) {
 	fmt.Println("Creating categories table")
 	createTableSQL := `CREATE TABLE IF NOT EXISTS categories (
@@ -1927,6 +3165,12 @@ func createCategoriesTable(db *sql.DB) {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	addColumnIfMissing(db, "categories", "ownerID", "INTEGER REFERENCES users(idUser)")
+	addColumnIfMissing(db, "categories", "rules", "TEXT")
+	addColumnIfMissing(db, "categories", "bannerURL", "TEXT")
+	addColumnIfMissing(db, "categories", "iconURL", "TEXT")
+	addColumnIfMissing(db, "categories", "mode", "TEXT NOT NULL DEFAULT 'public'")
+	addColumnIfMissing(db, "categories", "created_at", "TEXT")
 	fmt.Println("Categories table created")
 }
 
@@ -1936,14 +3180,15 @@ func createLikesDislikesTable(db *sql.DB) {
 		"idPost" INTEGER,
 		"idUser" INTEGER,
 		"like" INTEGER,
-		FOREIGN KEY(idPost) REFERENCES posts(idPost),
-		FOREIGN KEY(idUser) REFERENCES users(idUser)
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
 	);`
 	statement, err := db.Prepare(createTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	rebuildTableForDeleteRules(db, "likes_dislikes", createTableSQL)
 	fmt.Println("Likes/Dislikes table created")
 }
 
@@ -1954,6 +3199,7 @@ func createMessagesTable(db *sql.DB) {
 		"receiverID" INTEGER,
 		"content" TEXT,
 		"created_at" TEXT,
+		"held_at" TEXT,
 		FOREIGN KEY(senderID) REFERENCES users(idUser),
 		FOREIGN KEY(receiverID) REFERENCES users(idUser)
 	);`
@@ -1962,6 +3208,7 @@ func createMessagesTable(db *sql.DB) {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	addColumnIfMissing(db, "messages", "held_at", "TEXT")
 	fmt.Println("Messages table created")
 }
 
@@ -1970,6 +3217,8 @@ func createSubscriptionsTable(db *sql.DB) {
 		"idSubscription" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"subscriberID" INTEGER,
 		"subscribedToID" INTEGER,
+		"status" TEXT NOT NULL DEFAULT 'accepted',
+		"created_at" TEXT,
 		FOREIGN KEY(subscriberID) REFERENCES users(idUser),
 		FOREIGN KEY(subscribedToID) REFERENCES users(idUser)
 	);`
@@ -1978,6 +3227,9 @@ func createSubscriptionsTable(db *sql.DB) {
 		log.Fatal(err)
 	}
 	statement.Exec()
+	// Pending rows are follow requests to private accounts
+	addColumnIfMissing(db, "subscriptions", "status", "TEXT NOT NULL DEFAULT 'accepted'")
+	addColumnIfMissing(db, "subscriptions", "created_at", "TEXT")
 	fmt.Println("Subscriptions table created")
 }
 
@@ -1985,8 +3237,11 @@ func getMessages(c echo.Context) error {
 	senderId := c.QueryParam("senderID")
 	receiverId := c.QueryParam("receiverID")
 
-	query := `SELECT idMessage, senderID, receiverID, content, created_at FROM messages WHERE senderID = ? AND receiverID = ? OR senderID = ? AND receiverID = ? ORDER BY created_at`
-	rows, err := db.Query(query, senderId, receiverId, receiverId, senderId)
+	// Held messages are only shown to whoever sent them
+	query := `SELECT idMessage, senderID, receiverID, content, created_at FROM messages
+              WHERE (senderID = ? AND receiverID = ? OR senderID = ? AND receiverID = ?) AND (held_at IS NULL OR senderID = ?)
+              ORDER BY created_at`
+	rows, err := db.Query(query, senderId, receiverId, receiverId, senderId, currentUser(c).UserID)
 
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
@@ -2030,29 +3285,80 @@ func SendMessages(c echo.Context) error {
 		})
 	}
 
-	if message.SenderID == "" || message.ReceiverID == "" || message.Content == "" {
+	if message.ReceiverID == "" || message.Content == "" {
 		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "SenderID, receiverID, and content are required",
+			"error": "ReceiverID and content are required",
 		})
 	}
 
+	// The sender is always the logged in user. senderID is still accepted
+	// from older clients, but only when it names them.
+	senderID := strconv.Itoa(currentUser(c).UserID)
+	if message.SenderID != "" && message.SenderID != senderID {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You can only send messages as yourself",
+		})
+	}
+
+	blocked, err := isBlockedBetween(senderID, message.ReceiverID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	if blocked {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "You cannot message this user",
+		})
+	}
+
+	verdict, ok := checkAutomod(c, automodContent{
+		TargetType: reportTargetMessage,
+		UserID:     currentUser(c).UserID,
+		Text:       message.Content,
+	})
+	if !ok {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
 	query := `INSERT INTO messages (senderID, receiverID, content, created_at) VALUES (?, ?, ?, ?)`
-	result, err := db.Exec(query, message.SenderID, message.ReceiverID, message.Content, time.Now().Format(time.RFC3339))
+	result, err := tx.Exec(query, senderID, message.ReceiverID, message.Content, time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to insert message: " + err.Error(),
 		})
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to confirm message insertion",
+		})
+	}
+
+	if err := verdict.apply(tx, messageID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to apply automatic moderation: " + err.Error(),
+		})
+	}
+	if err := tx.Commit(); err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to confirm message insertion",
 		})
 	}
 
+	// Held messages only reach the receiver once a moderator lets them through
 	return c.JSON(http.StatusOK, echo.Map{
 		"message": "Message sent successfully",
+		"held":    verdict.Action == automodHold,
 	})
 }
 
@@ -2082,7 +3388,7 @@ func GetUserConversations(c echo.Context) error {
                     ORDER BY created_at DESC
                 ) as rn
             FROM messages m
-            WHERE senderID = ? OR receiverID = ?
+            WHERE (senderID = ? OR receiverID = ?) AND (held_at IS NULL OR senderID = ?)
         )
         SELECT 
             m.senderID,
@@ -2096,7 +3402,7 @@ func GetUserConversations(c echo.Context) error {
         WHERE rn = 1
         ORDER BY m.created_at DESC`
 
-	rows, err := db.Query(query, userID, userID)
+	rows, err := db.Query(query, userID, userID, userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": "Failed to query conversations: " + err.Error(),
@@ -2168,7 +3474,7 @@ func InsertRandomMessages(n int) {
 		senderID := Users[rand.Intn(len(Users))].IDUser
 		receiverID := Users[rand.Intn(len(Users))].IDUser
 		content := faker.Sentence()
-		createdAt := time.Now().Format(time.RFC3339)
+		createdAt := time.Now().UTC().Format(time.RFC3339)
 		_, err := db.Exec(`INSERT INTO messages (senderID, receiverID, content, created_at) VALUES (?, ?, ?, ?)`,
 			senderID, receiverID, content, createdAt)
 		if err != nil {
@@ -2219,7 +3525,7 @@ func insertRandomPosts(n int) {
 		numberOfPosts := rand.Intn(n) + 1
 		for i := 0; i < numberOfPosts; i++ {
 			content := faker.Sentence()
-			createdAt := time.Now().Format(time.RFC3339)
+			createdAt := time.Now().UTC().Format(time.RFC3339)
 			categoryID := Categories[rand.Intn(len(Categories))].IDCategory
 			testImage := "https://picsum.photos/200/300"
 			_, err := db.Exec(`INSERT INTO posts (content_text, created_at, userID, categoryID, imageURL ) VALUES (?, ?, ?, ?, ?)`,
@@ -2264,7 +3570,7 @@ func insertRandomComments(n int) {
 
 		for i := 0; i < numberOfComments; i++ {
 			content := faker.Sentence()
-			createdAt := time.Now().Format(time.RFC3339)
+			createdAt := time.Now().UTC().Format(time.RFC3339)
 			_, err := db.Exec(`INSERT INTO comments (idPost, idUser, content_text, created_at) VALUES (?, ?, ?, ?)`,
 				post.IDPost, Users[rand.Intn(len(Users))].IDUser, content, createdAt)
 			if err != nil {
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	mutedWordScopeHome          = "home"
+	mutedWordScopeCategory      = "category"
+	mutedWordScopeComments      = "comments"
+	mutedWordScopeNotifications = "notifications"
+
+	maxMutedWordLength = 100
+)
+
+var mutedWordScopes = []string{mutedWordScopeHome, mutedWordScopeCategory, mutedWordScopeComments, mutedWordScopeNotifications}
+
+type MutedWord struct {
+	IDMutedWord int      `json:"idMutedWord"`
+	Phrase      string   `json:"phrase"`
+	Scopes      []string `json:"scopes"`
+	// Placeholder keeps matching content as a "filtered" stub instead of removing it
+	Placeholder bool   `json:"placeholder"`
+	ExpiresAt   string `json:"expires_at"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func createMutedWordsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS muted_words (
+		"idMutedWord" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idUser" INTEGER,
+		"phrase" TEXT,
+		"scopes" TEXT,
+		"placeholder" INTEGER NOT NULL DEFAULT 0,
+		"expires_at" TEXT,
+		"created_at" TEXT,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Muted words table created")
+}
+
+type wordFilterEntry struct {
+	pattern     *regexp.Regexp
+	placeholder bool
+}
+
+// wordFilter holds a user's active muted words for one scope. A nil filter
+// matches nothing, which is what logged out visitors get.
+type wordFilter struct {
+	entries []wordFilterEntry
+}
+
+// mutedWordPattern matches a word, phrase or hashtag case-insensitively and
+// only as whole words, so muting "cat" leaves "category" alone but still
+// catches "#cat"
+func mutedWordPattern(phrase string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)(^|[^\p{L}\p{N}_])` + regexp.QuoteMeta(phrase) + `($|[^\p{L}\p{N}_])`)
+}
+
+func loadWordFilter(userID int, scope string) (*wordFilter, error) {
+	if userID == 0 {
+		return nil, nil
+	}
+
+	query := `
+        SELECT phrase, placeholder FROM muted_words
+        WHERE idUser = ? AND (',' || scopes || ',') LIKE ? AND (expires_at IS NULL OR expires_at > ?)`
+	rows, err := db.Query(query, userID, "%,"+scope+",%", time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filter := &wordFilter{}
+	for rows.Next() {
+		var phrase string
+		var placeholder bool
+		if err := rows.Scan(&phrase, &placeholder); err != nil {
+			return nil, err
+		}
+		pattern, err := mutedWordPattern(phrase)
+		if err != nil {
+			return nil, err
+		}
+		filter.entries = append(filter.entries, wordFilterEntry{pattern: pattern, placeholder: placeholder})
+	}
+	return filter, rows.Err()
+}
+
+// match reports whether text contains a muted word and, if so, whether it
+// should be removed outright. Removal wins when several words match.
+func (f *wordFilter) match(text string) (filtered bool, hide bool) {
+	if f == nil {
+		return false, false
+	}
+	for _, entry := range f.entries {
+		if entry.pattern.MatchString(text) {
+			filtered = true
+			if !entry.placeholder {
+				return true, true
+			}
+		}
+	}
+	return filtered, false
+}
+
+func parseMutedWordScopes(scopes []string) (string, error) {
+	if len(scopes) == 0 {
+		return strings.Join(mutedWordScopes, ","), nil
+	}
+	seen := map[string]bool{}
+	valid := []string{}
+	for _, scope := range scopes {
+		known := false
+		for _, mutedWordScope := range mutedWordScopes {
+			known = known || scope == mutedWordScope
+		}
+		if !known {
+			return "", fmt.Errorf("Unknown scope %q, expected one of %s", scope, strings.Join(mutedWordScopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			valid = append(valid, scope)
+		}
+	}
+	return strings.Join(valid, ","), nil
+}
+
+// AddMutedWord mutes a word, phrase or hashtag for the current user. Scopes
+// default to all of them and an empty expiry mutes until removed.
+func AddMutedWord(c echo.Context) error {
+	type MutedWordRequest struct {
+		Phrase      string   `json:"phrase"`
+		Scopes      []string `json:"scopes"`
+		Placeholder bool     `json:"placeholder"`
+		ExpiresAt   string   `json:"expiresAt"`
+	}
+
+	var req MutedWordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+
+	phrase := strings.TrimSpace(req.Phrase)
+	if phrase == "" || len([]rune(phrase)) > maxMutedWordLength {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": fmt.Sprintf("Phrase must be between 1 and %d characters", maxMutedWordLength),
+		})
+	}
+
+	scopes, err := parseMutedWordScopes(req.Scopes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var expiresAt interface{}
+	if req.ExpiresAt != "" {
+		at, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid expiry, expected RFC3339"})
+		}
+		if !at.After(time.Now()) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Expiry must be in the future"})
+		}
+		// Stored in UTC so active words can be found by comparing text
+		expiresAt = at.UTC().Format(time.RFC3339)
+	}
+
+	query := `INSERT INTO muted_words (idUser, phrase, scopes, placeholder, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, currentUser(c).UserID, phrase, scopes, req.Placeholder, expiresAt,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to mute word: " + err.Error()})
+	}
+
+	mutedWordID, err := result.LastInsertId()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm muted word"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Word muted", "idMutedWord": mutedWordID})
+}
+
+// GetMutedWords lists the current user's active muted words
+func GetMutedWords(c echo.Context) error {
+	query := `
+        SELECT idMutedWord, phrase, scopes, placeholder, COALESCE(expires_at, ''), created_at
+        FROM muted_words
+        WHERE idUser = ? AND (expires_at IS NULL OR expires_at > ?)
+        ORDER BY idMutedWord DESC`
+	rows, err := db.Query(query, currentUser(c).UserID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+	defer rows.Close()
+
+	words := []MutedWord{}
+	for rows.Next() {
+		var word MutedWord
+		var scopes string
+		if err := rows.Scan(&word.IDMutedWord, &word.Phrase, &scopes, &word.Placeholder, &word.ExpiresAt, &word.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan muted word"})
+		}
+		word.Scopes = strings.Split(scopes, ",")
+		words = append(words, word)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, words)
+}
+
+func DeleteMutedWord(c echo.Context) error {
+	type DeleteRequest struct {
+		MutedWordID int `json:"idMutedWord"`
+	}
+
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil || req.MutedWordID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Muted word ID is required"})
+	}
+
+	result, err := db.Exec(`DELETE FROM muted_words WHERE idMutedWord = ? AND idUser = ?`, req.MutedWordID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to remove muted word"})
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Muted word not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Muted word removed"})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	notificationFollow                 = "follow"
+	notificationFollowRequest          = "follow_request"
+	notificationFollowRequestApproved  = "follow_request_approved"
+	notificationFollowRequestDenied    = "follow_request_denied"
+	notificationFollowRequestCancelled = "follow_request_cancelled"
+	notificationCommunityJoinRequest   = "community_join_request"
+	notificationCommunityJoinApproved  = "community_join_approved"
+	notificationCommunityJoinDenied    = "community_join_denied"
+	notificationCommunityBan           = "community_ban"
+	notificationPostRemoved            = "post_removed"
+	notificationCommentRemoved         = "comment_removed"
+	notificationWarning                = "warning"
+	notificationReportOutcome          = "report_outcome"
+	notificationAccountLocked          = "account_locked"
+
+	notificationsPageLimit = 20
+)
+
+type Notification struct {
+	IDNotification int    `json:"idNotification"`
+	Type           string `json:"type"`
+	// ActorID is the user who caused the notification, 0 for the system
+	ActorID int `json:"actorID"`
+	// TargetID is the post, comment or similar the notification is about
+	TargetID  int    `json:"targetID"`
+	Message   string `json:"message"`
+	CreatedAt string `json:"created_at"`
+	Read      bool   `json:"read"`
+	// Filtered notifications matched a muted word and lost their message
+	Filtered bool `json:"filtered,omitempty"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so notifications can be
+// written inside the transaction that causes them
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func createNotificationsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS notifications (
+		"idNotification" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idUser" INTEGER,
+		"actorID" INTEGER,
+		"type" TEXT,
+		"targetID" INTEGER,
+		"message" TEXT,
+		"created_at" TEXT,
+		"read_at" TEXT,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Notifications table created")
+}
+
+// notify stores a notification for userID. actorID and targetID may be 0.
+func notify(exec execer, userID, actorID int, notificationType string, targetID int, message string) error {
+	// Shadowbanned actors notify nobody, that would give their content away
+	query := `INSERT INTO notifications (idUser, actorID, type, targetID, message, created_at)
+              SELECT ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM users WHERE idUser = ? AND shadowbanned_at IS NOT NULL)`
+	_, err := exec.Exec(query, userID, actorID, notificationType, targetID, message, time.Now().UTC().Format(time.RFC3339), actorID)
+	return err
+}
+
+// GetNotifications lists the current user's notifications, newest first,
+// with the number still unread
+func GetNotifications(c echo.Context) error {
+	offset, err := strconv.Atoi(c.QueryParam("offset"))
+	if err != nil && c.QueryParam("offset") != "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
+	}
+
+	userID := currentUser(c).UserID
+	filter, err := loadWordFilter(userID, mutedWordScopeNotifications)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+
+	query := `
+        SELECT idNotification, type, COALESCE(actorID, 0), COALESCE(targetID, 0), COALESCE(message, ''),
+               created_at, read_at IS NOT NULL
+        FROM notifications
+        WHERE idUser = ?
+        ORDER BY idNotification DESC
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, userID, notificationsPageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query notifications"})
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var notification Notification
+		if err := rows.Scan(&notification.IDNotification, &notification.Type, &notification.ActorID,
+			&notification.TargetID, &notification.Message, &notification.CreatedAt, &notification.Read); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan notification data"})
+		}
+		if filtered, hide := filter.match(notification.Message); hide {
+			continue
+		} else if filtered {
+			notification.Message = ""
+			notification.Filtered = true
+		}
+		notifications = append(notifications, notification)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	var unread int
+	err = db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE idUser = ? AND read_at IS NULL`, userID).Scan(&unread)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to count notifications"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"notifications": notifications,
+		"unread":        unread,
+	})
+}
+
+// MarkNotificationsRead marks one notification as read, or all of them when
+// no ID is given
+func MarkNotificationsRead(c echo.Context) error {
+	type ReadRequest struct {
+		NotificationID int `json:"notificationID"`
+	}
+
+	var req ReadRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+
+	query := `UPDATE notifications SET read_at = ? WHERE idUser = ? AND read_at IS NULL`
+	args := []interface{}{time.Now().UTC().Format(time.RFC3339), currentUser(c).UserID}
+	if req.NotificationID != 0 {
+		query += ` AND idNotification = ?`
+		args = append(args, req.NotificationID)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to mark notifications read"})
+	}
+	marked, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm update"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Notifications marked read", "marked": marked})
+}
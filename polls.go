@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	minPollOptions = 2
+	maxPollOptions = 6
+)
+
+type PollRequest struct {
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multipleChoice"`
+	// ClosesAt is an RFC3339 timestamp in the future
+	ClosesAt string `json:"closesAt"`
+}
+
+type PollOption struct {
+	IDOption int    `json:"idOption"`
+	Text     string `json:"text"`
+	// Votes is nil while the results are hidden from the viewer
+	Votes *int `json:"votes,omitempty"`
+}
+
+type Poll struct {
+	IDPoll         int          `json:"idPoll"`
+	MultipleChoice bool         `json:"multipleChoice"`
+	ClosesAt       string       `json:"closesAt"`
+	Closed         bool         `json:"closed"`
+	TotalVoters    int          `json:"totalVoters"`
+	ResultsVisible bool         `json:"resultsVisible"`
+	Options        []PollOption `json:"options"`
+	// ViewerVotes holds the options the viewer picked
+	ViewerVotes []int `json:"viewerVotes"`
+}
+
+func createPollTables(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS polls (
+		"idPoll" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idPost" INTEGER UNIQUE,
+		"multiple_choice" INTEGER NOT NULL DEFAULT 0,
+		"closes_at" TEXT,
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE
+	);`,
+		`CREATE TABLE IF NOT EXISTS poll_options (
+		"idOption" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idPoll" INTEGER,
+		"position" INTEGER,
+		"text" TEXT,
+		FOREIGN KEY(idPoll) REFERENCES polls(idPoll) ON DELETE CASCADE
+	);`,
+		`CREATE TABLE IF NOT EXISTS poll_votes (
+		"idVote" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idPoll" INTEGER,
+		"idOption" INTEGER,
+		"idUser" INTEGER,
+		"created_at" TEXT,
+		UNIQUE(idOption, idUser),
+		FOREIGN KEY(idPoll) REFERENCES polls(idPoll) ON DELETE CASCADE,
+		FOREIGN KEY(idOption) REFERENCES poll_options(idOption) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Poll tables created")
+}
+
+func validatePollRequest(req *PollRequest) error {
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return fmt.Errorf("A poll needs between %d and %d options", minPollOptions, maxPollOptions)
+	}
+	for i, option := range req.Options {
+		req.Options[i] = strings.TrimSpace(option)
+		if req.Options[i] == "" {
+			return errors.New("Poll options cannot be empty")
+		}
+	}
+
+	closesAt, err := time.Parse(time.RFC3339, req.ClosesAt)
+	if err != nil {
+		return errors.New("Invalid poll closing time, expected RFC3339")
+	}
+	if !closesAt.After(time.Now()) {
+		return errors.New("Poll closing time must be in the future")
+	}
+	// Stored in UTC so open/closed checks can compare timestamps as text
+	req.ClosesAt = closesAt.UTC().Format(time.RFC3339)
+	return nil
+}
+
+func insertPoll(tx *sql.Tx, postID int64, req *PollRequest) error {
+	result, err := tx.Exec(`INSERT INTO polls (idPost, multiple_choice, closes_at) VALUES (?, ?, ?)`,
+		postID, req.MultipleChoice, req.ClosesAt)
+	if err != nil {
+		return err
+	}
+	pollID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for position, option := range req.Options {
+		_, err := tx.Exec(`INSERT INTO poll_options (idPoll, position, text) VALUES (?, ?, ?)`, pollID, position, option)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPoll returns the poll attached to a post, or nil if it has none. Vote
+// counts are only included once the viewer has voted or the poll has closed.
+func loadPoll(postID, viewerID int) (*Poll, error) {
+	poll := &Poll{}
+	err := db.QueryRow(`SELECT idPoll, multiple_choice, closes_at FROM polls WHERE idPost = ?`, postID).
+		Scan(&poll.IDPoll, &poll.MultipleChoice, &poll.ClosesAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	poll.Closed = !time.Now().UTC().Before(parsePollTime(poll.ClosesAt))
+
+	err = db.QueryRow(`SELECT COUNT(DISTINCT idUser) FROM poll_votes WHERE idPoll = ?`, poll.IDPoll).Scan(&poll.TotalVoters)
+	if err != nil {
+		return nil, err
+	}
+
+	poll.ViewerVotes = []int{}
+	if viewerID != 0 {
+		rows, err := db.Query(`SELECT idOption FROM poll_votes WHERE idPoll = ? AND idUser = ? ORDER BY idOption`, poll.IDPoll, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var optionID int
+			if err := rows.Scan(&optionID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			poll.ViewerVotes = append(poll.ViewerVotes, optionID)
+		}
+		rows.Close()
+	}
+	poll.ResultsVisible = poll.Closed || len(poll.ViewerVotes) > 0
+
+	query := `
+        SELECT o.idOption, o.text, (SELECT COUNT(*) FROM poll_votes v WHERE v.idOption = o.idOption)
+        FROM poll_options o
+        WHERE o.idPoll = ?
+        ORDER BY o.position`
+	rows, err := db.Query(query, poll.IDPoll)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	poll.Options = []PollOption{}
+	for rows.Next() {
+		var option PollOption
+		var votes int
+		if err := rows.Scan(&option.IDOption, &option.Text, &votes); err != nil {
+			return nil, err
+		}
+		if poll.ResultsVisible {
+			option.Votes = &votes
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	return poll, rows.Err()
+}
+
+func parsePollTime(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// VotePoll records the current user's choice, replacing any earlier vote
+// while the poll is still open
+func VotePoll(c echo.Context) error {
+	type VoteRequest struct {
+		PollID    int   `json:"pollID"`
+		OptionIDs []int `json:"optionIDs"`
+	}
+
+	var req VoteRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request format"})
+	}
+	if req.PollID == 0 || len(req.OptionIDs) == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Poll ID and at least one option are required"})
+	}
+
+	var postID int
+	var multipleChoice bool
+	var closesAt string
+	visible, visibleArgs := postVisibleSQL("p", currentUser(c).UserID)
+	query := `
+        SELECT pl.idPost, pl.multiple_choice, pl.closes_at
+        FROM polls pl
+        JOIN posts p ON pl.idPost = p.idPost
+        WHERE pl.idPoll = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
+	err := db.QueryRow(query, append([]interface{}{req.PollID}, visibleArgs...)...).Scan(&postID, &multipleChoice, &closesAt)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Poll not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+
+	if !time.Now().UTC().Before(parsePollTime(closesAt)) {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Poll is closed"})
+	}
+
+	options := map[int]bool{}
+	for _, optionID := range req.OptionIDs {
+		options[optionID] = true
+	}
+	if !multipleChoice && len(options) > 1 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "This poll allows only one choice"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	userID := currentUser(c).UserID
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE idPoll = ? AND idUser = ?`, req.PollID, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record vote"})
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for optionID := range options {
+		// Selecting through poll_options rejects options from other polls
+		result, err := tx.Exec(`
+            INSERT INTO poll_votes (idPoll, idOption, idUser, created_at)
+            SELECT idPoll, idOption, ?, ? FROM poll_options WHERE idOption = ? AND idPoll = ?`,
+			userID, now, optionID, req.PollID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record vote"})
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid poll option"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to record vote"})
+	}
+
+	poll, err := loadPoll(postID, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query poll"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Vote recorded",
+		"poll":    poll,
+	})
+}
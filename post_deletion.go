@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// postRestoreWindow is how long an author can undo a deletion
+	postRestoreWindow = 7 * 24 * time.Hour
+	// deletedPostRetention is how long soft deleted posts are kept before purging
+	deletedPostRetention = 30 * 24 * time.Hour
+	purgeInterval        = time.Hour
+)
+
+func RestorePost(c echo.Context) error {
+	type RestoreRequest struct {
+		PostID string `json:"postID"`
+	}
+
+	var req RestoreRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Invalid request format",
+		})
+	}
+
+	if req.PostID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Post ID is required",
+		})
+	}
+
+	// RFC3339 timestamps in UTC compare correctly as text
+	cutoff := time.Now().UTC().Add(-postRestoreWindow).Format(time.RFC3339)
+	// Posts removed by moderators stay removed
+	query := `UPDATE posts SET deleted_at = NULL WHERE idPost = ? AND userID = ? AND deleted_at >= ? AND removed_at IS NULL`
+	result, err := db.Exec(query, req.PostID, currentUser(c).UserID, cutoff)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to restore post: " + err.Error(),
+		})
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to confirm restore",
+		})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "No deleted post found within the restore window",
+		})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Post restored successfully",
+	})
+}
+
+// GetDeletedPosts lists the current user's deleted posts that can still be restored
+func GetDeletedPosts(c echo.Context) error {
+	type DeletedPost struct {
+		IDPost       int    `json:"idPost"`
+		ContentText  string `json:"content_text"`
+		CreatedAt    string `json:"created_at"`
+		DeletedAt    string `json:"deleted_at"`
+		RestoreUntil string `json:"restore_until"`
+	}
+
+	cutoff := time.Now().UTC().Add(-postRestoreWindow).Format(time.RFC3339)
+	query := `
+        SELECT idPost, content_text, created_at, deleted_at
+        FROM posts
+        WHERE userID = ? AND deleted_at >= ? AND removed_at IS NULL
+        ORDER BY deleted_at DESC`
+	rows, err := db.Query(query, currentUser(c).UserID, cutoff)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Failed to query deleted posts",
+		})
+	}
+	defer rows.Close()
+
+	posts := []DeletedPost{}
+	for rows.Next() {
+		var post DeletedPost
+		if err := rows.Scan(&post.IDPost, &post.ContentText, &post.CreatedAt, &post.DeletedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Failed to scan post data",
+			})
+		}
+		if deletedAt, err := time.Parse(time.RFC3339, post.DeletedAt); err == nil {
+			post.RestoreUntil = deletedAt.Add(postRestoreWindow).Format(time.RFC3339)
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{
+			"error": "Error iterating over rows",
+		})
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
+
+// purgeDeletedPosts hard deletes posts soft deleted before the cutoff. Images,
+// comments, likes and saves go with them through ON DELETE CASCADE.
+func purgeDeletedPosts(cutoff time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM posts WHERE deleted_at IS NOT NULL AND deleted_at < ?`,
+		cutoff.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func startDeletedPostPurger() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := purgeDeletedPosts(time.Now().Add(-deletedPostRetention))
+		if err != nil {
+			log.Printf("Failed to purge deleted posts: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted posts", purged)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// postEditGracePeriod is how long after publishing a post can be edited
+// without recording a revision; zero makes every edit visible. Set it with
+// POST_EDIT_GRACE_PERIOD, see loadPostEditGracePeriod.
+var postEditGracePeriod = 5 * time.Minute
+
+// maxDiffCells caps the LCS table diffWords builds. Larger changes are shown
+// as the old text replaced by the new, rather than using unbounded memory.
+const maxDiffCells = 1 << 20
+
+type PostRevision struct {
+	IDRevision      int      `json:"idRevision"`
+	IDPost          int      `json:"idPost"`
+	ContentText     string   `json:"content_text"`
+	ImageURL        string   `json:"imageURL"`
+	CategoryID      int      `json:"categoryID"`
+	Category        string   `json:"category"`
+	SecondaryImages []string `json:"secondaryImages"`
+	CreatedAt       string   `json:"created_at"`
+}
+
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+func createPostRevisionsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS post_revisions (
+		"idRevision" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idPost" INTEGER,
+		"content_text" TEXT,
+		"imageURL" TEXT,
+		"categoryID" INTEGER,
+		"images" TEXT,
+		"created_at" TEXT,
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Post revisions table created")
+}
+
+// loadPostEditGracePeriod reads the grace period from POST_EDIT_GRACE_PERIOD,
+// a duration such as "10m" or "0s"
+func loadPostEditGracePeriod() {
+	value := os.Getenv("POST_EDIT_GRACE_PERIOD")
+	if value == "" {
+		return
+	}
+	period, err := time.ParseDuration(value)
+	if err != nil || period < 0 {
+		log.Fatalf("POST_EDIT_GRACE_PERIOD must be a duration of zero or more, got %q", value)
+	}
+	postEditGracePeriod = period
+	fmt.Printf("Post edit grace period is %s\n", period)
+}
+
+func withinEditGracePeriod(createdAt string) bool {
+	published, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return false
+	}
+	return time.Since(published) < postEditGracePeriod
+}
+
+// snapshotPostRevision stores the current state of a post, including its
+// secondary images, before it gets overwritten by an edit
+func snapshotPostRevision(tx *sql.Tx, postID string) error {
+	var images []string
+	rows, err := tx.Query(`SELECT imageURL FROM images WHERE postID = ? ORDER BY idImage`, postID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var imageURL string
+		if err := rows.Scan(&imageURL); err != nil {
+			rows.Close()
+			return err
+		}
+		images = append(images, imageURL)
+	}
+	rows.Close()
+
+	imagesJSON, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO post_revisions (idPost, content_text, imageURL, categoryID, images, created_at)
+        SELECT idPost, content_text, imageURL, categoryID, ?, COALESCE(edited_at, created_at)
+        FROM posts WHERE idPost = ?`
+	_, err = tx.Exec(query, string(imagesJSON), postID)
+	return err
+}
+
+// getPostVersion loads a stored revision, or the live post when revisionID is 0.
+// Posts hidden from the viewer are treated as missing.
+func getPostVersion(postID, revisionID, viewerID int) (PostRevision, error) {
+	var revision PostRevision
+	var imagesJSON string
+	visible, visibleArgs := postVisibleSQL("p", viewerID)
+
+	if revisionID == 0 {
+		query := `
+            SELECT p.idPost, p.content_text, COALESCE(p.imageURL, ''), COALESCE(p.categoryID, 0),
+                   COALESCE(c.name, ''), COALESCE(p.edited_at, p.created_at)
+            FROM posts p
+            LEFT JOIN categories c ON p.categoryID = c.idCategory
+            WHERE p.idPost = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
+		err := db.QueryRow(query, append([]interface{}{postID}, visibleArgs...)...).Scan(&revision.IDPost, &revision.ContentText, &revision.ImageURL,
+			&revision.CategoryID, &revision.Category, &revision.CreatedAt)
+		if err != nil {
+			return revision, err
+		}
+
+		rows, err := db.Query(`SELECT imageURL FROM images WHERE postID = ? ORDER BY idImage`, postID)
+		if err != nil {
+			return revision, err
+		}
+		defer rows.Close()
+
+		revision.SecondaryImages = []string{}
+		for rows.Next() {
+			var imageURL string
+			if err := rows.Scan(&imageURL); err != nil {
+				return revision, err
+			}
+			revision.SecondaryImages = append(revision.SecondaryImages, imageURL)
+		}
+		return revision, rows.Err()
+	}
+
+	query := `
+        SELECT r.idRevision, r.idPost, r.content_text, COALESCE(r.imageURL, ''), COALESCE(r.categoryID, 0),
+               COALESCE(c.name, ''), COALESCE(r.images, '[]'), r.created_at
+        FROM post_revisions r
+        JOIN posts p ON r.idPost = p.idPost
+        LEFT JOIN categories c ON r.categoryID = c.idCategory
+        WHERE r.idRevision = ? AND r.idPost = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
+	err := db.QueryRow(query, append([]interface{}{revisionID, postID}, visibleArgs...)...).Scan(&revision.IDRevision, &revision.IDPost, &revision.ContentText,
+		&revision.ImageURL, &revision.CategoryID, &revision.Category, &imagesJSON, &revision.CreatedAt)
+	if err != nil {
+		return revision, err
+	}
+	return revision, decodeRevisionImages(imagesJSON, &revision)
+}
+
+func decodeRevisionImages(imagesJSON string, revision *PostRevision) error {
+	revision.SecondaryImages = []string{}
+	if err := json.Unmarshal([]byte(imagesJSON), &revision.SecondaryImages); err != nil {
+		return err
+	}
+	if revision.SecondaryImages == nil {
+		revision.SecondaryImages = []string{}
+	}
+	return nil
+}
+
+// GetPostRevisions lists the previous versions of a post, newest first
+func GetPostRevisions(c echo.Context) error {
+	postID, err := strconv.Atoi(c.QueryParam("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+
+	current, err := getPostVersion(postID, 0, viewerID(c))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query post"})
+	}
+
+	query := `
+        SELECT r.idRevision, r.idPost, r.content_text, COALESCE(r.imageURL, ''), COALESCE(r.categoryID, 0),
+               COALESCE(c.name, ''), COALESCE(r.images, '[]'), r.created_at
+        FROM post_revisions r
+        LEFT JOIN categories c ON r.categoryID = c.idCategory
+        WHERE r.idPost = ?
+        ORDER BY r.idRevision DESC`
+	rows, err := db.Query(query, postID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query post revisions"})
+	}
+	defer rows.Close()
+
+	revisions := []PostRevision{}
+	for rows.Next() {
+		var revision PostRevision
+		var imagesJSON string
+		if err := rows.Scan(&revision.IDRevision, &revision.IDPost, &revision.ContentText, &revision.ImageURL,
+			&revision.CategoryID, &revision.Category, &imagesJSON, &revision.CreatedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan post revision"})
+		}
+		if err := decodeRevisionImages(imagesJSON, &revision); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to decode revision images"})
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"current":   current,
+		"revisions": revisions,
+	})
+}
+
+// DiffPostRevisions compares two versions of a post. "from" and "to" are
+// revision IDs, where 0 or a missing value stands for the live post.
+func DiffPostRevisions(c echo.Context) error {
+	postID, err := strconv.Atoi(c.QueryParam("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+
+	var versionIDs [2]int
+	for i, param := range []string{"from", "to"} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		if versionIDs[i], err = strconv.Atoi(value); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid " + param + " revision ID"})
+		}
+	}
+
+	var versions [2]PostRevision
+	for i, revisionID := range versionIDs {
+		versions[i], err = getPostVersion(postID, revisionID, viewerID(c))
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Revision not found"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load post revisions"})
+		}
+	}
+	from, to := versions[0], versions[1]
+
+	added, removed := diffImages(from.SecondaryImages, to.SecondaryImages)
+	return c.JSON(http.StatusOK, echo.Map{
+		"from":            from,
+		"to":              to,
+		"content":         diffWords(from.ContentText, to.ContentText),
+		"imageChanged":    from.ImageURL != to.ImageURL,
+		"categoryChanged": from.CategoryID != to.CategoryID,
+		"imagesAdded":     added,
+		"imagesRemoved":   removed,
+	})
+}
+
+// diffWords returns a word level diff built from the longest common
+// subsequence. Words the versions start and end with are matched up first,
+// only the part in between needs the LCS table.
+func diffWords(from, to string) []DiffOp {
+	a, b := strings.Fields(from), strings.Fields(to)
+
+	ops := []DiffOp{}
+	appendOp := func(op, word string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += " " + word
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: word})
+	}
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		appendOp("equal", a[prefix])
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, word := range a {
+			appendOp("delete", word)
+		}
+		for _, word := range b {
+			appendOp("insert", word)
+		}
+	} else {
+		diffWordsLCS(a, b, appendOp)
+	}
+	for _, word := range tail {
+		appendOp("equal", word)
+	}
+	return ops
+}
+
+// diffWordsLCS diffs a and b through a full LCS table, which takes
+// len(a)*len(b) space
+func diffWordsLCS(a, b []string, appendOp func(op, word string)) {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			appendOp("equal", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			appendOp("delete", a[i])
+			i++
+		default:
+			appendOp("insert", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		appendOp("delete", a[i])
+	}
+	for ; j < len(b); j++ {
+		appendOp("insert", b[j])
+	}
+}
+
+func diffImages(from, to []string) (added, removed []string) {
+	inFrom := make(map[string]bool, len(from))
+	for _, image := range from {
+		inFrom[image] = true
+	}
+	inTo := make(map[string]bool, len(to))
+	for _, image := range to {
+		inTo[image] = true
+	}
+
+	added, removed = []string{}, []string{}
+	for _, image := range to {
+		if !inFrom[image] {
+			added = append(added, image)
+		}
+	}
+	for _, image := range from {
+		if !inTo[image] {
+			removed = append(removed, image)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	rateLimitByUser = "user"
+	rateLimitByIP   = "ip"
+
+	rateLimitSweepInterval = 5 * time.Minute
+)
+
+// rateLimitPolicy lets Limit requests through in a burst, after which the
+// bucket refills evenly so another Limit requests fit in every Per. Key says
+// whether callers share a bucket per user or per IP address.
+type rateLimitPolicy struct {
+	Limit int
+	Per   time.Duration
+	Key   string
+}
+
+// rateLimitPolicies are the per-route policies, by name. RATE_LIMIT_CONFIG
+// can point at a JSON file that overrides them, see loadRateLimitConfig.
+var rateLimitPolicies = map[string]rateLimitPolicy{
+	"login":    {Limit: 10, Per: time.Minute, Key: rateLimitByIP},
+	"register": {Limit: 5, Per: time.Hour, Key: rateLimitByIP},
+	// Each request sends an email, keep it from being used to flood inboxes
+	"accountEmail": {Limit: 5, Per: time.Hour, Key: rateLimitByIP},
+	"addPost":      {Limit: 10, Per: time.Minute, Key: rateLimitByUser},
+	// A thread holds up to maxThreadLength posts, so fewer of them fit
+	"addThread":   {Limit: 3, Per: time.Minute, Key: rateLimitByUser},
+	"addComment":  {Limit: 20, Per: time.Minute, Key: rateLimitByUser},
+	"sendMessage": {Limit: 30, Per: time.Minute, Key: rateLimitByUser},
+	"like":        {Limit: 60, Per: time.Minute, Key: rateLimitByUser},
+}
+
+// rateLimiter holds the buckets. It is in memory, so every instance of the
+// server counts on its own; a store shared between instances can replace it.
+var rateLimiter rateLimitStore = newMemoryRateLimitStore()
+
+// rateLimitStore keeps token buckets. Take has to check and update a bucket
+// in one step, so concurrent requests can't spend the same token.
+type rateLimitStore interface {
+	Take(key string, policy rateLimitPolicy, now time.Time) (rateLimitDecision, error)
+}
+
+type rateLimitDecision struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next token, zero when allowed
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again
+	ResetAfter time.Duration
+}
+
+// tokenBucket is the state of one bucket. Stores keep it however suits them
+// and use take to spend from it.
+type tokenBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// take refills the bucket for the time since it was last updated and spends a
+// token if there is one
+func (b *tokenBucket) take(policy rateLimitPolicy, now time.Time) rateLimitDecision {
+	perToken := policy.Per / time.Duration(policy.Limit)
+	if b.Updated.IsZero() {
+		b.Tokens = float64(policy.Limit)
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = math.Min(float64(policy.Limit), b.Tokens+float64(elapsed)/float64(perToken))
+	}
+	b.Updated = now
+
+	var decision rateLimitDecision
+	if b.Tokens >= 1 {
+		b.Tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = time.Duration((1 - b.Tokens) * float64(perToken))
+	}
+	decision.Remaining = int(b.Tokens)
+	decision.ResetAfter = time.Duration((float64(policy.Limit) - b.Tokens) * float64(perToken))
+	return decision
+}
+
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokenBucket
+	// full is when the bucket will have refilled, after which it can go
+	full time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryRateLimitStore) Take(key string, policy rateLimitPolicy, now time.Time) (rateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{}
+		s.buckets[key] = bucket
+	}
+	decision := bucket.take(policy, now)
+	bucket.full = now.Add(decision.ResetAfter)
+	return decision, nil
+}
+
+// sweep drops buckets that have refilled, a new one would start out the same
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, bucket := range s.buckets {
+		if !now.Before(bucket.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func startRateLimitSweeper(store *memoryRateLimitStore) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		store.sweep(time.Now())
+	}
+}
+
+// loadRateLimitConfig overrides policies from the JSON file named in
+// RATE_LIMIT_CONFIG, for example
+//
+//	{"login": {"limit": 5, "per": "1m", "key": "ip"}}
+//
+// Policies the file doesn't mention keep their defaults.
+func loadRateLimitConfig() {
+	path := os.Getenv("RATE_LIMIT_CONFIG")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var config map[string]struct {
+		Limit int    `json:"limit"`
+		Per   string `json:"per"`
+		Key   string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	for name, entry := range config {
+		per, err := time.ParseDuration(entry.Per)
+		if err != nil || per <= 0 || entry.Limit <= 0 {
+			log.Fatalf("%s: policy %s needs a positive limit and per", path, name)
+		}
+		if entry.Key != rateLimitByUser && entry.Key != rateLimitByIP {
+			log.Fatalf("%s: policy %s key must be user or ip", path, name)
+		}
+		rateLimitPolicies[name] = rateLimitPolicy{Limit: entry.Limit, Per: per, Key: entry.Key}
+	}
+	fmt.Printf("Loaded rate limits from %s\n", path)
+}
+
+// clientIPExtractor decides where c.RealIP, which rate limits and login
+// lockouts key on, gets the client's address. By default it is the peer of
+// the connection, forwarding headers are ignored since any client can send
+// them. Behind a reverse proxy TRUSTED_PROXIES lists the proxies' ranges as
+// comma separated CIDRs, and X-Forwarded-For is read back past them.
+func clientIPExtractor() echo.IPExtractor {
+	proxies := os.Getenv("TRUSTED_PROXIES")
+	if proxies == "" {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(proxies, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Fatalf("TRUSTED_PROXIES: %v", err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	fmt.Printf("Trusting X-Forwarded-For from %s\n", proxies)
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// rateLimit applies the named policy to a route. Routes keyed by user go
+// after jwtMiddleware; without a logged in user they fall back to the IP.
+// When the store fails requests are let through rather than locking everyone
+// out.
+func rateLimit(name string) echo.MiddlewareFunc {
+	policy, ok := rateLimitPolicies[name]
+	if !ok {
+		log.Fatalf("No rate limit policy named %s", name)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := name + ":ip:" + c.RealIP()
+			if claims := currentUser(c); policy.Key == rateLimitByUser && claims != nil {
+				key = name + ":user:" + strconv.Itoa(claims.UserID)
+			}
+
+			decision, err := rateLimiter.Take(key, policy, time.Now())
+			if err != nil {
+				log.Printf("Rate limiter failed for %s: %v", key, err)
+				return next(c)
+			}
+
+			header := c.Response().Header()
+			header.Set("X-RateLimit-Limit", strconv.Itoa(policy.Limit))
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.ResetAfter)))
+			if !decision.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+				return c.JSON(http.StatusTooManyRequests, echo.Map{"error": "Too many requests, try again later"})
+			}
+			return next(c)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
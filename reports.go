@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reportTargetPost    = "post"
+	reportTargetComment = "comment"
+	reportTargetMessage = "message"
+	reportTargetUser    = "user"
+
+	reportOpen      = "open"
+	reportResolved  = "resolved"
+	reportDismissed = "dismissed"
+
+	reportActionDismiss = "dismiss"
+	reportActionRemove  = "remove"
+	reportActionWarn    = "warn"
+	reportActionSuspend = "suspend"
+
+	maxReportDetailsLength = 1000
+	reportQueuePageLimit   = 25
+)
+
+var reportReasonCodes = []string{
+	"spam", "harassment", "hate", "violence", "sexual", "misinformation", "self_harm", "impersonation", "other",
+}
+
+type Report struct {
+	IDReport   int    `json:"idReport"`
+	TargetType string `json:"targetType"`
+	TargetID   int    `json:"targetID"`
+	ReasonCode string `json:"reasonCode"`
+	Details    string `json:"details"`
+	Status     string `json:"status"`
+	Resolution string `json:"resolution,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	ResolvedAt string `json:"resolved_at,omitempty"`
+}
+
+// ReportQueueItem groups the open reports against one target
+type ReportQueueItem struct {
+	TargetType      string   `json:"targetType"`
+	TargetID        int      `json:"targetID"`
+	AuthorID        int      `json:"authorID"`
+	Content         string   `json:"content"`
+	ReportCount     int      `json:"reportCount"`
+	ReasonCodes     []string `json:"reasonCodes"`
+	FirstReportedAt string   `json:"first_reported_at"`
+	LastReportedAt  string   `json:"last_reported_at"`
+}
+
+func createReportsTable(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS reports (
+		"idReport" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"reporterID" INTEGER,
+		"targetType" TEXT,
+		"targetID" INTEGER,
+		"categoryID" INTEGER,
+		"reasonCode" TEXT,
+		"details" TEXT,
+		"status" TEXT NOT NULL DEFAULT 'open',
+		"created_at" TEXT,
+		"resolvedBy" INTEGER,
+		"resolution" TEXT,
+		"resolved_at" TEXT,
+		FOREIGN KEY(reporterID) REFERENCES users(idUser) ON DELETE CASCADE,
+		FOREIGN KEY(categoryID) REFERENCES categories(idCategory) ON DELETE SET NULL
+	);`,
+		`CREATE INDEX IF NOT EXISTS idx_reports_target ON reports (targetType, targetID, status)`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Reports table created")
+}
+
+func isReportReasonCode(code string) bool {
+	for _, reasonCode := range reportReasonCodes {
+		if code == reasonCode {
+			return true
+		}
+	}
+	return false
+}
+
+// reportTarget checks that the reporter can see what they are reporting and
+// returns its author and community, 0 for content outside any community.
+// Messages can only be reported by the person who received them.
+func reportTarget(targetType string, targetID, reporterID int) (int, int, error) {
+	var authorID, categoryID int
+	var err error
+	switch targetType {
+	case reportTargetPost:
+		var visible bool
+		if visible, err = publishedPostExists(targetID, reporterID); err == nil && !visible {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			categoryID, authorID, err = postCommunity(targetID)
+		}
+	case reportTargetComment:
+		var postID int
+		err = db.QueryRow(`SELECT idPost, idUser FROM comments WHERE idComment = ? AND deleted_at IS NULL AND removed_at IS NULL`,
+			targetID).Scan(&postID, &authorID)
+		var visible bool
+		if err == nil {
+			if visible, err = publishedPostExists(postID, reporterID); err == nil && !visible {
+				err = sql.ErrNoRows
+			}
+		}
+		if err == nil {
+			categoryID, _, err = postCommunity(postID)
+		}
+	case reportTargetMessage:
+		err = db.QueryRow(`SELECT senderID FROM messages WHERE idMessage = ? AND receiverID = ?`, targetID, reporterID).Scan(&authorID)
+	case reportTargetUser:
+		err = db.QueryRow(`SELECT idUser FROM users WHERE idUser = ?`, targetID).Scan(&authorID)
+	default:
+		return 0, 0, errors.New("Target type must be post, comment, message or user")
+	}
+	return authorID, categoryID, err
+}
+
+// CreateReport flags a post, comment, message or user. Reporting the same
+// thing again while the first report is still open is rejected.
+func CreateReport(c echo.Context) error {
+	type ReportRequest struct {
+		TargetType string `json:"targetType"`
+		TargetID   int    `json:"targetID"`
+		ReasonCode string `json:"reasonCode"`
+		Details    string `json:"details"`
+	}
+
+	var req ReportRequest
+	if err := c.Bind(&req); err != nil || req.TargetID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Target type and ID are required"})
+	}
+	if !isReportReasonCode(req.ReasonCode) {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "Reason code must be one of " + strings.Join(reportReasonCodes, ", "),
+		})
+	}
+	details := strings.TrimSpace(req.Details)
+	if len([]rune(details)) > maxReportDetailsLength {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": fmt.Sprintf("Details must be at most %d characters", maxReportDetailsLength),
+		})
+	}
+	if req.ReasonCode == "other" && details == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Details are required for other"})
+	}
+
+	reporterID := currentUser(c).UserID
+	authorID, categoryID, err := reportTarget(req.TargetType, req.TargetID, reporterID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Nothing to report with that ID"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if authorID == reporterID {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "You cannot report yourself"})
+	}
+
+	var duplicate bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM reports WHERE reporterID = ? AND targetType = ? AND targetID = ? AND status = 'open')`,
+		reporterID, req.TargetType, req.TargetID).Scan(&duplicate)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if duplicate {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "You already reported this"})
+	}
+
+	// Reports on community content go to that community's moderators
+	var community interface{}
+	if categoryID != 0 {
+		community = categoryID
+	}
+	query := `INSERT INTO reports (reporterID, targetType, targetID, categoryID, reasonCode, details, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, reporterID, req.TargetType, req.TargetID, community,
+		req.ReasonCode, details, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to save report: " + err.Error()})
+	}
+
+	reportID, err := result.LastInsertId()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm report"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Report received", "idReport": reportID})
+}
+
+// GetMyReports lists the reports the current user filed and how they ended
+func GetMyReports(c echo.Context) error {
+	query := `
+        SELECT idReport, targetType, targetID, reasonCode, COALESCE(details, ''), status, COALESCE(resolution, ''),
+               created_at, COALESCE(resolved_at, '')
+        FROM reports
+        WHERE reporterID = ?
+        ORDER BY idReport DESC`
+	rows, err := db.Query(query, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query reports"})
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var report Report
+		if err := rows.Scan(&report.IDReport, &report.TargetType, &report.TargetID, &report.ReasonCode, &report.Details,
+			&report.Status, &report.Resolution, &report.CreatedAt, &report.ResolvedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan report data"})
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, reports)
+}
+
+// reportedContent returns the author and text of a reported item, empty when
+// it is already gone
+func reportedContent(targetType string, targetID int) (int, string, error) {
+	var authorID int
+	var content string
+	var err error
+	switch targetType {
+	case reportTargetPost:
+		err = db.QueryRow(`SELECT userID, COALESCE(content_text, '') FROM posts WHERE idPost = ?`, targetID).Scan(&authorID, &content)
+	case reportTargetComment:
+		err = db.QueryRow(`SELECT idUser, COALESCE(content_text, '') FROM comments WHERE idComment = ?`, targetID).Scan(&authorID, &content)
+	case reportTargetMessage:
+		err = db.QueryRow(`SELECT senderID, COALESCE(content, '') FROM messages WHERE idMessage = ?`, targetID).Scan(&authorID, &content)
+	case reportTargetUser:
+		err = db.QueryRow(`SELECT idUser, username FROM users WHERE idUser = ?`, targetID).Scan(&authorID, &content)
+	}
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	return authorID, content, err
+}
+
+// requireReportModerator responds with an error and returns false unless the
+// current user may handle reports filed in categoryID. Reports outside any
+// community are for site moderators.
+func requireReportModerator(c echo.Context, categoryID int) bool {
+	if categoryID != 0 {
+		return requireCommunityModerator(c, categoryID)
+	}
+	if !isSiteModerator(c) {
+		c.JSON(http.StatusForbidden, echo.Map{"error": "Only site moderators can do that"})
+		return false
+	}
+	return true
+}
+
+// GetReportQueue lists open reports in a community for its moderators, one
+// entry per reported item, most reported first and oldest first among equals.
+// Without a categoryID it lists the site queue of reports outside communities.
+func GetReportQueue(c echo.Context) error {
+	categoryID, offset := 0, 0
+	var err error
+	if c.QueryParam("categoryID") != "" {
+		categoryID, offset, err = bindCommunityQuery(c)
+	} else if c.QueryParam("offset") != "" {
+		offset, err = strconv.Atoi(c.QueryParam("offset"))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid category ID or offset"})
+	}
+	if !requireReportModerator(c, categoryID) {
+		return nil
+	}
+
+	query := `
+        SELECT targetType, targetID, COUNT(*), GROUP_CONCAT(DISTINCT reasonCode), MIN(created_at), MAX(created_at)
+        FROM reports
+        WHERE status = 'open' AND COALESCE(categoryID, 0) = ?
+        GROUP BY targetType, targetID
+        ORDER BY COUNT(*) DESC, MIN(created_at)
+        LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, categoryID, reportQueuePageLimit, offset)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query reports"})
+	}
+	defer rows.Close()
+
+	items := []ReportQueueItem{}
+	for rows.Next() {
+		var item ReportQueueItem
+		var reasonCodes string
+		if err := rows.Scan(&item.TargetType, &item.TargetID, &item.ReportCount, &reasonCodes,
+			&item.FirstReportedAt, &item.LastReportedAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan report data"})
+		}
+		item.ReasonCodes = strings.Split(reasonCodes, ",")
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+	rows.Close()
+
+	for i := range items {
+		items[i].AuthorID, items[i].Content, err = reportedContent(items[i].TargetType, items[i].TargetID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query reported content"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, items)
+}
+
+// ResolveReports closes every open report against one item. Dismissing
+// leaves the item alone, the other actions remove it, warn its author or ban
+// its author from the community, or suspend them site-wide for reports
+// outside communities. Reporters are told the outcome.
+func ResolveReports(c echo.Context) error {
+	type ResolveRequest struct {
+		TargetType string `json:"targetType"`
+		TargetID   int    `json:"targetID"`
+		Action     string `json:"action"`
+		Reason     string `json:"reason"`
+		// ExpiresAt (RFC3339) limits a suspension, empty suspends for good
+		ExpiresAt string `json:"expiresAt"`
+	}
+
+	var req ResolveRequest
+	if err := c.Bind(&req); err != nil || req.TargetType == "" || req.TargetID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Target type and ID are required"})
+	}
+
+	reason := strings.TrimSpace(req.Reason)
+	switch req.Action {
+	case reportActionDismiss:
+	case reportActionRemove, reportActionWarn, reportActionSuspend:
+		var err error
+		if reason, err = validateRemovalReason(req.Reason); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Action must be dismiss, remove, warn or suspend"})
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	var categoryID int
+	err = db.QueryRow(`SELECT COALESCE(categoryID, 0) FROM reports WHERE targetType = ? AND targetID = ? AND status = 'open' LIMIT 1`,
+		req.TargetType, req.TargetID).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "No open reports for that item"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !requireReportModerator(c, categoryID) {
+		return nil
+	}
+
+	authorID, _, err := reportedContent(req.TargetType, req.TargetID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query reported content"})
+	}
+
+	before := snapshot(req.TargetType, req.TargetID)
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	moderatorID := currentUser(c).UserID
+	status, outcome := reportResolved, ""
+	switch req.Action {
+	case reportActionDismiss:
+		status, outcome = reportDismissed, "no action was taken"
+		err = logModAction(tx, categoryID, moderatorID, modActionDismissReports, req.TargetType, req.TargetID, reason)
+	case reportActionRemove:
+		outcome = "the content was removed"
+		switch req.TargetType {
+		case reportTargetPost:
+			err = removePost(tx, categoryID, moderatorID, req.TargetID, authorID, reason)
+		case reportTargetComment:
+			err = removeComment(tx, categoryID, moderatorID, req.TargetID, authorID, reason)
+		case reportTargetMessage:
+			_, err = tx.Exec(`DELETE FROM messages WHERE idMessage = ?`, req.TargetID)
+		default:
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Only posts, comments and messages can be removed"})
+		}
+	case reportActionWarn:
+		outcome = "the author was warned"
+		if err = logModAction(tx, categoryID, moderatorID, modActionWarnUser, "user", authorID, reason); err == nil {
+			err = notify(tx, authorID, moderatorID, notificationWarning, req.TargetID, "You received a warning: "+reason)
+		}
+	case reportActionSuspend:
+		if categoryID != 0 {
+			outcome = "the author was banned from the community"
+			err = banUser(tx, categoryID, moderatorID, authorID, reason, expiresAt)
+			break
+		}
+		var state *accountState
+		if state, err = loadAccountState(authorID); err == nil && roleAtLeast(state.Role, roleModerator) {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Site staff cannot be suspended from reports"})
+		}
+		if err == nil {
+			outcome = "the author was suspended"
+			err = suspendUser(tx, authorID, reason, expiresAt)
+		}
+	}
+	// Content held by automod stays hidden only when it's removed
+	if err == nil && req.Action != reportActionRemove {
+		err = releaseHeldContent(tx, req.TargetType, req.TargetID)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to apply action: " + err.Error()})
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = tx.Exec(`
+        INSERT INTO notifications (idUser, actorID, type, targetID, message, created_at)
+        SELECT DISTINCT reporterID, 0, ?, ?, ?, ? FROM reports
+        WHERE targetType = ? AND targetID = ? AND status = 'open' AND reporterID IS NOT NULL`,
+		notificationReportOutcome, req.TargetID, "Thanks for your report, "+outcome, now, req.TargetType, req.TargetID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to notify reporters: " + err.Error()})
+	}
+	result, err := tx.Exec(`
+        UPDATE reports SET status = ?, resolvedBy = ?, resolution = ?, resolved_at = ?
+        WHERE targetType = ? AND targetID = ? AND status = 'open'`,
+		status, moderatorID, req.Action, now, req.TargetType, req.TargetID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to close reports: " + err.Error()})
+	}
+	closed, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm update"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to resolve reports"})
+	}
+	recordAudit(c, moderatorID, auditActionResolveReports, req.TargetType, req.TargetID, before, echo.Map{
+		"resolution": req.Action,
+		"reason":     reason,
+		"closed":     closed,
+		"target":     snapshot(req.TargetType, req.TargetID),
+	})
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Reports resolved", "closed": closed, "status": status})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// QuotedPost is the embedded preview of the post a quote post refers to
+type QuotedPost struct {
+	IDPost      int    `json:"idPost"`
+	UserID      int    `json:"userID,omitempty"`
+	ContentText string `json:"content_text,omitempty"`
+	ImageURL    string `json:"imageURL,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	// Unavailable is set once the original has been deleted
+	Unavailable bool `json:"unavailable"`
+}
+
+func createRepostsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS reposts (
+		"idRepost" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"idPost" INTEGER,
+		"idUser" INTEGER,
+		"created_at" TEXT,
+		UNIQUE(idPost, idUser),
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Reposts table created")
+}
+
+// loadQuotedPost returns the embed for a quote post, nil when the post quotes
+// nothing. posts.quotedPostID and posts.inReplyToID deliberately have no
+// foreign key: quotes and replies outlive the original, which then renders
+// as unavailable. So does an original the viewer is not allowed to see.
+func loadQuotedPost(quotedPostID, viewerID int) (*QuotedPost, error) {
+	if quotedPostID == 0 {
+		return nil, nil
+	}
+
+	quoted := &QuotedPost{IDPost: quotedPostID}
+	visible, visibleArgs := postVisibleSQL("p", viewerID)
+	query := `
+        SELECT p.userID, p.content_text, COALESCE(p.imageURL, ''), p.created_at
+        FROM posts p
+        WHERE p.idPost = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible
+	err := db.QueryRow(query, append([]interface{}{quotedPostID}, visibleArgs...)...).Scan(&quoted.UserID, &quoted.ContentText, &quoted.ImageURL, &quoted.CreatedAt)
+	if err == sql.ErrNoRows {
+		quoted.Unavailable = true
+		return quoted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quoted, nil
+}
+
+func bindRepostRequest(c echo.Context) (int, error) {
+	type RepostRequest struct {
+		PostID string `json:"postID"`
+	}
+
+	var req RepostRequest
+	if err := c.Bind(&req); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(req.PostID)
+}
+
+func Repost(c echo.Context) error {
+	postID, err := bindRepostRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+
+	exists, err := publishedPostExists(postID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
+
+	query := `INSERT OR IGNORE INTO reposts (idPost, idUser, created_at) VALUES (?, ?, ?)`
+	result, err := db.Exec(query, postID, currentUser(c).UserID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to repost: " + err.Error()})
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm repost"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Post already reposted"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Post reposted"})
+}
+
+func UndoRepost(c echo.Context) error {
+	postID, err := bindRepostRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+
+	result, err := db.Exec(`DELETE FROM reposts WHERE idPost = ? AND idUser = ?`, postID, currentUser(c).UserID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to undo repost: " + err.Error()})
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to confirm undo"})
+	}
+	if rowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Repost not found"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Repost removed"})
+}
+
+// GetHomeFeed returns posts and reposts from the accounts the current user
+// follows plus their own posts, newest activity first
+func GetHomeFeed(c echo.Context) error {
+	type FeedPost struct {
+		IDPost          int          `json:"idPost"`
+		ContentText     string       `json:"content_text"`
+		CreatedAt       string       `json:"created_at"`
+		UserID          int          `json:"userID"`
+		Category        string       `json:"category"`
+		ImageURL        string       `json:"imageURL"`
+		SecondaryImages []string     `json:"secondaryImages"`
+		Edited          bool         `json:"edited"`
+		EditedAt        string       `json:"edited_at"`
+		QuotedPostID    int          `json:"quotedPostID"`
+		QuotedPost      *QuotedPost  `json:"quotedPost,omitempty"`
+		Preview         *LinkPreview `json:"preview,omitempty"`
+		RepostCount     int          `json:"repostCount"`
+		QuoteCount      int          `json:"quoteCount"`
+		InReplyToID     int          `json:"inReplyToID"`
+		ReplyCount      int          `json:"replyCount"`
+		Visibility      string       `json:"visibility"`
+		// Filtered posts matched a muted word and only keep their metadata
+		Filtered bool `json:"filtered,omitempty"`
+		// Set when the post shows up because someone the user follows reposted it
+		RepostedBy int    `json:"repostedBy,omitempty"`
+		RepostedAt string `json:"repostedAt,omitempty"`
+	}
+
+	offset, err := strconv.Atoi(c.QueryParam("offset"))
+	if err != nil && c.QueryParam("offset") != "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
+	}
+
+	userID := currentUser(c).UserID
+	filter, err := loadWordFilter(userID, mutedWordScopeHome)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query muted words"})
+	}
+
+	visible, visibleArgs := postVisibleSQL("p", userID)
+	notMuted, notMutedArgs := notMutedSQL("p.userID", userID)
+	repostNotMuted, repostNotMutedArgs := notMutedSQL("f.repostedBy", userID)
+	query := `
+        WITH feed AS (
+            SELECT p.idPost, p.created_at AS activity_at, 0 AS repostedBy, '' AS repostedAt
+            FROM posts p
+            WHERE p.userID = ? OR p.userID IN (SELECT subscribedToID FROM subscriptions WHERE subscriberID = ? AND status = 'accepted')
+            UNION ALL
+            SELECT r.idPost, r.created_at, r.idUser, r.created_at
+            FROM reposts r
+            WHERE r.idUser IN (SELECT subscribedToID FROM subscriptions WHERE subscriberID = ? AND status = 'accepted')
+        )
+        SELECT
+            p.idPost,
+            p.content_text,
+            p.created_at,
+            p.userID,
+            COALESCE(c.name, '') as category,
+            COALESCE(p.imageURL, '') as imageURL,
+            COALESCE(p.edited_at, '') as edited_at,
+            COALESCE(p.quotedPostID, 0) as quotedPostID,
+            (SELECT COUNT(*) FROM reposts r WHERE r.idPost = p.idPost
+                AND r.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as repostCount,
+            (SELECT COUNT(*) FROM posts q WHERE q.quotedPostID = p.idPost AND q.deleted_at IS NULL AND q.status = 'published'
+                AND q.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as quoteCount,
+            COALESCE(p.inReplyToID, 0) as inReplyToID,
+            (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount,
+            p.visibility,
+            f.repostedBy,
+            f.repostedAt
+        FROM feed f
+        JOIN posts p ON f.idPost = p.idPost
+        LEFT JOIN categories c ON p.categoryID = c.idCategory
+        WHERE p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + `
+            AND ` + notMuted + ` AND ` + repostNotMuted + ` AND ` + notShadowbannedSQL("f.repostedBy") + `
+        ORDER BY f.activity_at DESC
+        LIMIT 10 OFFSET ?`
+
+	args := append([]interface{}{userID, userID, userID}, visibleArgs...)
+	args = append(append(args, notMutedArgs...), repostNotMutedArgs...)
+	rows, err := db.Query(query, append(args, userID, offset)...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query feed"})
+	}
+	defer rows.Close()
+
+	posts := []FeedPost{}
+	for rows.Next() {
+		var post FeedPost
+		if err := rows.Scan(
+			&post.IDPost,
+			&post.ContentText,
+			&post.CreatedAt,
+			&post.UserID,
+			&post.Category,
+			&post.ImageURL,
+			&post.EditedAt,
+			&post.QuotedPostID,
+			&post.RepostCount,
+			&post.QuoteCount,
+			&post.InReplyToID,
+			&post.ReplyCount,
+			&post.Visibility,
+			&post.RepostedBy,
+			&post.RepostedAt,
+		); err != nil {
+			log.Printf("Scan error: %v", err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan post data"})
+		}
+		post.Edited = post.EditedAt != ""
+		if filtered, hide := filter.match(post.ContentText); hide {
+			continue
+		} else if filtered {
+			post = FeedPost{IDPost: post.IDPost, CreatedAt: post.CreatedAt, UserID: post.UserID, Category: post.Category,
+				Visibility: post.Visibility, Filtered: true, RepostedBy: post.RepostedBy, RepostedAt: post.RepostedAt}
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+	rows.Close()
+
+	for i := range posts {
+		if posts[i].Filtered {
+			posts[i].SecondaryImages = []string{}
+			continue
+		}
+		if posts[i].QuotedPost, err = loadQuotedPost(posts[i].QuotedPostID, userID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query quoted post"})
+		}
+		if posts[i].Preview, err = loadLinkPreview(posts[i].IDPost); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query link preview"})
+		}
+
+		posts[i].SecondaryImages = []string{}
+		imageRows, err := db.Query(`SELECT imageURL FROM images WHERE postID = ?`, posts[i].IDPost)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query secondary images"})
+		}
+		for imageRows.Next() {
+			var imageURL string
+			if err := imageRows.Scan(&imageURL); err != nil {
+				imageRows.Close()
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan image data"})
+			}
+			posts[i].SecondaryImages = append(posts[i].SecondaryImages, imageURL)
+		}
+		imageRows.Close()
+	}
+
+	return c.JSON(http.StatusOK, posts)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRank orders roles so checks can ask for a minimum role
+var roleRank = map[string]int{roleUser: 0, roleModerator: 1, roleAdmin: 2}
+
+// accountState is what jwtMiddleware needs to know about a user on every
+// request, read fresh so role changes and suspensions apply immediately
+type accountState struct {
+	Role              string
+	Suspended         bool
+	SuspendedUntil    string
+	SuspensionReason  string
+	MustResetPassword bool
+	EmailVerified     bool
+	// Tokens issued before this Unix time are rejected
+	TokensInvalidBefore int64
+}
+
+func parseRole(role string) (string, error) {
+	if _, ok := roleRank[role]; !ok {
+		return "", errors.New("Role must be user, moderator or admin")
+	}
+	return role, nil
+}
+
+// roleAtLeast reports whether role grants everything min does
+func roleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min]
+}
+
+func loadAccountState(userID int) (*accountState, error) {
+	var state accountState
+	err := db.QueryRow(`
+        SELECT role, suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > ?),
+               COALESCE(suspended_until, ''), COALESCE(suspension_reason, ''), must_reset_password,
+               email_verified_at IS NOT NULL, tokens_invalid_before
+        FROM users WHERE idUser = ?`, time.Now().UTC().Format(time.RFC3339), userID).
+		Scan(&state.Role, &state.Suspended, &state.SuspendedUntil, &state.SuspensionReason,
+			&state.MustResetPassword, &state.EmailVerified, &state.TokensInvalidBefore)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// checkAccountState returns the status and body to reject a request with, or
+// 0 when the account may go ahead. Users who have to reset their password can
+// only reach path.
+func checkAccountState(state *accountState, issuedAt int64, path string) (int, echo.Map) {
+	if issuedAt < state.TokensInvalidBefore {
+		return http.StatusUnauthorized, echo.Map{"error": "Token has been revoked, please log in again"}
+	}
+	if state.Suspended {
+		return http.StatusForbidden, echo.Map{
+			"error":           "Account suspended",
+			"reason":          state.SuspensionReason,
+			"suspended_until": state.SuspendedUntil,
+		}
+	}
+	if state.MustResetPassword && path != "/updatePassword" {
+		return http.StatusForbidden, echo.Map{"error": "Password reset required"}
+	}
+	return 0, nil
+}
+
+// currentRole returns the current user's role as loaded by jwtMiddleware
+func currentRole(c echo.Context) string {
+	role, _ := c.Get("role").(string)
+	if role == "" {
+		return roleUser
+	}
+	return role
+}
+
+// requireRole only lets users with at least the given role through. It goes
+// after jwtMiddleware, which loads the role from the database rather than
+// trusting the one in the token.
+func requireRole(min string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !roleAtLeast(currentRole(c), min) {
+				return c.JSON(http.StatusForbidden, echo.Map{"error": "Insufficient permissions"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// isSiteModerator reports whether the current user moderates the whole site
+func isSiteModerator(c echo.Context) bool {
+	return roleAtLeast(currentRole(c), roleModerator)
+}
+
+// bootstrapAdmin makes the user named in ADMIN_USERNAME an admin, so a fresh
+// install has someone who can hand out roles
+func bootstrapAdmin(db *sql.DB) {
+	username := os.Getenv("ADMIN_USERNAME")
+	if username == "" {
+		return
+	}
+	if _, err := db.Exec(`UPDATE users SET role = ? WHERE username = ?`, roleAdmin, username); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Made %s an admin\n", username)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// notShadowbannedSQL returns the condition that the user in column is not
+// shadowbanned, taking the viewer as its argument. Shadowbanned users still
+// see their own content so nothing looks off to them.
+func notShadowbannedSQL(column string) string {
+	return fmt.Sprintf(`(%[1]s = ? OR NOT EXISTS (SELECT 1 FROM users sb WHERE sb.idUser = %[1]s AND sb.shadowbanned_at IS NOT NULL))`, column)
+}
+
+// AdminShadowbanUser turns a shadowban on or off. Shadowbanned users can keep
+// posting and commenting, but only they see the results. Site staff can't be
+// shadowbanned.
+func AdminShadowbanUser(c echo.Context) error {
+	type ShadowbanRequest struct {
+		UserID int   `json:"userID"`
+		Value  *bool `json:"value"`
+	}
+
+	var req ShadowbanRequest
+	if err := bindAdminTarget(c, &req, &req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if req.Value == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Value is required"})
+	}
+
+	state, err := loadAccountState(req.UserID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "User not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	if *req.Value && roleAtLeast(state.Role, roleModerator) {
+		return c.JSON(http.StatusForbidden, echo.Map{"error": "Site staff cannot be shadowbanned"})
+	}
+
+	var shadowbannedAt interface{}
+	action, message := auditActionUnshadowbanUser, "Shadowban lifted"
+	if *req.Value {
+		shadowbannedAt = time.Now().UTC().Format(time.RFC3339)
+		action, message = auditActionShadowbanUser, "User shadowbanned"
+	}
+	before := snapshot("user", req.UserID)
+	result, err := db.Exec(`UPDATE users SET shadowbanned_at = ? WHERE idUser = ?`, shadowbannedAt, req.UserID)
+	return respondUserUpdate(c, action, req.UserID, before, result, err, message)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/bits"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Content scoring at or above these goes into the moderation queue,
+	// visible or held back until reviewed
+	spamFlagThreshold = 0.35
+	spamHoldThreshold = 0.6
+
+	// Simhashes this many bits apart or closer count as near-duplicates. Posts
+	// are short, so a few changed words already move a fair number of bits.
+	nearDuplicateDistance = 10
+	shingleSize           = 3
+
+	spamOwnWindow      = 24 * time.Hour
+	spamSiteWindow     = time.Hour
+	spamVelocityWindow = 10 * time.Minute
+	spamNewAccountAge  = 7 * 24 * time.Hour
+	// Caps how much recent history a single check loads
+	spamHistoryLimit = 1000
+)
+
+// spamWeights says how much each signal contributes to the score. They add
+// up to 1 so the score stays between 0 and 1.
+var spamWeights = struct {
+	OwnDuplicates, SiteDuplicates, Velocity, LinkDensity, AccountAge float64
+}{0.30, 0.20, 0.10, 0.25, 0.15}
+
+// contentFingerprint is a recent post or comment as spam scoring sees it
+type contentFingerprint struct {
+	UserID    int
+	Simhash   uint64
+	CreatedAt time.Time
+}
+
+// spamSignals are the inputs to the score, gathered from the database for
+// live content or from a fixture corpus by the evaluation harness
+type spamSignals struct {
+	// Near-duplicates of the author's own content within spamOwnWindow
+	OwnDuplicates int
+	// Other users who posted a near-duplicate within spamSiteWindow
+	SiteDuplicates int
+	// Items the author wrote within spamVelocityWindow
+	RecentItems int
+	Links       int
+	Words       int
+	AccountAge  time.Duration
+	// False for accounts that predate registration times being recorded
+	AgeKnown bool
+}
+
+func createContentFingerprintsTable(db *sql.DB) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS content_fingerprints (
+		"idFingerprint" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"targetType" TEXT,
+		"targetID" INTEGER,
+		"userID" INTEGER,
+		"simhash" INTEGER,
+		"spamScore" REAL,
+		"created_at" TEXT,
+		FOREIGN KEY(userID) REFERENCES users(idUser) ON DELETE CASCADE
+	);`,
+		`CREATE INDEX IF NOT EXISTS idx_content_fingerprints_created ON content_fingerprints (created_at)`,
+	}
+	for _, createTableSQL := range statements {
+		statement, err := db.Prepare(createTableSQL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statement.Exec()
+	}
+	fmt.Println("Content fingerprints table created")
+}
+
+// contentTokens splits text into lowercase words, ignoring punctuation
+func contentTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// simhash fingerprints text from its overlapping word shingles, so texts that
+// differ in a few words end up a few bits apart. Text without words hashes to
+// 0, which never counts as a duplicate.
+func simhash(text string) uint64 {
+	tokens := contentTokens(text)
+	if len(tokens) == 0 {
+		return 0
+	}
+	size := shingleSize
+	if len(tokens) < size {
+		size = len(tokens)
+	}
+
+	var weights [64]int
+	for i := 0; i+size <= len(tokens); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(tokens[i:i+size], " ")))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var fingerprint uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+func isNearDuplicate(a, b uint64) bool {
+	return a != 0 && b != 0 && bits.OnesCount64(a^b) <= nearDuplicateDistance
+}
+
+// collectSpamSignals works out the signals for content by userID at now,
+// given the recent fingerprints around it, newest or oldest first
+func collectSpamSignals(text string, fingerprint uint64, userID int, now time.Time, recent []contentFingerprint) spamSignals {
+	signals := spamSignals{Links: len(urlPattern.FindAllString(text, -1)), Words: len(contentTokens(text))}
+	otherUsers := map[int]bool{}
+	for _, item := range recent {
+		age := now.Sub(item.CreatedAt)
+		if age < 0 {
+			continue
+		}
+		if item.UserID == userID {
+			if age <= spamVelocityWindow {
+				signals.RecentItems++
+			}
+			if age <= spamOwnWindow && isNearDuplicate(fingerprint, item.Simhash) {
+				signals.OwnDuplicates++
+			}
+		} else if age <= spamSiteWindow && isNearDuplicate(fingerprint, item.Simhash) {
+			otherUsers[item.UserID] = true
+		}
+	}
+	signals.SiteDuplicates = len(otherUsers)
+	return signals
+}
+
+func clamp01(value float64) float64 {
+	return max(0, min(1, value))
+}
+
+// spamScore turns signals into a score between 0 and 1. Every signal is
+// scaled to 0..1 first: a single own repeat, two other users posting the same
+// thing, ten items in the velocity window, one link per six words and a brand
+// new account each max out their signal.
+func spamScore(signals spamSignals) float64 {
+	score := spamWeights.OwnDuplicates * clamp01(float64(signals.OwnDuplicates))
+	score += spamWeights.SiteDuplicates * clamp01(float64(signals.SiteDuplicates)/2)
+	score += spamWeights.Velocity * clamp01(float64(signals.RecentItems-2)/8)
+	if signals.Words > 0 {
+		score += spamWeights.LinkDensity * clamp01(6*float64(signals.Links)/float64(signals.Words))
+	}
+	if signals.AgeKnown {
+		score += spamWeights.AccountAge * clamp01(1-float64(signals.AccountAge)/float64(spamNewAccountAge))
+	}
+	return score
+}
+
+// spamAction is the automod action a score calls for, empty when none
+func spamAction(score float64) string {
+	switch {
+	case score >= spamHoldThreshold:
+		return automodHold
+	case score >= spamFlagThreshold:
+		return automodFlag
+	}
+	return ""
+}
+
+// loadRecentFingerprints returns the fingerprints spam scoring needs: the
+// user's own within spamOwnWindow and everyone's within spamSiteWindow
+func loadRecentFingerprints(userID int, now time.Time) ([]contentFingerprint, error) {
+	rows, err := db.Query(`
+        SELECT userID, simhash, created_at FROM content_fingerprints
+        WHERE (userID = ? AND created_at > ?) OR created_at > ?
+        ORDER BY created_at DESC
+        LIMIT ?`,
+		userID, now.Add(-spamOwnWindow).Format(time.RFC3339), now.Add(-spamSiteWindow).Format(time.RFC3339), spamHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recent []contentFingerprint
+	for rows.Next() {
+		var item contentFingerprint
+		var hash int64
+		var createdAt string
+		if err := rows.Scan(&item.UserID, &hash, &createdAt); err != nil {
+			return nil, err
+		}
+		item.Simhash = uint64(hash)
+		if item.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+			continue
+		}
+		recent = append(recent, item)
+	}
+	return recent, rows.Err()
+}
+
+// scoreSpam scores new content and raises the verdict to flag or hold it when
+// the score calls for that. Automod rules that already reject or hold the
+// content win over the score.
+func (v *automodVerdict) scoreSpam() error {
+	now := time.Now().UTC()
+	recent, err := loadRecentFingerprints(v.Content.UserID, now)
+	if err != nil {
+		return err
+	}
+	age, known, err := accountAge(v.Content.UserID)
+	if err != nil {
+		return err
+	}
+
+	v.Fingerprint = simhash(v.Content.Text)
+	signals := collectSpamSignals(v.Content.Text, v.Fingerprint, v.Content.UserID, now, recent)
+	signals.AccountAge, signals.AgeKnown = age, known
+	v.SpamScore = spamScore(signals)
+	v.Scored = true
+
+	if action := spamAction(v.SpamScore); automodActionRank[action] > automodActionRank[v.Action] {
+		v.Action = action
+		v.SpamAction = true
+	}
+	return nil
+}
+
+// storeFingerprint keeps scored content around for later near-duplicate and
+// velocity checks
+func (v *automodVerdict) storeFingerprint(exec execer, targetID int64) error {
+	if !v.Scored {
+		return nil
+	}
+	_, err := exec.Exec(`INSERT INTO content_fingerprints (targetType, targetID, userID, simhash, spamScore, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		v.Content.TargetType, targetID, v.Content.UserID, int64(v.Fingerprint), v.SpamScore, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// spamFixture is one item of the evaluation corpus. Minute places it in time
+// relative to the start of the corpus.
+type spamFixture struct {
+	User            int     `json:"user"`
+	Minute          float64 `json:"minute"`
+	AccountAgeHours float64 `json:"accountAgeHours"`
+	Text            string  `json:"text"`
+	Spam            bool    `json:"spam"`
+}
+
+// runSpamEvaluation scores a JSON lines corpus of labelled posts offline and
+// prints how well the flag and hold thresholds separate spam from the rest.
+// Items are scored in order against the items before them, as they would be
+// when posted live.
+func runSpamEvaluation(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var fixtures []spamFixture
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var fixture spamFixture
+		if err := json.Unmarshal(scanner.Bytes(), &fixture); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	type outcome struct{ truePositive, falsePositive, falseNegative, trueNegative int }
+	outcomes := map[string]*outcome{automodFlag: {}, automodHold: {}}
+	thresholds := map[string]float64{automodFlag: spamFlagThreshold, automodHold: spamHoldThreshold}
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var history []contentFingerprint
+	for _, fixture := range fixtures {
+		now := start.Add(time.Duration(fixture.Minute * float64(time.Minute)))
+		fingerprint := simhash(fixture.Text)
+		signals := collectSpamSignals(fixture.Text, fingerprint, fixture.User, now, history)
+		signals.AccountAge = time.Duration(fixture.AccountAgeHours * float64(time.Hour))
+		signals.AgeKnown = true
+		score := spamScore(signals)
+		history = append(history, contentFingerprint{UserID: fixture.User, Simhash: fingerprint, CreatedAt: now})
+
+		for action, threshold := range thresholds {
+			caught := score >= threshold
+			switch {
+			case caught && fixture.Spam:
+				outcomes[action].truePositive++
+			case caught:
+				outcomes[action].falsePositive++
+			case fixture.Spam:
+				outcomes[action].falseNegative++
+			default:
+				outcomes[action].trueNegative++
+			}
+		}
+		if (score >= spamFlagThreshold) != fixture.Spam {
+			fmt.Printf("misclassified spam=%t score=%.2f user=%d: %s\n", fixture.Spam, score, fixture.User, fixture.Text)
+		}
+	}
+
+	fmt.Printf("%d items scored\n", len(fixtures))
+	for _, action := range []string{automodFlag, automodHold} {
+		o := outcomes[action]
+		precision := float64(o.truePositive) / float64(max(1, o.truePositive+o.falsePositive))
+		recall := float64(o.truePositive) / float64(max(1, o.truePositive+o.falseNegative))
+		fmt.Printf("%s at %.2f: precision %.2f, recall %.2f (tp %d, fp %d, fn %d, tn %d)\n",
+			action, thresholds[action], precision, recall, o.truePositive, o.falsePositive, o.falseNegative, o.trueNegative)
+	}
+	return nil
+}
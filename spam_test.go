@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openTestDB points db at a fresh database with every table and the users
+// alice (1) and bob (2)
+func openTestDB(t *testing.T) {
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDB := db
+	t.Cleanup(func() {
+		database.Close()
+		db = savedDB
+	})
+	db = database
+
+	createTables(database)
+	for _, username := range []string{"alice", "bob"} {
+		_, err := db.Exec(`INSERT INTO users (username, displayName, email, password, created_at) VALUES (?, ?, ?, 'pw', '2020-01-01T00:00:00Z')`,
+			username, username, username+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// postAs calls a protected handler as the given user
+func postAs(t *testing.T, userID int, handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set("user", &JwtCustomClaims{UserID: userID, Role: roleUser})
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// Spam history is kept per author, so content has to be stored under the
+// user who was scored for it
+func TestContentIsAttributedToTheCaller(t *testing.T) {
+	openTestDB(t)
+	const alice, bob = 1, 2
+
+	for _, tc := range []struct {
+		name    string
+		handler echo.HandlerFunc
+		forged  string
+		own     string
+		table   string
+		author  string
+	}{
+		{"post", AddPost,
+			`{"content_text":"buy now","userID":"2"}`,
+			`{"content_text":"buy now"}`,
+			"posts", "userID"},
+		{"comment", AddComment,
+			`{"postID":"1","contentText":"buy now","userID":"2"}`,
+			`{"postID":"1","contentText":"buy now"}`,
+			"comments", "idUser"},
+		{"message", SendMessages,
+			`{"receiverID":"2","content":"buy now","senderID":"2"}`,
+			`{"receiverID":"2","content":"buy now"}`,
+			"messages", "senderID"},
+	} {
+		before := countRows(t, `SELECT COUNT(*) FROM `+tc.table)
+		if rec := postAs(t, alice, tc.handler, tc.forged); rec.Code != http.StatusForbidden {
+			t.Errorf("%s as bob = %d %s, want it rejected", tc.name, rec.Code, rec.Body)
+		}
+		if after := countRows(t, `SELECT COUNT(*) FROM `+tc.table); after != before {
+			t.Errorf("rejected %s was stored", tc.name)
+		}
+
+		if rec := postAs(t, alice, tc.handler, tc.own); rec.Code != http.StatusOK {
+			t.Fatalf("%s = %d %s", tc.name, rec.Code, rec.Body)
+		}
+		if n := countRows(t, `SELECT COUNT(*) FROM `+tc.table+` WHERE `+tc.author+` = ?`, bob); n != 0 {
+			t.Errorf("%d %ss stored under bob", n, tc.name)
+		}
+	}
+
+	// The post and comment were scored, their fingerprints belong to alice
+	if n := countRows(t, `SELECT COUNT(*) FROM content_fingerprints WHERE userID = ?`, alice); n != 2 {
+		t.Errorf("alice has %d fingerprints, want 2", n)
+	}
+	if n := countRows(t, `SELECT COUNT(*) FROM content_fingerprints WHERE userID != ?`, alice); n != 0 {
+		t.Errorf("%d fingerprints belong to someone else", n)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxThreadLength       = 25
+	maxConversationDepth  = 100
+	conversationPageLimit = 20
+)
+
+type ConversationPost struct {
+	IDPost      int    `json:"idPost"`
+	UserID      int    `json:"userID,omitempty"`
+	ContentText string `json:"content_text,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+	ImageURL    string `json:"imageURL,omitempty"`
+	InReplyToID int    `json:"inReplyToID"`
+	ReplyCount  int    `json:"replyCount"`
+	// Unavailable marks deleted posts kept in the chain so replies stay in context
+	Unavailable bool `json:"unavailable"`
+}
+
+// AddThread publishes several posts by the current user at once, each one
+// replying to the previous. Either the whole thread is stored or none of it.
+func AddThread(c echo.Context) error {
+	type ThreadPost struct {
+		ContentText     string   `json:"content_text"`
+		ImageURL        string   `json:"imageURL"`
+		SecondaryImages []string `json:"secondaryImages"`
+	}
+	type ThreadRequest struct {
+		CategoryID  string       `json:"categoryID"`
+		InReplyToID int          `json:"inReplyToID"`
+		Visibility  string       `json:"visibility"`
+		Posts       []ThreadPost `json:"posts"`
+	}
+
+	req := new(ThreadRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request data"})
+	}
+
+	if len(req.Posts) < 2 || len(req.Posts) > maxThreadLength {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "A thread needs between 2 and " + strconv.Itoa(maxThreadLength) + " posts",
+		})
+	}
+	for _, post := range req.Posts {
+		if post.ContentText == "" {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Every post in a thread needs content text"})
+		}
+	}
+
+	visibility, err := parseVisibility(req.Visibility)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if nullableID(req.CategoryID) != nil {
+		if status, err := checkCanPost(req.CategoryID, currentUser(c).UserID); err != nil {
+			return c.JSON(status, echo.Map{"error": err.Error()})
+		}
+	}
+
+	// Every post goes through automatic moderation and spam scoring, one
+	// rejected post rejects the whole thread
+	categoryID, _ := strconv.Atoi(req.CategoryID)
+	verdicts := []*automodVerdict{}
+	for _, post := range req.Posts {
+		verdict, ok := checkAutomod(c, automodContent{
+			TargetType: reportTargetPost,
+			UserID:     currentUser(c).UserID,
+			CategoryID: categoryID,
+			Text:       post.ContentText,
+		})
+		if !ok {
+			return nil
+		}
+		if err := verdict.scoreSpam(); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to score post: " + err.Error()})
+		}
+		verdicts = append(verdicts, verdict)
+	}
+
+	var inReplyToID interface{}
+	if req.InReplyToID != 0 {
+		exists, err := publishedPostExists(req.InReplyToID, currentUser(c).UserID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+		if !exists {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Post to reply to not found"})
+		}
+		inReplyToID = req.InReplyToID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+	defer tx.Rollback()
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	postIDs := []int64{}
+	statuses := []string{}
+	previewURLs := []string{}
+	for i, post := range req.Posts {
+		previewURL := extractFirstURL(post.ContentText)
+		previewURLs = append(previewURLs, previewURL)
+
+		query := `INSERT INTO posts (content_text, imageURL, created_at, userID, categoryID, inReplyToID, previewURL, visibility)
+                  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+		result, err := tx.Exec(query, post.ContentText, post.ImageURL, createdAt,
+			currentUser(c).UserID, nullableID(req.CategoryID), inReplyToID, nullableString(previewURL), visibility)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+
+		postID, err := result.LastInsertId()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+		if err := storeMentions(tx, postID, post.ContentText); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+
+		for _, imageURL := range post.SecondaryImages {
+			if _, err := tx.Exec(`INSERT INTO images (postID, imageURL) VALUES (?, ?)`, postID, imageURL); err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+			}
+		}
+
+		if err := verdicts[i].apply(tx, postID); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+		}
+		status := postStatusPublished
+		if verdicts[i].Action == automodHold {
+			status = postStatusHeld
+		}
+
+		postIDs = append(postIDs, postID)
+		statuses = append(statuses, status)
+		inReplyToID = postID
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error()})
+	}
+
+	for _, previewURL := range previewURLs {
+		queueLinkPreview(previewURL)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Thread created", "postIDs": postIDs, "statuses": statuses})
+}
+
+// loadConversationPost reads a post for the conversation view. Deleted and
+// unpublished posts, and those hidden from the viewer, come back as
+// unavailable but keep their reply link.
+func loadConversationPost(postID, viewerID int) (ConversationPost, error) {
+	post := ConversationPost{IDPost: postID}
+	var available bool
+	visible, visibleArgs := postVisibleSQL("p", viewerID)
+	query := `
+        SELECT userID, content_text, created_at, COALESCE(imageURL, ''), COALESCE(inReplyToID, 0),
+               (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                   AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)),
+               deleted_at IS NULL AND status = 'published' AND ` + visible + `
+        FROM posts p
+        WHERE idPost = ?`
+	err := db.QueryRow(query, append(visibleArgs, postID)...).Scan(&post.UserID, &post.ContentText, &post.CreatedAt,
+		&post.ImageURL, &post.InReplyToID, &post.ReplyCount, &available)
+	if err != nil {
+		return post, err
+	}
+
+	if !available {
+		post = ConversationPost{IDPost: postID, InReplyToID: post.InReplyToID, Unavailable: true}
+	}
+	return post, nil
+}
+
+// GetConversation returns the chain of posts a post replies to, root first,
+// along with its direct replies. Replies continuing the author's own thread
+// come first, the rest are ranked by votes and replies.
+func GetConversation(c echo.Context) error {
+	postID, err := strconv.Atoi(c.QueryParam("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid post ID format"})
+	}
+
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		if offset, err = strconv.Atoi(c.QueryParam("offset")); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid offset parameter"})
+		}
+	}
+
+	viewer := viewerID(c)
+	post, err := loadConversationPost(postID, viewer)
+	if err == sql.ErrNoRows || (err == nil && post.Unavailable) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Post not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query post"})
+	}
+
+	ancestors := []ConversationPost{}
+	seen := map[int]bool{postID: true}
+	for parentID := post.InReplyToID; parentID != 0 && !seen[parentID] && len(ancestors) < maxConversationDepth; {
+		seen[parentID] = true
+		parent, err := loadConversationPost(parentID, viewer)
+		if err == sql.ErrNoRows {
+			// Purged for good, nothing left to follow
+			ancestors = append(ancestors, ConversationPost{IDPost: parentID, Unavailable: true})
+			break
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query conversation"})
+		}
+		ancestors = append(ancestors, parent)
+		parentID = parent.InReplyToID
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+
+	visible, visibleArgs := postVisibleSQL("p", viewer)
+	query := `
+        SELECT p.idPost, p.userID, p.content_text, p.created_at, COALESCE(p.imageURL, ''), p.inReplyToID,
+               (SELECT COUNT(*) FROM posts rp WHERE rp.inReplyToID = p.idPost AND rp.deleted_at IS NULL AND rp.status = 'published'
+                   AND rp.userID NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)) as replyCount
+        FROM posts p
+        WHERE p.inReplyToID = ? AND p.deleted_at IS NULL AND p.status = 'published' AND ` + visible + `
+        ORDER BY
+            p.userID = ? DESC,
+            COALESCE((SELECT SUM(l.like) FROM likes_dislikes l WHERE l.idPost = p.idPost AND l.idUser NOT IN (SELECT idUser FROM users WHERE shadowbanned_at IS NOT NULL)), 0) + 2 * replyCount DESC,
+            p.created_at
+        LIMIT ? OFFSET ?`
+	args := append([]interface{}{postID}, visibleArgs...)
+	rows, err := db.Query(query, append(args, post.UserID, conversationPageLimit, offset)...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to query replies"})
+	}
+	defer rows.Close()
+
+	replies := []ConversationPost{}
+	for rows.Next() {
+		var reply ConversationPost
+		if err := rows.Scan(&reply.IDPost, &reply.UserID, &reply.ContentText, &reply.CreatedAt,
+			&reply.ImageURL, &reply.InReplyToID, &reply.ReplyCount); err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to scan reply data"})
+		}
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error iterating over rows"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ancestors": ancestors,
+		"post":      post,
+		"replies":   replies,
+	})
+}
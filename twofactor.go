@@ -0,0 +1,504 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Codes follow RFC 6238 with the settings every authenticator app
+	// defaults to
+	totpIssuer = "Twitter-Reddit Clone"
+	totpPeriod = 30
+	totpDigits = 6
+	// Codes from one period either side are accepted, for clocks that drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// The second login step has to happen within this long of the password
+	twoFactorChallengeTTL = 5 * time.Minute
+
+	secondFactorTOTP     = "totp"
+	secondFactorRecovery = "recovery_code"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// createRecoveryCodesTable stores the one-time codes that stand in for the
+// authenticator app when it is lost. Like account tokens, only hashes are
+// kept.
+func createRecoveryCodesTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS recovery_codes (
+		"idCode" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"userID" INTEGER NOT NULL,
+		"codeHash" TEXT NOT NULL,
+		"created_at" TEXT,
+		"used_at" TEXT,
+		FOREIGN KEY(userID) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Recovery codes table created")
+}
+
+// totpCode is the code for secret in the given time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the time step code belongs to at now, or 0 when it
+// doesn't match any step within the allowed skew
+func matchTOTP(secret string, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+func newTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(raw), nil
+}
+
+// totpURI is the otpauth link authenticator apps read, usually from a QR code
+func totpURI(username, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + query.Encode()
+}
+
+// normalizeRecoveryCode lets recovery codes be typed with or without the
+// dash and in any case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes voids a user's recovery codes and returns a fresh set.
+// They are shown once, only their hashes are stored.
+func replaceRecoveryCodes(exec execer, userID int, now time.Time) ([]string, error) {
+	if _, err := exec.Exec(`DELETE FROM recovery_codes WHERE userID = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		_, err := exec.Exec(`INSERT INTO recovery_codes (userID, codeHash, created_at) VALUES (?, ?, ?)`,
+			userID, hashAccountToken(normalizeRecoveryCode(code)), now.UTC().Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts either a code from the user's authenticator app
+// or one of their unused recovery codes, and returns which it was. It returns
+// an empty method when the code is wrong. A code that worked once is spent,
+// an authenticator code can't be replayed within its window and a recovery
+// code is used up.
+func checkSecondFactor(tx *sql.Tx, userID int, code string, now time.Time) (string, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return "", nil
+	}
+
+	var secret string
+	err := tx.QueryRow(`SELECT COALESCE(totp_secret, '') FROM users WHERE idUser = ?`, userID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", nil
+	}
+
+	if step := matchTOTP(secret, code, now); step != 0 {
+		result, err := tx.Exec(`UPDATE users SET totp_last_step = ? WHERE idUser = ? AND totp_last_step < ?`, step, userID, step)
+		if err != nil {
+			return "", err
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+			return "", err
+		}
+		return secondFactorTOTP, nil
+	}
+
+	result, err := tx.Exec(`UPDATE recovery_codes SET used_at = ? WHERE userID = ? AND codeHash = ? AND used_at IS NULL`,
+		now.UTC().Format(time.RFC3339), userID, hashAccountToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return "", err
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return "", err
+	}
+	return secondFactorRecovery, nil
+}
+
+// twoFactorEnabled reports whether logging in as userID needs a second factor
+func twoFactorEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT totp_enabled_at IS NOT NULL FROM users WHERE idUser = ?`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// startTwoFactorLogin answers a correct password on an account with 2FA. The
+// challenge it returns is exchanged, along with a code, for the real token at
+// LoginTwoFactor.
+func startTwoFactorLogin(c echo.Context, userID int) error {
+	challenge, err := issueAccountToken(db, userID, accountTokenTwoFactor, "", twoFactorChallengeTTL, loginGuard.now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to start two-factor login"})
+	}
+	recordAudit(c, userID, auditActionLoginChallenge, "user", userID, nil, nil)
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"twoFactorRequired": true,
+		"challenge":         challenge,
+	})
+}
+
+// LoginTwoFactor finishes a login on an account with 2FA, issuing the token
+// once the challenge from Login comes back with a code from the user's
+// authenticator app or a recovery code. Wrong codes count towards the login
+// lockout like wrong passwords do.
+func LoginTwoFactor(c echo.Context) error {
+	type TwoFactorRequest struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Challenge and code are required"})
+	}
+
+	now := loginGuard.now()
+	userID, err := accountTokenUser(accountTokenTwoFactor, req.Challenge, now)
+	if err == errInvalidAccountToken {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Login expired, please log in again"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check challenge"})
+	}
+	if throttled, err := rejectThrottledLogin(c, userID, nil); throttled {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	method, err := checkSecondFactor(tx, userID, req.Code, now)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check code"})
+	}
+	if method == "" {
+		// The challenge stays usable for another try. The transaction has to
+		// end before the failure is written.
+		tx.Rollback()
+		recordAudit(c, 0, auditActionLoginFailed, "user", userID, nil, echo.Map{"reason": "two_factor"})
+		countLoginFailure(c, userID)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid code"})
+	}
+	// Only one of two requests racing with the same challenge gets a token
+	if _, _, err := consumeAccountToken(tx, accountTokenTwoFactor, req.Challenge, now); err == errInvalidAccountToken {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Login expired, please log in again"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check challenge"})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check code"})
+	}
+
+	var user User
+	err = db.QueryRow(`SELECT idUser, username, displayName, email FROM users WHERE idUser = ?`, userID).
+		Scan(&user.IDUser, &user.Username, &user.DisplayName, &user.Email)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	state, err := loadAccountState(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if state.Suspended {
+		status, body := checkAccountState(state, now.Unix(), "")
+		return c.JSON(status, body)
+	}
+	if method == secondFactorRecovery {
+		sendEmail(userID, "A recovery code was used",
+			"One of your two-factor recovery codes was just used to log in.\n\n"+
+				"If this wasn't you, change your password and generate new recovery codes straight away.")
+	}
+	return finishLogin(c, user, state, echo.Map{"method": method})
+}
+
+// reauthenticate checks the current user's password and a second factor
+// again before their 2FA setup changes, so a stolen session alone can't turn
+// it off. Failures count towards the login lockout, callers check it before
+// starting tx. It returns whether the request was rejected, and the response
+// if so.
+func reauthenticate(c echo.Context, tx *sql.Tx, userID int, password, code string) (bool, error) {
+	var passwordMatches bool
+	err := tx.QueryRow(`SELECT password = ? FROM users WHERE idUser = ?`, password, userID).Scan(&passwordMatches)
+	if err != nil {
+		return true, c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	method := ""
+	if passwordMatches {
+		method, err = checkSecondFactor(tx, userID, code, loginGuard.now())
+		if err != nil {
+			return true, c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to check code"})
+		}
+	}
+	if method == "" {
+		tx.Rollback()
+		recordAudit(c, userID, auditActionLoginFailed, "user", userID, nil, echo.Map{"reason": "reauthenticate"})
+		countLoginFailure(c, userID)
+		return true, c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid password or code"})
+	}
+	return false, nil
+}
+
+// EnrollTwoFactor starts setting up 2FA for the current user. The secret only
+// takes effect once ConfirmTwoFactor sees a code made from it, so a half
+// finished setup can't lock anyone out.
+func EnrollTwoFactor(c echo.Context) error {
+	userID := currentUser(c).UserID
+	var username string
+	var enabled bool
+	err := db.QueryRow(`SELECT username, totp_enabled_at IS NOT NULL FROM users WHERE idUser = ?`, userID).Scan(&username, &enabled)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if enabled {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is already enabled"})
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create secret"})
+	}
+	if _, err := db.Exec(`UPDATE users SET totp_pending_secret = ? WHERE idUser = ?`, secret, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to start enrollment"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"secret": secret,
+		"uri":    totpURI(username, secret),
+	})
+}
+
+// ConfirmTwoFactor turns 2FA on with the first code from the user's
+// authenticator app, and returns their recovery codes
+func ConfirmTwoFactor(c echo.Context) error {
+	type ConfirmRequest struct {
+		Code string `json:"code"`
+	}
+
+	var req ConfirmRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Code is required"})
+	}
+	userID := currentUser(c).UserID
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabled bool
+	err = tx.QueryRow(`SELECT COALESCE(totp_pending_secret, ''), totp_enabled_at IS NOT NULL FROM users WHERE idUser = ?`, userID).
+		Scan(&secret, &enabled)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if enabled {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is already enabled"})
+	}
+	if secret == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Start enrollment first"})
+	}
+	now := loginGuard.now()
+	step := matchTOTP(secret, strings.TrimSpace(req.Code), now)
+	if step == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid code"})
+	}
+	before := snapshot("user", userID)
+
+	_, err = tx.Exec(`
+        UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = NULL, totp_enabled_at = ?, totp_last_step = ?
+        WHERE idUser = ?`,
+		now.UTC().Format(time.RFC3339), step, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to enable two-factor authentication"})
+	}
+	codes, err := replaceRecoveryCodes(tx, userID, now)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create recovery codes"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to enable two-factor authentication"})
+	}
+	recordAudit(c, userID, auditActionEnableTwoFactor, "user", userID, before, snapshot("user", userID))
+	sendEmail(userID, "Two-factor authentication is on",
+		"Logging in to your account now needs a code from your authenticator app.\n\n"+
+			"If this wasn't you, reset your password straight away.")
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message":       "Two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTwoFactor turns 2FA off after checking the password and a code again
+func DisableTwoFactor(c echo.Context) error {
+	type DisableRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var req DisableRequest
+	if err := c.Bind(&req); err != nil || req.Password == "" || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Password and code are required"})
+	}
+	userID := currentUser(c).UserID
+
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if !enabled {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is not enabled"})
+	}
+	if throttled, err := rejectThrottledLogin(c, userID, nil); throttled {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if rejected, err := reauthenticate(c, tx, userID, req.Password, req.Code); rejected {
+		return err
+	}
+	before := snapshot("user", userID)
+
+	_, err = tx.Exec(`
+        UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+        WHERE idUser = ?`, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to disable two-factor authentication"})
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE userID = ?`, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to disable two-factor authentication"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to disable two-factor authentication"})
+	}
+	recordAudit(c, userID, auditActionDisableTwoFactor, "user", userID, before, snapshot("user", userID))
+	sendEmail(userID, "Two-factor authentication is off",
+		"Logging in to your account no longer needs a code from your authenticator app.\n\n"+
+			"If this wasn't you, reset your password straight away.")
+
+	return c.JSON(http.StatusOK, echo.Map{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes after
+// checking the password and a code again. The old codes stop working.
+func RegenerateRecoveryCodes(c echo.Context) error {
+	type RegenerateRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var req RegenerateRequest
+	if err := c.Bind(&req); err != nil || req.Password == "" || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Password and code are required"})
+	}
+	userID := currentUser(c).UserID
+
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load account"})
+	}
+	if !enabled {
+		return c.JSON(http.StatusConflict, echo.Map{"error": "Two-factor authentication is not enabled"})
+	}
+	if throttled, err := rejectThrottledLogin(c, userID, nil); throttled {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	if rejected, err := reauthenticate(c, tx, userID, req.Password, req.Code); rejected {
+		return err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID, loginGuard.now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create recovery codes"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create recovery codes"})
+	}
+	recordAudit(c, userID, auditActionRegenerateCodes, "user", userID, nil, nil)
+
+	return c.JSON(http.StatusOK, echo.Map{"recoveryCodes": codes})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 Appendix B test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes, ours are their last 6 digits
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(rfc6238Secret, tc.unix/totpPeriod); got != tc.code {
+			t.Errorf("totpCode at %d = %s, want %s", tc.unix, got, tc.code)
+		}
+	}
+}
+
+func TestMatchTOTPSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Secret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for _, tc := range []struct {
+		name string
+		code string
+		want int64
+	}{
+		{"current step", totpCode(rfc6238Secret, current), current},
+		{"one step behind", totpCode(rfc6238Secret, current-1), current - 1},
+		{"one step ahead", totpCode(rfc6238Secret, current+1), current + 1},
+		{"two steps behind", totpCode(rfc6238Secret, current-2), 0},
+		{"two steps ahead", totpCode(rfc6238Secret, current+2), 0},
+		{"8 digit RFC code", "14050471", 0},
+		{"too short", "50471", 0},
+	} {
+		if got := matchTOTP(secret, tc.code, now); got != tc.want {
+			t.Errorf("%s: matchTOTP(%s) = %d, want %d", tc.name, tc.code, got, tc.want)
+		}
+	}
+
+	if got := matchTOTP("not base32!", totpCode(rfc6238Secret, current), now); got != 0 {
+		t.Errorf("matchTOTP with a malformed secret = %d, want 0", got)
+	}
+}
+
+func TestSecondFactorRejectsReplay(t *testing.T) {
+	openTestDB(t)
+	const alice = 1
+	_, err := db.Exec(`UPDATE users SET totp_secret = ? WHERE idUser = ?`, totpEncoding.EncodeToString(rfc6238Secret), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	// Each attempt runs at now, in order. A step that worked once, or one
+	// before it, can't be used again.
+	for _, tc := range []struct {
+		name string
+		step int64
+		want string
+	}{
+		{"first use", current - 1, secondFactorTOTP},
+		{"replayed", current - 1, ""},
+		{"next step", current, secondFactorTOTP},
+		{"replayed again", current, ""},
+		{"older step", current - 1, ""},
+		{"step ahead", current + 1, secondFactorTOTP},
+	} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		method, err := checkSecondFactor(tx, alice, totpCode(rfc6238Secret, tc.step), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if method != tc.want {
+			t.Errorf("%s: checkSecondFactor = %q, want %q", tc.name, method, tc.want)
+		}
+	}
+}
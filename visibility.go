@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	visibilityPublic    = "public"
+	visibilityFollowers = "followers"
+	visibilityMentioned = "mentioned"
+
+	subscriptionAccepted = "accepted"
+	subscriptionPending  = "pending"
+)
+
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_]+)`)
+
+func createPostMentionsTable(db *sql.DB) {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS post_mentions (
+		"idPost" INTEGER,
+		"idUser" INTEGER,
+		PRIMARY KEY(idPost, idUser),
+		FOREIGN KEY(idPost) REFERENCES posts(idPost) ON DELETE CASCADE,
+		FOREIGN KEY(idUser) REFERENCES users(idUser) ON DELETE CASCADE
+	);`
+	statement, err := db.Prepare(createTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statement.Exec()
+	fmt.Println("Post mentions table created")
+}
+
+// parseVisibility validates a requested post visibility, defaulting to public
+func parseVisibility(visibility string) (string, error) {
+	switch visibility {
+	case "":
+		return visibilityPublic, nil
+	case visibilityPublic, visibilityFollowers, visibilityMentioned:
+		return visibility, nil
+	}
+	return "", errors.New("Visibility must be public, followers or mentioned")
+}
+
+// storeMentions records which existing users a post mentions, replacing the
+// previous set when the post is edited. Users blocked by or blocking the
+// author are never mentioned.
+func storeMentions(tx *sql.Tx, postID interface{}, contentText string) error {
+	if _, err := tx.Exec(`DELETE FROM post_mentions WHERE idPost = ?`, postID); err != nil {
+		return err
+	}
+	for _, match := range mentionPattern.FindAllStringSubmatch(contentText, -1) {
+		_, err := tx.Exec(`
+            INSERT OR IGNORE INTO post_mentions (idPost, idUser)
+            SELECT p.idPost, u.idUser FROM users u, posts p
+            WHERE p.idPost = ? AND u.username = ? AND NOT EXISTS (SELECT 1 FROM blocks bl
+                WHERE (bl.blockerID = u.idUser AND bl.blockedID = p.userID) OR (bl.blockerID = p.userID AND bl.blockedID = u.idUser))`,
+			postID, match[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postVisibleSQL returns the condition a post row must meet for the viewer to
+// see it, along with its arguments. Authors always see their own posts.
+// Private accounts only show posts to accepted followers, followers-only posts
+// need an accepted follow and mentioned-only posts need a mention. Blocks in
+// either direction hide everything, as does being outside a private
+// community or the author being shadowbanned. A viewerID of 0 is a logged out
+// visitor.
+func postVisibleSQL(alias string, viewerID int) (string, []interface{}) {
+	follows := fmt.Sprintf(`EXISTS (SELECT 1 FROM subscriptions vs
+            WHERE vs.subscriberID = ? AND vs.subscribedToID = %[1]s.userID AND vs.status = 'accepted')`, alias)
+	condition := fmt.Sprintf(`(%[1]s.userID = ?
+            OR (%[1]s.visibility = 'public' AND (NOT EXISTS (SELECT 1 FROM users vu WHERE vu.idUser = %[1]s.userID AND vu.private = 1) OR %[2]s))
+            OR (%[1]s.visibility = 'followers' AND %[2]s)
+            OR (%[1]s.visibility = 'mentioned' AND EXISTS (SELECT 1 FROM post_mentions vm WHERE vm.idPost = %[1]s.idPost AND vm.idUser = ?)))
+            AND %[3]s AND %[4]s AND %[5]s`,
+		alias, follows, notBlockedSQL(alias+".userID"), communityVisibleSQL(alias), notShadowbannedSQL(alias+".userID"))
+	return condition, []interface{}{viewerID, viewerID, viewerID, viewerID, viewerID, viewerID, viewerID, viewerID}
+}
+
+// SetAccountPrivacy turns the current user's private account setting on or
+// off. Going public accepts every pending follow request and lets the
+// requesters know.
+func SetAccountPrivacy(c echo.Context) error {
+	type PrivacyRequest struct {
+		Private *bool `json:"private"`
+	}
+
+	var req PrivacyRequest
+	if err := c.Bind(&req); err != nil || req.Private == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Private flag is required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	userID := currentUser(c).UserID
+	if _, err := tx.Exec(`UPDATE users SET private = ? WHERE idUser = ?`, *req.Private, userID); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update privacy: " + err.Error()})
+	}
+	if !*req.Private {
+		_, err := tx.Exec(`
+            INSERT INTO notifications (idUser, actorID, type, targetID, message, created_at)
+            SELECT subscriberID, ?, ?, 0, 'Follow request approved', ? FROM subscriptions
+            WHERE subscribedToID = ? AND status = 'pending'`,
+			userID, notificationFollowRequestApproved, time.Now().UTC().Format(time.RFC3339), userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to send notifications: " + err.Error()})
+		}
+		_, err = tx.Exec(`UPDATE subscriptions SET status = 'accepted' WHERE subscribedToID = ? AND status = 'pending'`, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to accept follow requests: " + err.Error()})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update privacy"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Privacy updated",
+		"private": *req.Private,
+	})
+}
+
+// isPrivateAccount reports whether new followers of a user need approval
+func isPrivateAccount(userID string) (bool, error) {
+	var private bool
+	err := db.QueryRow(`SELECT private FROM users WHERE idUser = ?`, userID).Scan(&private)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return private, err
+}